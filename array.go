@@ -0,0 +1,138 @@
+package sparse
+
+import (
+	"sort"
+)
+
+// Array is a sparse array of elements of type T, such as a sparse register
+// file or tensor.  Elements that have not been set read as the zero value of
+// T.  Like Buffer, it holds runs of consecutive elements that have been set,
+// merging them as they come to touch.
+//
+// The zero value is an empty Array ready to use.
+type Array[T any] struct {
+	runs []run[T]
+	size int64
+}
+
+// run is a run of consecutive elements held by an Array.
+type run[T any] struct {
+	off  int64
+	vals []T
+}
+
+func (r run[T]) start() int64 { return r.off }
+func (r run[T]) end() int64   { return r.off + int64(len(r.vals)) }
+
+// Len returns the length of a, which is one more than the highest index set,
+// unless changed by Truncate.
+func (a *Array[T]) Len() int64 {
+	return a.size
+}
+
+// find returns the index of the first run ending after i.
+func (a *Array[T]) find(i int64) int {
+	return sort.Search(len(a.runs), func(k int) bool { return a.runs[k].end() > i })
+}
+
+// Get returns the element at index i, or the zero value of T if it has not
+// been set.
+func (a *Array[T]) Get(i int64) (v T) {
+	if k := a.find(i); k < len(a.runs) && a.runs[k].off <= i {
+		v = a.runs[k].vals[i-a.runs[k].off]
+	}
+	return
+}
+
+// Set sets the element at index i to v.  Panics if i is negative.
+func (a *Array[T]) Set(i int64, v T) {
+	a.SetRange(i, []T{v})
+}
+
+// SetRange sets the elements starting at index i to a copy of vs.  Panics if i
+// is negative.
+func (a *Array[T]) SetRange(i int64, vs []T) {
+	if i < 0 {
+		panic("sparse: negative Array index")
+	}
+	if len(vs) == 0 {
+		return
+	}
+	end := i + int64(len(vs))
+	if end > a.size {
+		a.size = end
+	}
+	left, right, keepLeft, keepRight, ok := span(a.runs, i, int64(len(vs)))
+	if !ok {
+		k, _ := fit(a.runs, i, int64(len(vs)))
+		a.runs = append(a.runs, run[T]{})
+		copy(a.runs[k+1:], a.runs[k:])
+		a.runs[k] = run[T]{i, append([]T(nil), vs...)}
+		return
+	}
+
+	l, r := a.runs[left], a.runs[right]
+	n := int(keepLeft) + len(vs) + int(keepRight)
+	vals := l.vals
+	if cap(vals) >= n {
+		vals = vals[:n]
+	} else {
+		vals = make([]T, n)
+		copy(vals, l.vals[:keepLeft])
+	}
+	// Move what we keep of the right run before copying vs, in case they
+	// share storage.
+	copy(vals[int(keepLeft)+len(vs):], r.vals[len(r.vals)-int(keepRight):])
+	copy(vals[keepLeft:], vs)
+	if i < l.off {
+		l.off = i
+	}
+	a.runs[left] = run[T]{l.off, vals}
+	if right > left {
+		copy(a.runs[left+1:], a.runs[right+1:])
+		tail := len(a.runs) - (right - left)
+		for k := tail; k < len(a.runs); k++ {
+			a.runs[k] = run[T]{} // release the storage of deleted runs
+		}
+		a.runs = a.runs[:tail]
+	}
+}
+
+// Range calls fn for each run of consecutive elements that have been set, in
+// order, with the index of the first element and the elements themselves.  If
+// fn returns false, Range stops.  vals refers to a's own storage, so fn should
+// not modify or retain it.
+func (a *Array[T]) Range(fn func(i int64, vals []T) bool) {
+	for _, r := range a.runs {
+		if !fn(r.off, r.vals) {
+			return
+		}
+	}
+}
+
+// Extents returns the extents of the elements in a that have been set.
+func (a *Array[T]) Extents() (es []Extent) {
+	for _, r := range a.runs {
+		es = append(es, Extent{r.off, int64(len(r.vals))})
+	}
+	return
+}
+
+// Truncate sets the length of a to n.  Elements at and after index n are
+// deleted.
+func (a *Array[T]) Truncate(n int64) {
+	if n < 0 {
+		panic("sparse: negative Array length")
+	}
+	a.size = n
+	k := a.find(n)
+	if k < len(a.runs) && a.runs[k].off < n {
+		r := &a.runs[k]
+		r.vals = append([]T(nil), r.vals[:n-r.off]...)
+		k++
+	}
+	for j := k; j < len(a.runs); j++ {
+		a.runs[j] = run[T]{}
+	}
+	a.runs = a.runs[:k]
+}
@@ -0,0 +1,117 @@
+package sparse_test
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+type register struct {
+	Value uint32
+	Valid bool
+}
+
+func TestArrayRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		var a sparse.Array[register]
+		var model []register
+		var set []bool
+		var ops []string
+		for j := 0; j < 20; j++ {
+			off := r.Int63n(64)
+			switch r.Intn(5) {
+			case 0:
+				a.Truncate(off)
+				if off < int64(len(model)) {
+					model, set = model[:off], set[:off]
+				} else {
+					model = append(model, make([]register, off-int64(len(model)))...)
+					set = append(set, make([]bool, off-int64(len(set)))...)
+				}
+				ops = append(ops, fmt.Sprintf("Truncate(%d)", off))
+			default:
+				vs := make([]register, r.Intn(8))
+				for k := range vs {
+					vs[k] = register{uint32(j<<8 | k), true}
+				}
+				a.SetRange(off, vs)
+				if n := off + int64(len(vs)); len(vs) > 0 && n > int64(len(model)) {
+					model = append(model, make([]register, n-int64(len(model)))...)
+					set = append(set, make([]bool, n-int64(len(set)))...)
+				}
+				for k, v := range vs {
+					model[off+int64(k)], set[off+int64(k)] = v, true
+				}
+				ops = append(ops, fmt.Sprintf("SetRange(%d, %d values)", off, len(vs)))
+			}
+
+			if a.Len() != int64(len(model)) {
+				t.Fatalf("%d: Len should be %d, got %d after %v", i, len(model), a.Len(), ops)
+			}
+			for k := int64(0); k < int64(len(model))+2; k++ {
+				var want register
+				if k < int64(len(model)) {
+					want = model[k]
+				}
+				if got := a.Get(k); got != want {
+					t.Fatalf("%d: Get(%d) should be %v, got %v after %v", i, k, want, got, ops)
+				}
+			}
+			var prevEnd int64 = -1
+			a.Range(func(off int64, vals []register) bool {
+				if off <= prevEnd {
+					t.Fatalf("%d: run at %d should not overlap or touch the run ending at %d after %v", i, off, prevEnd, ops)
+				}
+				for k := range vals {
+					if !set[off+int64(k)] {
+						t.Fatalf("%d: Range returned unset index %d after %v", i, off+int64(k), ops)
+					}
+				}
+				prevEnd = off + int64(len(vals))
+				return true
+			})
+		}
+	}
+}
+
+func TestArraySet(t *testing.T) {
+	var a sparse.Array[float64]
+	a.Set(5, 1.5)
+	a.Set(7, 2.5)
+	a.Set(6, 2)
+	a.Set(1000, 3)
+	want := []sparse.Extent{{5, 3}, {1000, 1}}
+	if got := a.Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Extents should be %v, got %v", want, got)
+	}
+	if a.Len() != 1001 {
+		t.Errorf("Len should be 1001, got %d", a.Len())
+	}
+	if got := a.Get(6); got != 2 {
+		t.Errorf("Get(6) should be 2, got %v", got)
+	}
+	if got := a.Get(999); got != 0 {
+		t.Errorf("Get(999) should be 0, got %v", got)
+	}
+}
+
+func ExampleArray() {
+	var regs sparse.Array[uint32]
+	regs.Set(0x10, 0xdead)
+	regs.SetRange(0x11, []uint32{0xbeef, 0xcafe})
+	regs.Set(0x40, 1)
+
+	regs.Range(func(i int64, vals []uint32) bool {
+		fmt.Printf("%#x: %#x\n", i, vals)
+		return true
+	})
+	fmt.Printf("%#x %#x\n", regs.Get(0x12), regs.Get(0x20))
+	// Output:
+	// 0x10: [0xdead 0xbeef 0xcafe]
+	// 0x40: [0x1]
+	// 0xcafe 0x0
+}
@@ -0,0 +1,151 @@
+package sparse
+
+import (
+	"io"
+)
+
+// Bitmap is a sparse set of bits, such as a map of the blocks allocated on a
+// device.  It holds runs of set bits, so it stays small however many bits
+// are set, provided they are set in runs.
+//
+// Bits are indexed from zero.  The methods taking a bit index panic if it is
+// negative.  The zero value is an empty Bitmap ready to use.
+type Bitmap struct {
+	set ExtentSet
+}
+
+// NewBitmap returns a Bitmap with the bits covered by es set.  The extents
+// may be given in any order and may overlap.
+func NewBitmap(es ...Extent) *Bitmap {
+	m := &Bitmap{}
+	for _, e := range es {
+		m.SetRange(e.Off, e.Len)
+	}
+	return m
+}
+
+// BitmapOf returns a Bitmap with a bit for each block of blockSize bytes in
+// f, which is set if the block holds any data.  If blockSize is zero,
+// DefaultBlockSize is used.
+func BitmapOf(f Finder, blockSize int64) (*Bitmap, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	es, err := Extents(f)
+	if err != nil {
+		return nil, err
+	}
+	m := &Bitmap{}
+	for _, e := range es {
+		first, end := e.Off/blockSize, (e.End()+blockSize-1)/blockSize
+		m.set.Add(Extent{first, end - first})
+	}
+	return m, nil
+}
+
+func checkBit(i int64) {
+	if i < 0 {
+		panic("sparse: negative Bitmap index")
+	}
+}
+
+// Set sets bit i.
+func (m *Bitmap) Set(i int64) {
+	m.SetRange(i, 1)
+}
+
+// SetRange sets the n bits starting at i.
+func (m *Bitmap) SetRange(i, n int64) {
+	checkBit(i)
+	m.set.Add(Extent{i, n})
+}
+
+// Clear clears bit i.
+func (m *Bitmap) Clear(i int64) {
+	m.ClearRange(i, 1)
+}
+
+// ClearRange clears the n bits starting at i.
+func (m *Bitmap) ClearRange(i, n int64) {
+	checkBit(i)
+	m.set.Remove(Extent{i, n})
+}
+
+// Test reports whether bit i is set.
+func (m *Bitmap) Test(i int64) bool {
+	checkBit(i)
+	return m.set.Contains(i)
+}
+
+// NextSet returns the index of the first set bit at or after i, and true, or
+// false if there is none.
+func (m *Bitmap) NextSet(i int64) (int64, bool) {
+	checkBit(i)
+	k := m.set.search(i + 1)
+	if k == len(m.set.es) {
+		return 0, false
+	}
+	if off := m.set.es[k].Off; off > i {
+		return off, true
+	}
+	return i, true
+}
+
+// NextClear returns the index of the first clear bit at or after i.
+func (m *Bitmap) NextClear(i int64) int64 {
+	checkBit(i)
+	// Runs are never adjacent, so the bit after a run is always clear.
+	if k := m.set.search(i + 1); k < len(m.set.es) && m.set.es[k].Off <= i {
+		return m.set.es[k].End()
+	}
+	return i
+}
+
+// Count returns the number of bits set.
+func (m *Bitmap) Count() int64 {
+	return m.set.Total()
+}
+
+// Extents returns the runs of set bits in m, in order.
+func (m *Bitmap) Extents() []Extent {
+	return m.set.Extents()
+}
+
+// Finder returns a view of m as a Finder over a file of blocks of blockSize
+// bytes, where the blocks whose bits are set are data and everything else is
+// a hole.  This lets an allocation map be used with SeekData and SeekHole
+// semantics, as by Extents or MapOf.  The Finder's Size is size, or the
+// end of the last block set if that is larger.  Changes to m are visible
+// through the Finder.  If blockSize is zero, DefaultBlockSize is used.
+func (m *Bitmap) Finder(blockSize, size int64) Finder {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return bitmapFinder{m, blockSize, size}
+}
+
+type bitmapFinder struct {
+	m         *Bitmap
+	blockSize int64
+	size      int64
+}
+
+func (f bitmapFinder) Find(ofs int64) (int64, int64, error) {
+	if ofs < 0 {
+		ofs = 0
+	}
+	es := f.m.set.es
+	i := f.m.set.search(ofs/f.blockSize + 1)
+	if i == len(es) {
+		return 0, 0, io.EOF
+	}
+	return es[i].Off * f.blockSize, es[i].Len * f.blockSize, nil
+}
+
+func (f bitmapFinder) Size() int64 {
+	es := f.m.set.es
+	if n := len(es); n > 0 && es[n-1].End()*f.blockSize > f.size {
+		return es[n-1].End() * f.blockSize
+	}
+	return f.size
+}
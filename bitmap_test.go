@@ -0,0 +1,128 @@
+package sparse_test
+
+import (
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func TestBitmapRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 200; iter++ {
+		var m sparse.Bitmap
+		model := make(bitModel, modelSize)
+		for op := 0; op < 20; op++ {
+			e := randomExtent(r)
+			switch r.Intn(4) {
+			case 0:
+				m.SetRange(e.Off, e.Len)
+				model.set(e, true)
+			case 1:
+				m.ClearRange(e.Off, e.Len)
+				model.set(e, false)
+			case 2:
+				m.Set(e.Off)
+				model[e.Off] = true
+			case 3:
+				m.Clear(e.Off)
+				model[e.Off] = false
+			}
+			if got, want := m.Extents(), model.extents(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("iter %d op %d: Extents should return %v, got %v", iter, op, want, got)
+			}
+		}
+
+		var count int64
+		for i := int64(0); i < modelSize; i++ {
+			if model[i] {
+				count++
+			}
+			if got := m.Test(i); got != model[i] {
+				t.Errorf("iter %d: Test(%d) should return %v, got %v", iter, i, model[i], got)
+			}
+			wantSet, wantOK := i, false
+			for ; wantSet < modelSize; wantSet++ {
+				if model[wantSet] {
+					wantOK = true
+					break
+				}
+			}
+			if !wantOK {
+				wantSet = 0
+			}
+			if got, ok := m.NextSet(i); got != wantSet || ok != wantOK {
+				t.Errorf("iter %d: NextSet(%d) should return %d, %v, got %d, %v", iter, i, wantSet, wantOK, got, ok)
+			}
+			wantClear := i
+			for wantClear < modelSize && model[wantClear] {
+				wantClear++
+			}
+			if got := m.NextClear(i); got != wantClear {
+				t.Errorf("iter %d: NextClear(%d) should return %d, got %d", iter, i, wantClear, got)
+			}
+		}
+		if got := m.Count(); got != count {
+			t.Errorf("iter %d: Count should return %d, got %d", iter, count, got)
+		}
+	}
+}
+
+func TestBitmapOf(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("A"), 5)
+	sb.WriteAt([]byte("BB"), 4095)
+	sb.WriteAt([]byte("C"), 4*4096)
+	sb.Truncate(8 * 4096)
+
+	m, err := sparse.BitmapOf(&sb, 4096)
+	if err != nil {
+		t.Fatalf("BitmapOf should succeed, got %v", err)
+	}
+	want := []sparse.Extent{{0, 2}, {4, 1}}
+	if got := m.Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("BitmapOf should set bits %v, got %v", want, got)
+	}
+
+	f := m.Finder(4096, sb.Size())
+	if size := f.Size(); size != 8*4096 {
+		t.Errorf("Finder should have Size %d, got %d", 8*4096, size)
+	}
+	wantExt := []sparse.Extent{{0, 2 * 4096}, {4 * 4096, 4096}}
+	if got, _ := sparse.Extents(f); !reflect.DeepEqual(got, wantExt) {
+		t.Errorf("Finder should have extents %v, got %v", wantExt, got)
+	}
+
+	// Find reports the run of blocks containing or following an offset.
+	if ofs, size, err := f.Find(2 * 4096); ofs != 4*4096 || size != 4096 || err != nil {
+		t.Errorf("Find(%d) should find the block at %d, got %d, %d, %v", 2*4096, 4*4096, ofs, size, err)
+	}
+	if ofs, size, err := f.Find(4097); ofs != 0 || size != 2*4096 || err != nil {
+		t.Errorf("Find(4097) should find the run at 0, got %d, %d, %v", ofs, size, err)
+	}
+
+	m.Clear(4)
+	if _, _, err := f.Find(3 * 4096); err != io.EOF {
+		t.Errorf("Finder should see changes to the Bitmap, got %v", err)
+	}
+}
+
+func TestBitmapDefaultBlockSize(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("A"), sparse.DefaultBlockSize+1)
+
+	m, err := sparse.BitmapOf(&sb, 0)
+	if err != nil {
+		t.Fatalf("BitmapOf should succeed, got %v", err)
+	}
+	want := []sparse.Extent{{Off: 1, Len: 1}}
+	if got := m.Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("BitmapOf with block size 0 should use DefaultBlockSize and set %v, got %v", want, got)
+	}
+	f := m.Finder(-1, 0)
+	if ofs, size, err := f.Find(0); ofs != sparse.DefaultBlockSize || size != sparse.DefaultBlockSize || err != nil {
+		t.Errorf("Finder with block size -1 should use DefaultBlockSize, Find(0) got %d, %d, %v", ofs, size, err)
+	}
+}
@@ -2,12 +2,29 @@ package sparse
 
 import (
 	"io"
+	"sort"
 )
 
 // segment represents data bytes held at a specific offset.
 type segment struct {
 	off  int64
 	data []byte
+	cold coldData // if non-nil, holds the segment's bytes in place of data
+	used uint64   // the Buffer's tick when this segment was last accessed
+}
+
+// coldData holds a segment's bytes somewhere other than in memory.
+type coldData interface {
+	// size returns the number of bytes held.
+	size() int
+	// readAt reads len(p) bytes at off, relative to the start of the segment.
+	readAt(p []byte, off int64) (int, error)
+	// truncate discards all but the first n bytes.
+	truncate(n int)
+	// split discards bytes n and after, returning a new coldData holding them.
+	split(n int) coldData
+	// release frees the bytes held, after which the coldData is not used.
+	release()
 }
 
 // ReadAt for a segment reads just this segment's portion of the address
@@ -18,10 +35,28 @@ func (s *segment) ReadAt(p []byte, ofs int64) (n int, err error) {
 		return 0, io.EOF
 	}
 	lofs := ofs - s.off
+	if s.cold != nil {
+		if rem := int64(s.cold.size()) - lofs; int64(len(p)) > rem {
+			p = p[:rem]
+		}
+		n, err = s.cold.readAt(p, lofs)
+		if n == len(p) {
+			err = nil
+		}
+		return
+	}
 	n = copy(p, s.data[int(lofs):])
 	return
 }
 
+// size returns the number of bytes in the segment.
+func (s *segment) size() int {
+	if s.cold != nil {
+		return s.cold.size()
+	}
+	return len(s.data)
+}
+
 func (s *segment) contains(ofs int64) bool {
 	if s == nil {
 		return false
@@ -29,26 +64,59 @@ func (s *segment) contains(ofs int64) bool {
 	return s.off <= ofs && ofs < s.end()
 }
 
-// end returns the offset after this segment, or s.off+len(s.data).
-func (s segment) end() int64 { return s.off + int64(len(s.data)) }
+// start returns the offset of this segment, or s.off.
+func (s segment) start() int64 { return s.off }
+
+// end returns the offset after this segment, or s.off+s.size().
+func (s segment) end() int64 { return s.off + int64(s.size()) }
 
 // Buffer provides a sparse in-memory collection of bytes.  Data may be stored
 // using the io.WriteSeeker or io.WriterAt interfaces, or with StoreAt.  Data
 // may be read using the sparse.Reader or sparse.FindReader interfaces.
 //
-// A zero-value Buffer is ready to accept writes.
+// A zero-value Buffer is ready to accept writes.  By default all data is held
+// in memory, but SetMemoryLimit can be used to spill data to a backing store.
+// Fragmentation from many small writes can be bounded with SetAutoCompact,
+// compressible data can be held compressed with SetCompression, and data
+// shared by many Buffers can be stored once with SetBlockStore.
 type Buffer struct {
 	es      []segment
 	cur     *segment
 	filePos int64
 	trunc   int64
+
+	tick     uint64 // advanced on each access, for recording segment.used
+	resident int64  // bytes of segment data held in memory
+	limit    int64  // if positive, the limit for resident
+	store    *spillStore
+	err      error    // the first error encountered spilling, see Err
+	stats    segStats // see Stats
+
+	compactThreshold int // if positive, the segment count triggering Compact
+	compactAt        int // the segment count at which to compact next
+	compactOpts      CompactOptions
+
+	comp   *compressor // if non-nil, compresses segments not being written
+	blocks *BlockStore // if non-nil, holds segments not being written
+	hot    Extent      // the range last written, left in memory until the next write
+}
+
+// spanned is implemented by the runs of data held by Buffer and Array, so that
+// they can share the logic for locating them.
+type spanned interface {
+	start() int64
+	end() int64
+}
+
+func (b *Buffer) span(ofs, size int64) (left, right int, keepLeft, keepRight int64, ok bool) {
+	return span(b.es, ofs, size)
 }
 
 // Span identifies the left-most and right-most segments that cover the range of
 // ofs:ofs+size, including segments immediately adjacent to ofs or ofs+size.
-// Returns the indices into b.es for these segments, and the offsets within the
+// Returns the indices into es for these segments, and the offsets within the
 // segments outside of ofs:ofs+size.
-func (b *Buffer) span(ofs, size int64) (left, right int, keepLeft, keepRight int64, ok bool) {
+func span[S spanned](es []S, ofs, size int64) (left, right int, keepLeft, keepRight int64, ok bool) {
 	// Given segments like:
 	// |0123456789012345678|
 	// |....AAAAA..B..CCCCC| // A=4:9 B=11:12 C=14:19
@@ -77,22 +145,22 @@ func (b *Buffer) span(ofs, size int64) (left, right int, keepLeft, keepRight int
 	//           XXXXX       // left=0 (A) right=2 (C)
 	//      LLLLL     RRRRR  // keepLeft=5 keepRight=5
 	end := ofs + size
-	for i, e := range b.es {
+	for i, e := range es {
 		if e.end() < ofs {
 			continue
 		}
-		if end < e.off {
+		if end < e.start() {
 			break
 		}
 		if !ok && ofs <= e.end() {
 			left = i
-			keepLeft = ofs - e.off
+			keepLeft = ofs - e.start()
 			if keepLeft < 0 {
 				keepLeft = 0
 			}
 			ok = true
 		}
-		if ok && e.off <= end {
+		if ok && e.start() <= end {
 			right = i
 			keepRight = e.end() - end
 			if keepRight < 0 {
@@ -111,7 +179,7 @@ func (b *Buffer) span(ofs, size int64) (left, right int, keepLeft, keepRight int
 // readerOfs>off. If no data lies at or after off, returns io.EOF.
 func (b *Buffer) Find(off int64) (readerOfs, size int64, err error) {
 	if b.moveTo(off, true) {
-		return b.cur.off, int64(len(b.cur.data)), nil
+		return b.cur.off, int64(b.cur.size()), nil
 	}
 	return 0, 0, io.EOF
 }
@@ -123,6 +191,10 @@ func (b *Buffer) Find(off int64) (readerOfs, size int64, err error) {
 func (b *Buffer) moveTo(off int64, advance bool) (ok bool) {
 	b.cur = nil
 	for i, e := range b.es {
+		if e.size() == 0 {
+			// Zero-length segments hold no data to find.
+			continue
+		}
 		if off < e.end() {
 			if off < e.off && advance {
 				off = e.off
@@ -138,6 +210,31 @@ func (b *Buffer) moveTo(off int64, advance bool) (ok bool) {
 	return
 }
 
+// readAt copies into p any data held in b within off:off+len(p), without
+// moving the file position.  Bytes of p corresponding to holes are left
+// unmodified.
+func (b *Buffer) readAt(p []byte, off int64) (err error) {
+	end := off + int64(len(p))
+	for i := range b.es {
+		e := &b.es[i]
+		if e.end() <= off {
+			continue
+		}
+		if e.off >= end {
+			break
+		}
+		if e.off <= off {
+			_, err = e.ReadAt(p, off)
+		} else {
+			_, err = e.ReadAt(p[e.off-off:], e.off)
+		}
+		if err != nil && err != io.EOF {
+			return
+		}
+	}
+	return nil
+}
+
 // Read reads up to len(p) bytes of data found at the current file position. If
 // the file position points to a gap within the sparse data, which could be at
 // the start of the buffer, returns io.EOF without reading any bytes. Callers
@@ -147,6 +244,10 @@ func (b *Buffer) Read(p []byte) (n int, err error) {
 	if !b.cur.contains(b.filePos) {
 		b.moveTo(b.filePos, false)
 	}
+	if b.cur != nil {
+		b.tick++
+		b.cur.used = b.tick
+	}
 	n, err = b.cur.ReadAt(p, b.filePos)
 	b.filePos += int64(n)
 	if err == io.EOF && n != 0 {
@@ -189,8 +290,30 @@ func (b Buffer) Size() int64 {
 	return b.trunc
 }
 
-// Reset empties the buffer and resets the file position to 0.
+// ExtentSet returns the set of offsets at which b holds data.  Unlike
+// Extents, this does not move the file position.
+func (b *Buffer) ExtentSet() *ExtentSet {
+	s := &ExtentSet{}
+	for _, e := range b.extents() {
+		s.es = appendExtent(s.es, e)
+	}
+	return s
+}
+
+// extents returns the extents of the non-empty segments of b.
+func (b *Buffer) extents() (es []Extent) {
+	for i := range b.es {
+		if n := b.es[i].size(); n > 0 {
+			es = append(es, Extent{b.es[i].off, int64(n)})
+		}
+	}
+	return
+}
+
+// Reset empties the buffer and resets the file position to 0.  Any memory
+// limit remains in effect.
 func (b *Buffer) Reset() {
+	b.delSegments(0, len(b.es))
 	b.filePos = 0
 	b.es = nil
 	b.cur = nil
@@ -198,30 +321,37 @@ func (b *Buffer) Reset() {
 }
 
 // WriteAt stores a copy of p at offset off within the Buffer.  The new readable portion of the
-// buffer will be at least off+len(p) bytes.
+// buffer will be at least off+len(p) bytes.  An error is only possible if the Buffer has a memory
+// limit and data needed from its backing store could not be read.
 func (b *Buffer) WriteAt(p []byte, off int64) (n int, err error) {
-	return b.writeAt(p, off, false), nil
+	return b.writeAt(p, off, false)
 }
 
 // StoreAt takes ownership of p and stores it at offset off within the Buffer.  The new readable
 // portion of the buffer will be at least off+len(p) bytes.  StoreAt differs from WriteAt in that
-// it may be possible to avoid a copy if the write does not overlap existing data.
+// it may be possible to avoid a copy if the write does not overlap existing data.  Errors are
+// reported by Err.
 func (b *Buffer) StoreAt(p []byte, off int64) {
-	b.writeAt(p, off, true)
+	if _, err := b.writeAt(p, off, true); err != nil {
+		b.setErr(err)
+	}
 }
 
-func (b *Buffer) writeAt(p []byte, off int64, ownP bool) (n int) {
+func (b *Buffer) writeAt(p []byte, off int64, ownP bool) (n int, err error) {
+	b.tick++
 	left, right, keepLeft, keepRight, mergeNeeded := b.span(off, int64(len(p)))
 
 	// If we're allowed to keep p, then we can save ourselves some copies if we avoid trying
 	// to merge adjacent segments.  We can spot these in the return from span by the fact that
 	// span will ask us to keep their entire contents.
+	// Zero-length segments within the span are never treated as adjacent, so
+	// that they are merged away rather than left overlapping the new data.
 	if mergeNeeded && ownP {
-		if len(b.es[left].data) == int(keepLeft) {
+		if n := b.es[left].size(); n > 0 && n == int(keepLeft) {
 			left++
 			keepLeft = 0
 		}
-		if len(b.es[right].data) == int(keepRight) {
+		if n := b.es[right].size(); n > 0 && n == int(keepRight) {
 			right--
 			keepRight = 0
 		}
@@ -232,11 +362,21 @@ func (b *Buffer) writeAt(p []byte, off int64, ownP bool) (n int) {
 	}
 
 	if mergeNeeded {
-		n = b.writeMerge(p, off, left, right, int(keepLeft), int(keepRight))
+		n, err = b.writeMerge(p, off, left, right, int(keepLeft), int(keepRight))
 	} else {
 		n = b.writeInsert(p, off, ownP)
 	}
 	b.cur = nil
+	if err == nil {
+		b.autoCompact()
+		// Only the segments of the previous write can have been left in
+		// memory since the last write, so there is no need to look further.
+		i, j := b.overlapping(b.hot)
+		b.dedupCold(i, j)
+		b.compressCold(i, j)
+		b.spillCold()
+		b.hot = Extent{off, int64(len(p))}
+	}
 	return
 }
 
@@ -245,29 +385,125 @@ func (b *Buffer) writeAt(p []byte, off int64, ownP bool) (n int) {
 func (b *Buffer) Truncate(ofs int64) {
 	b.trunc = ofs
 	var i int
-	for i = range b.es {
-		if b.es[i].contains(ofs) {
-			end := ofs - b.es[i].off
-			if end != int64(len(b.es[i].data)) {
+	for i = 0; i < len(b.es); i++ {
+		if b.es[i].off >= ofs {
+			break
+		}
+		if e := &b.es[i]; e.contains(ofs) {
+			end := int(ofs - e.off)
+			b.stats.tally(b.es, i, i+1, -1)
+			if e.cold != nil {
+				e.cold.truncate(end)
+			} else {
 				nd := make([]byte, end)
-				copy(nd, b.es[i].data)
-				b.es[i].data = nd
+				copy(nd, e.data)
+				b.setData(e, nd)
 			}
+			b.stats.tally(b.es, i, i+1, 1)
+			i++
 			break
 		}
 	}
-	if i+1 < len(b.es) {
-		b.delSegments(i+1, len(b.es)-i)
+	if i < len(b.es) {
+		b.delSegments(i, len(b.es)-i)
+	}
+	b.cur = nil
+}
+
+// setData replaces the bytes held by s with data, accounting for the change
+// in memory use.
+func (b *Buffer) setData(s *segment, data []byte) {
+	if s.cold != nil {
+		s.cold.release()
+		s.cold = nil
+	} else {
+		b.resident -= int64(len(s.data))
+	}
+	s.data = data
+	b.resident += int64(len(data))
+}
+
+// PunchHole deletes any data within off:off+size, leaving a hole.  The size of the buffer is
+// unchanged.
+func (b *Buffer) PunchHole(off, size int64) {
+	if size <= 0 {
+		return
+	}
+	if sz := b.Size(); sz > b.trunc {
+		// Removing trailing data must not change the size.
+		b.trunc = sz
+	}
+	end := off + size
+	var del []int
+	for i := 0; i < len(b.es) && b.es[i].off < end; i++ {
+		e := &b.es[i]
+		if e.end() <= off {
+			continue
+		}
+		if off <= e.off && e.end() <= end {
+			del = append(del, i)
+			continue
+		}
+		b.stats.tally(b.es, i, i+1, -1)
+		switch {
+		case e.off < off && end < e.end():
+			// Punching out the middle of a segment leaves two segments.
+			var right segment
+			keep := int(end - e.off)
+			if e.cold != nil {
+				right.cold = e.cold.split(keep)
+				e.cold.truncate(int(off - e.off))
+			} else {
+				right.data = e.data[keep:]
+				b.resident -= int64(keep - int(off-e.off))
+				e.data = e.data[: off-e.off : off-e.off]
+			}
+			right.off, right.used = end, e.used
+			b.es = append(b.es, segment{})
+			copy(b.es[i+2:], b.es[i+1:])
+			b.es[i+1] = right
+			b.stats.tally(b.es, i, i+2, 1)
+			i++
+			continue
+		case e.off < off:
+			if e.cold != nil {
+				e.cold.truncate(int(off - e.off))
+			} else {
+				b.resident -= e.end() - off
+				e.data = e.data[: off-e.off : off-e.off]
+			}
+		default:
+			keep := int(end - e.off)
+			if e.cold != nil {
+				right := e.cold.split(keep)
+				e.cold.release()
+				e.cold = right
+			} else {
+				b.resident -= int64(keep)
+				e.data = e.data[keep:]
+			}
+			e.off = end
+		}
+		b.stats.tally(b.es, i, i+1, 1)
+	}
+	for j := len(del) - 1; j >= 0; j-- {
+		b.delSegments(del[j], 1)
 	}
+	b.cur = nil
 }
 
 func (b *Buffer) delSegments(idx, num int) {
+	b.stats.tally(b.es, idx, idx+num, -1)
+	for i := idx; i < idx+num; i++ {
+		b.setData(&b.es[i], nil)
+	}
 	copy(b.es[idx:], b.es[idx+num:])
 	trunc := len(b.es) - num
 	for i := trunc; i < len(b.es); i++ {
 		b.es[i] = segment{} // zero the segment to free any memory
 	}
 	b.es = b.es[:trunc]
+	b.stats.tally(b.es, idx, idx, 1)
 }
 
 func tryGrowByReslice(s []byte, desired int) ([]byte, bool) {
@@ -277,37 +513,62 @@ func tryGrowByReslice(s []byte, desired int) ([]byte, bool) {
 	return s, false
 }
 
-func (b *Buffer) writeMerge(p []byte, off int64, left, right, keepLeft, keepRight int) (n int) {
+func (b *Buffer) writeMerge(p []byte, off int64, left, right, keepLeft, keepRight int) (n int, err error) {
 	l, r := &b.es[left], &b.es[right]
 
-	dest := l.data
+	// Segments may not be held in memory, so use ReadAt to retrieve the portions we need, and
+	// avoid modifying anything until we have them.
+	var dest []byte
 	var ok bool
-	if dest, ok = tryGrowByReslice(dest, keepLeft+len(p)+keepRight); !ok {
+	if l.cold == nil {
+		dest, ok = tryGrowByReslice(l.data, keepLeft+len(p)+keepRight)
+	}
+	if !ok {
 		dest = make([]byte, keepLeft+len(p)+keepRight)
-		copy(dest, l.data[:keepLeft])
+		if _, err = l.ReadAt(dest[:keepLeft], l.off); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = r.ReadAt(dest[keepLeft+len(p):], r.end()-int64(keepRight)); err != nil {
+		return 0, err
 	}
-	copy(dest[keepLeft+len(p):], r.data[len(r.data)-keepRight:])
 	copy(dest[keepLeft:], p)
 
+	if left != right {
+		b.delSegments(left+1, right-left)
+	}
+	b.stats.tally(b.es, left, left+1, -1)
 	if off < l.off {
 		l.off = off
 	}
-	l.data = dest
+	b.setData(l, dest)
+	l.used = b.tick
+	b.stats.tally(b.es, left, left+1, 1)
+	return len(p), nil
+}
 
-	if left != right {
-		b.delSegments(left+1, right-left)
+// overlapping returns the range of indices of the segments overlapping e.
+func (b *Buffer) overlapping(e Extent) (i, j int) {
+	i = sort.Search(len(b.es), func(k int) bool { return b.es[k].end() > e.Off })
+	for j = i; j < len(b.es) && b.es[j].off < e.Off+e.Len; j++ {
 	}
-	return len(p)
+	return
 }
 
 func (b *Buffer) fit(off, size int64) (i int, ok bool) {
-	for i = 0; i < len(b.es); i++ {
-		e := b.es[i]
-		if off+size <= e.off {
+	return fit(b.es, off, size)
+}
+
+// fit returns the index in es at which a segment covering off:off+size can be
+// inserted, or false if it would overlap an existing segment.
+func fit[S spanned](es []S, off, size int64) (i int, ok bool) {
+	for i = 0; i < len(es); i++ {
+		e := es[i]
+		if off+size <= e.start() {
 			// next segment begins after our request, so this is a good insert spot
 			break
 		}
-		if off < e.off+int64(len(e.data)) {
+		if off < e.end() {
 			// our request starts before this segment ends, so there's some sort of overlap
 			return i, false
 		}
@@ -328,9 +589,12 @@ func (b *Buffer) writeInsert(p []byte, off int64, ownP bool) (n int) {
 		copy(buf, p)
 	}
 
+	b.stats.tally(b.es, insert, insert, -1)
 	b.es = append(b.es, segment{})
 	copy(b.es[insert+1:], b.es[insert:])
-	b.es[insert] = segment{off, buf}
+	b.es[insert] = segment{off: off, data: buf, used: b.tick}
+	b.resident += int64(len(buf))
+	b.stats.tally(b.es, insert, insert+1, 1)
 	return
 }
 
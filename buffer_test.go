@@ -4,19 +4,52 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsetest"
 )
 
 var (
-	_ sparse.Reader     = (*sparse.Buffer)(nil)
-	_ sparse.ReadFinder = (*sparse.Buffer)(nil)
-	_ io.WriterAt       = (*sparse.Buffer)(nil)
-	_ io.WriteSeeker    = (*sparse.Buffer)(nil)
+	_ sparse.Reader          = (*sparse.Buffer)(nil)
+	_ sparse.ReadFinder      = (*sparse.Buffer)(nil)
+	_ sparse.ReadWriteFinder = (*sparse.Buffer)(nil)
+	_ io.WriterAt            = (*sparse.Buffer)(nil)
+	_ io.WriteSeeker         = (*sparse.Buffer)(nil)
 )
 
+func TestBufferConformance(t *testing.T) {
+	sparsetest.TestReadWriteFinder(t, func(t *testing.T) sparse.ReadWriteFinder {
+		return new(sparse.Buffer)
+	})
+}
+
+// bufferOf returns a Buffer holding the same segments as m.
+func bufferOf(m *sparsetest.Model) *sparse.Buffer {
+	sb := new(sparse.Buffer)
+	for _, s := range m.Segments() {
+		sb.StoreAt(append([]byte(nil), s.Data...), s.Off)
+	}
+	if m.Size() > sb.Size() {
+		sb.Truncate(m.Size())
+	}
+	return sb
+}
+
+func TestBufferReaderConformance(t *testing.T) {
+	sparsetest.TestReader(t, func(t *testing.T, m *sparsetest.Model) sparse.Reader {
+		return bufferOf(m)
+	})
+}
+
+func TestBufferReadFinderConformance(t *testing.T) {
+	sparsetest.TestReadFinder(t, func(t *testing.T, m *sparsetest.Model) sparse.ReadFinder {
+		return bufferOf(m)
+	})
+}
+
 func TestBufferSimple(t *testing.T) {
 	var sb sparse.Buffer
 	abc := []byte("ABC")
@@ -42,7 +75,7 @@ func TestBufferSimple(t *testing.T) {
 		t.Errorf("ReadAt(0) should have read %s, got %s", string(abc), string(buf[:3]))
 	}
 	if sb.Size() != 3 {
-		fmt.Errorf("Buffer should have 3 bytes in it, got Size of %d", sb.Size())
+		t.Errorf("Buffer should have 3 bytes in it, got Size of %d", sb.Size())
 	}
 }
 
@@ -225,6 +258,41 @@ func TestTruncate(t *testing.T) {
 	}
 }
 
+func TestTruncateInHole(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAA"), 0)
+	sb.WriteAt([]byte("BBB"), 5)
+	sb.Truncate(4)
+
+	if sb.Size() != 4 {
+		t.Errorf("Truncate(4) should leave Size 4, got %d", sb.Size())
+	}
+	if ofs, size, err := sb.Find(3); err != io.EOF {
+		t.Errorf("Truncate(4) should have removed BBB, Find(3) got %d, %d, %v", ofs, size, err)
+	}
+}
+
+func TestBufferPunchHole(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAAAAA"), 0)
+	sb.WriteAt([]byte("BBB"), 8)
+	sb.PunchHole(2, 2)
+	sb.PunchHole(5, 4)
+
+	want := []sparse.Extent{{0, 2}, {4, 1}, {9, 2}}
+	if got, _ := sparse.Extents(&sb); !reflect.DeepEqual(got, want) {
+		t.Errorf("PunchHole should leave extents %v, got %v", want, got)
+	}
+	if sb.Size() != 11 {
+		t.Errorf("PunchHole should not change Size 11, got %d", sb.Size())
+	}
+	got := make([]byte, 11)
+	readBuf(&sb, got)
+	if want := "AA..A....BB"; printable(got) != want {
+		t.Errorf("PunchHole should leave %q, got %q", want, printable(got))
+	}
+}
+
 func printable(b []byte) string {
 	return strings.Replace(string(b), "\000", ".", -1)
 }
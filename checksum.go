@@ -0,0 +1,315 @@
+package sparse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// ChecksumAlgorithm identifies the hash function used by a Checksummer.
+type ChecksumAlgorithm uint8
+
+const (
+	CRC32C ChecksumAlgorithm = iota // CRC-32 with the Castagnoli polynomial
+	SHA256                          // SHA-256
+)
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case CRC32C:
+		return "crc32c"
+	case SHA256:
+		return "sha256"
+	}
+	return fmt.Sprintf("ChecksumAlgorithm(%d)", uint8(a))
+}
+
+func (a ChecksumAlgorithm) new() (hash.Hash, error) {
+	switch a {
+	case CRC32C:
+		return crc32.New(crcTable), nil
+	case SHA256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("sparse: unknown checksum algorithm %v", a)
+}
+
+// Checksummer computes a checksum for each fixed-size block of sparse data,
+// so that corruption can be detected and located.  Blocks are checksummed
+// with holes read as zeros.  Blocks holding no data at all are not read, and
+// are taken to have the checksum of a block of zeros, so a block checksums
+// the same whether it is a hole or explicit zeros.
+type Checksummer struct {
+	Algorithm ChecksumAlgorithm
+	BlockSize int64 // if zero, DefaultBlockSize is used
+}
+
+func (c *Checksummer) blockSize() int64 {
+	if c.BlockSize <= 0 {
+		return DefaultBlockSize
+	}
+	return c.BlockSize
+}
+
+// BlockSum is the checksum of a block of sparse data.
+type BlockSum struct {
+	Index int64 // the block's index, so it starts at Index*BlockSize
+	Sum   []byte
+}
+
+// Manifest records the checksums of sparse data, as computed by Checksummer.
+// Only blocks holding some data are listed; the rest are holes.  Verify and
+// ReadManifest reject a BlockSize over 64 MiB, since a block is read into
+// memory whole, and a Manifest may come from elsewhere.
+type Manifest struct {
+	Algorithm ChecksumAlgorithm
+	BlockSize int64
+	Size      int64
+	Blocks    []BlockSum // in order of Index
+}
+
+// Sum returns a Manifest of the checksums of the blocks of r.  This will
+// move the file position of r.
+func (c *Checksummer) Sum(r ReadFinder) (*Manifest, error) {
+	h, err := c.Algorithm.new()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Algorithm: c.Algorithm, BlockSize: c.blockSize(), Size: r.Size()}
+	err = dataBlocks(r, m.BlockSize, func(i int64, p []byte) error {
+		h.Reset()
+		h.Write(p)
+		m.Blocks = append(m.Blocks, BlockSum{i, h.Sum(nil)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dataBlocks calls fn, in order, for each block of bs bytes of r that holds
+// some data, with the block's index and content, with holes read as zeros.
+// The last block may be short.  p is valid only until fn returns.  This will
+// move the file position of r.
+func dataBlocks(r ReadFinder, bs int64, fn func(i int64, p []byte) error) error {
+	es, err := Extents(r)
+	if err != nil {
+		return err
+	}
+	size := r.Size()
+	buf := make([]byte, bs)
+	var next int64 // the start of the first block not yet visited
+	for k := 0; k < len(es) && es[k].Off < size; {
+		start := es[k].Off
+		if start < next {
+			start = next
+		}
+		start -= start % bs
+		end := start + bs
+		if end > size {
+			end = size
+		}
+		p := buf[:end-start]
+		for i := range p {
+			p[i] = 0
+		}
+		for ; k < len(es) && es[k].Off < end; k++ {
+			lo, hi := es[k].Off, es[k].End()
+			if lo < start {
+				lo = start
+			}
+			if hi > end {
+				hi = end
+			}
+			if err := readExtent(r, p[lo-start:hi-start], lo); err != nil {
+				return err
+			}
+			if es[k].End() > end {
+				// The extent continues into the next block.
+				break
+			}
+		}
+		if err := fn(start/bs, p); err != nil {
+			return err
+		}
+		next = end
+	}
+	return nil
+}
+
+// blockLen returns the number of bytes in block i of m.
+func (m *Manifest) blockLen(i int64) int64 {
+	n := m.Size - i*m.BlockSize
+	if n > m.BlockSize {
+		n = m.BlockSize
+	}
+	return n
+}
+
+// holeSum returns the checksum of n zeros, using h, remembering it in cache.
+func holeSum(h hash.Hash, n int64, cache map[int64][]byte) []byte {
+	if sum, ok := cache[n]; ok {
+		return sum
+	}
+	h.Reset()
+	writeZeros(h, n)
+	sum := h.Sum(nil)
+	cache[n] = sum
+	return sum
+}
+
+// Verify checks r against the checksums in m, and returns the extents of r
+// found not to match, coalesced and in order.  A difference in size is
+// reported as a mismatch of the range between the two sizes.  This will move
+// the file position of r.
+func Verify(r ReadFinder, m *Manifest) ([]Extent, error) {
+	if m.BlockSize <= 0 || m.BlockSize > maxManifestBlockSize {
+		return nil, errManifestFormat
+	}
+	got, err := (&Checksummer{m.Algorithm, m.BlockSize}).Sum(r)
+	if err != nil {
+		return nil, err
+	}
+	h, _ := m.Algorithm.new()
+	holes := map[int64][]byte{}
+	minSize, maxSize := m.Size, got.Size
+	if minSize > maxSize {
+		minSize, maxSize = maxSize, minSize
+	}
+
+	var bad []Extent
+	mismatch := func(i int64) {
+		end := (i + 1) * m.BlockSize
+		if end > maxSize {
+			end = maxSize
+		}
+		bad = appendExtent(bad, Extent{i * m.BlockSize, end - i*m.BlockSize})
+	}
+	a, b := m.Blocks, got.Blocks
+	for len(a) > 0 || len(b) > 0 {
+		var i int64
+		var sa, sb []byte
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].Index < b[0].Index):
+			i, sa = a[0].Index, a[0].Sum
+			a = a[1:]
+			if i*m.BlockSize < got.Size {
+				sb = holeSum(h, got.blockLen(i), holes)
+			}
+		case len(a) == 0 || b[0].Index < a[0].Index:
+			i, sb = b[0].Index, b[0].Sum
+			b = b[1:]
+			if i*m.BlockSize < m.Size {
+				sa = holeSum(h, m.blockLen(i), holes)
+			}
+		default:
+			i, sa, sb = a[0].Index, a[0].Sum, b[0].Sum
+			a, b = a[1:], b[1:]
+		}
+		if i*m.BlockSize < minSize && !bytes.Equal(sa, sb) {
+			mismatch(i)
+		}
+	}
+	if maxSize > minSize {
+		// Any block straddling minSize was reported above, if it differed.
+		start := minSize
+		if n := len(bad); n > 0 && bad[n-1].End() > start {
+			start = bad[n-1].End()
+		}
+		bad = appendExtent(bad, Extent{start, maxSize - start})
+	}
+	return bad, nil
+}
+
+// The encoded form of a Manifest is:
+//
+//   magic        "SSUM"
+//   version      uint16
+//   algorithm    uint8
+//   sum length   uint8
+//   block size   int64
+//   size         int64
+//   count        uint64, the number of blocks listed
+//   blocks       count × {index int64, sum}
+//
+// All integers are big-endian.
+
+var manifestMagic = [4]byte{'S', 'S', 'U', 'M'}
+
+const manifestVersion = 1
+
+// maxManifestBlockSize bounds the memory a Manifest can make Verify allocate.
+const maxManifestBlockSize = 64 << 20
+
+var errManifestFormat = errors.New("sparse: invalid manifest format")
+
+type manifestHeader struct {
+	Magic     [4]byte
+	Version   uint16
+	Algorithm ChecksumAlgorithm
+	SumLen    uint8
+	BlockSize int64
+	Size      int64
+	Count     uint64
+}
+
+// WriteTo writes an encoded form of m to w, suitable for ReadManifest.
+func (m *Manifest) WriteTo(w io.Writer) (n int64, err error) {
+	h, err := m.Algorithm.new()
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, manifestHeader{
+		manifestMagic, manifestVersion, m.Algorithm, uint8(h.Size()), m.BlockSize, m.Size, uint64(len(m.Blocks)),
+	})
+	for _, b := range m.Blocks {
+		if len(b.Sum) != h.Size() {
+			return 0, fmt.Errorf("sparse: block %d has a checksum of %d bytes, want %d", b.Index, len(b.Sum), h.Size())
+		}
+		binary.Write(&buf, binary.BigEndian, b.Index)
+		buf.Write(b.Sum)
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadManifest decodes a Manifest previously encoded with Manifest.WriteTo.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var hdr manifestHeader
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Magic != manifestMagic || hdr.Version != manifestVersion || hdr.BlockSize <= 0 || hdr.BlockSize > maxManifestBlockSize || hdr.Size < 0 {
+		return nil, errManifestFormat
+	}
+	h, err := hdr.Algorithm.new()
+	if err != nil {
+		return nil, err
+	}
+	if int(hdr.SumLen) != h.Size() {
+		return nil, errManifestFormat
+	}
+	m := &Manifest{Algorithm: hdr.Algorithm, BlockSize: hdr.BlockSize, Size: hdr.Size}
+	last := int64(-1)
+	for i := uint64(0); i < hdr.Count; i++ {
+		b := BlockSum{Sum: make([]byte, hdr.SumLen)}
+		if err := binary.Read(r, binary.BigEndian, &b.Index); err != nil {
+			return nil, unexpected(err)
+		}
+		if _, err := io.ReadFull(r, b.Sum); err != nil {
+			return nil, unexpected(err)
+		}
+		if b.Index <= last || b.Index > hdr.Size/hdr.BlockSize || b.Index*hdr.BlockSize >= hdr.Size {
+			return nil, errManifestFormat
+		}
+		last = b.Index
+		m.Blocks = append(m.Blocks, b)
+	}
+	return m, nil
+}
@@ -0,0 +1,124 @@
+package sparse_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func TestChecksum(t *testing.T) {
+	for _, alg := range []sparse.ChecksumAlgorithm{sparse.CRC32C, sparse.SHA256} {
+		t.Run(alg.String(), func(t *testing.T) {
+			var sb sparse.Buffer
+			sb.WriteAt([]byte("AAAA"), 2)
+			sb.WriteAt([]byte("BB"), 14)
+			sb.WriteAt([]byte("CC"), 30)
+			sb.Truncate(42)
+
+			c := &sparse.Checksummer{Algorithm: alg, BlockSize: 8}
+			m, err := c.Sum(&sb)
+			if err != nil {
+				t.Fatalf("Sum should succeed, got %v", err)
+			}
+			var idx []int64
+			for _, b := range m.Blocks {
+				idx = append(idx, b.Index)
+			}
+			if want := []int64{0, 1, 3}; !reflect.DeepEqual(idx, want) {
+				t.Errorf("Sum should list blocks %v, got %v", want, idx)
+			}
+
+			var enc bytes.Buffer
+			if _, err := m.WriteTo(&enc); err != nil {
+				t.Fatalf("WriteTo should succeed, got %v", err)
+			}
+			m2, err := sparse.ReadManifest(&enc)
+			if err != nil {
+				t.Fatalf("ReadManifest should succeed, got %v", err)
+			}
+			if !reflect.DeepEqual(m, m2) {
+				t.Errorf("ReadManifest should return %+v, got %+v", m, m2)
+			}
+
+			if bad, err := sparse.Verify(&sb, m2); bad != nil || err != nil {
+				t.Errorf("Verify of unchanged data should find nothing, got %v, %v", bad, err)
+			}
+
+			// Explicit zeros checksum the same as holes.
+			sb.WriteAt(make([]byte, 8), 16)
+			if bad, err := sparse.Verify(&sb, m2); bad != nil || err != nil {
+				t.Errorf("Verify should treat zeros as holes, got %v, %v", bad, err)
+			}
+
+			sb.WriteAt([]byte("X"), 3)
+			sb.WriteAt([]byte("X"), 9)
+			sb.WriteAt([]byte("X"), 26)
+			sb.PunchHole(31, 1)
+			want := []sparse.Extent{{0, 16}, {24, 8}}
+			if bad, err := sparse.Verify(&sb, m2); !reflect.DeepEqual(bad, want) || err != nil {
+				t.Errorf("Verify should report %v, got %v, %v", want, bad, err)
+			}
+
+			sb.Truncate(50)
+			want = []sparse.Extent{{0, 16}, {24, 8}, {42, 8}}
+			if bad, err := sparse.Verify(&sb, m2); !reflect.DeepEqual(bad, want) || err != nil {
+				t.Errorf("Verify should report a change of size as %v, got %v, %v", want, bad, err)
+			}
+		})
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	f := sparseFile(t)
+	defer cleanup(f)
+
+	// The file holds a block of A at 0 and of B at 2*blockSize.
+	var sb sparse.Buffer
+	sb.WriteAt(bytes.Repeat([]byte{'A'}, blockSize), 0)
+	sb.WriteAt(bytes.Repeat([]byte{'B'}, blockSize), 2*blockSize)
+	sb.Truncate(4 * blockSize)
+
+	c := &sparse.Checksummer{Algorithm: sparse.SHA256}
+	m, err := c.Sum(&sb)
+	if err != nil {
+		t.Fatalf("Sum should succeed, got %v", err)
+	}
+	if bad, err := sparse.Verify(sparse.NewFile(f), m); bad != nil || err != nil {
+		t.Errorf("Verify of the file should find nothing, got %v, %v", bad, err)
+	}
+
+	f.WriteAt([]byte("C"), 3*blockSize+5)
+	want := []sparse.Extent{{3 * blockSize, blockSize}}
+	if bad, err := sparse.Verify(sparse.NewFile(f), m); !reflect.DeepEqual(bad, want) || err != nil {
+		t.Errorf("Verify of the file should report %v, got %v, %v", want, bad, err)
+	}
+}
+
+func TestReadManifestInvalid(t *testing.T) {
+	m := &sparse.Manifest{BlockSize: 8, Size: 16, Blocks: []sparse.BlockSum{{Index: 2, Sum: make([]byte, 4)}}}
+	var enc bytes.Buffer
+	if _, err := m.WriteTo(&enc); err != nil {
+		t.Fatalf("WriteTo should succeed, got %v", err)
+	}
+	if _, err := sparse.ReadManifest(&enc); err == nil {
+		t.Errorf("ReadManifest should reject a block beyond the size")
+	}
+	if _, err := sparse.ReadManifest(bytes.NewReader([]byte("SPRS"))); err == nil {
+		t.Errorf("ReadManifest should reject other data")
+	}
+
+	// A block size this large would have Verify allocate a block of it.
+	m = &sparse.Manifest{BlockSize: 1 << 50, Size: 1 << 52}
+	enc.Reset()
+	m.WriteTo(&enc)
+	if _, err := sparse.ReadManifest(&enc); err == nil {
+		t.Errorf("ReadManifest should reject a block size of %d", m.BlockSize)
+	}
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("data"), 0)
+	if _, err := sparse.Verify(&sb, m); err == nil {
+		t.Errorf("Verify should reject a block size of %d", m.BlockSize)
+	}
+}
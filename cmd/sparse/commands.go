@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dnesting/sparse"
+)
+
+// source is satisfied by both *sparse.File and *sparse.Buffer.
+type source interface {
+	sparse.Reader
+	sparse.Finder
+}
+
+// parse parses flags from args and ensures the right number of positional
+// arguments remain.  If max is negative, there is no upper limit.
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		// The FlagSet has already reported the problem.
+		return flag.ErrHelp
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		return errUsage
+	}
+	return nil
+}
+
+// openSource opens name for reading as a sparse file.  If zeros is positive,
+// runs of at least that many zeros will also be treated as holes, which
+// requires reading the file's data into memory.
+func openSource(name string, zeros int64) (src source, close func() error, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	sf := sparse.NewFile(f)
+	if zeros <= 0 {
+		return sf, f.Close, nil
+	}
+	defer f.Close()
+	var b sparse.Buffer
+	if _, err = sparse.Copy(&b, sparse.Make(bufio.NewReader(sparse.NewReader(sf, nil)), zeros)); err != nil {
+		return nil, nil, err
+	}
+	b.Truncate(sf.Size())
+	b.Seek(0, io.SeekStart)
+	return &b, func() error { return nil }, nil
+}
+
+func runMap(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	asJSON := fs.Bool("json", false, "write the map as JSON")
+	width := fs.Int("width", 64, "width of the occupancy bar, or 0 to omit it")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m, err := sparse.MapOf(sparse.NewFile(f))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	}
+	return m.WriteText(stdout, *width)
+}
+
+func runStat(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		m, err := sparse.MapOf(sparse.NewFile(f))
+		f.Close()
+		if err != nil {
+			return err
+		}
+		var pct float64
+		if m.Size > 0 {
+			pct = 100 * float64(m.HoleBytes) / float64(m.Size)
+		}
+		fmt.Fprintf(stdout, "%s: size %d, data %d in %d extents, holes %d (%.1f%% sparse)\n",
+			name, m.Size, m.DataBytes, len(m.Extents), m.HoleBytes, pct)
+	}
+	return nil
+}
+
+func runCat(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(stdout, sparse.NewReader(sparse.NewFile(f), nil))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile creates name and copies src into it, seeking over holes, and
+// leaving it with the given size.
+func writeFile(name string, src sparse.Reader, size int64) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = sparse.Copy(f, src); err == nil {
+		err = f.Truncate(size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func runCopy(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	zeros := fs.Int64("zeros", 0, "also treat runs of at least `N` zero bytes as holes")
+	if err := parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sf := sparse.NewFile(f)
+	var src sparse.Reader = sf
+	if *zeros > 0 {
+		src = sparse.Make(bufio.NewReader(sparse.NewReader(sf, nil)), *zeros)
+	}
+	return writeFile(fs.Arg(1), src, sf.Size())
+}
+
+func runDig(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	dryRun := fs.Bool("n", false, "report what would be reclaimed without modifying files")
+	block := fs.Int64("block", sparse.DefaultBlockSize, "punch holes over whole blocks of `N` bytes")
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	for _, name := range fs.Args() {
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		n, err := sparse.DigHoles(f, &sparse.DigOptions{BlockSize: *block, DryRun: *dryRun})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		verb := "reclaimed"
+		if *dryRun {
+			verb = "would reclaim"
+		}
+		fmt.Fprintf(stdout, "%s: %s %d bytes\n", name, verb, n)
+	}
+	return nil
+}
+
+func runDiff(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	zeroHoles := fs.Bool("zero-holes", false, "treat holes as equal to explicit zeros")
+	if err := parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+	a, closeA, err := openSource(fs.Arg(0), 0)
+	if err != nil {
+		return err
+	}
+	defer closeA()
+	b, closeB, err := openSource(fs.Arg(1), 0)
+	if err != nil {
+		return err
+	}
+	defer closeB()
+
+	es, err := sparse.Diff(a, b, &sparse.DiffOptions{ZeroHoles: *zeroHoles})
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		fmt.Fprintf(stdout, "%d %d %d\n", e.Off, e.End(), e.Len)
+	}
+	if len(es) > 0 {
+		return exitError(1)
+	}
+	return nil
+}
+
+func runConvert(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	from := fs.String("from", "file", "`format` of SRC, file or encoded")
+	to := fs.String("to", "encoded", "`format` of DST, file or encoded")
+	zeros := fs.Int64("zeros", 0, "when reading a file, also treat runs of at least `N` zero bytes as holes")
+	if err := parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+
+	var src source
+	switch *from {
+	case "file":
+		s, closeSrc, err := openSource(fs.Arg(0), *zeros)
+		if err != nil {
+			return err
+		}
+		defer closeSrc()
+		src = s
+	case "encoded":
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		b, err := sparse.Decode(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return err
+		}
+		src = b
+	default:
+		return errUsage
+	}
+
+	switch *to {
+	case "file":
+		return writeFile(fs.Arg(1), src, src.Size())
+	case "encoded":
+		f, err := os.Create(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		err = sparse.Encode(f, src)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return errUsage
+}
@@ -0,0 +1,93 @@
+// Command sparse inspects, copies and compares sparse files.
+//
+// Usage:
+//
+//	sparse map [-json] [-width N] FILE
+//	sparse stat FILE...
+//	sparse cat FILE...
+//	sparse copy [-zeros N] SRC DST
+//	sparse dig [-n] [-block N] FILE...
+//	sparse diff [-zero-holes] A B
+//	sparse convert [-from FORMAT] [-to FORMAT] [-zeros N] SRC DST
+//
+// Files are read using SeekData and SeekHole where the file system supports
+// them.  Formats for convert are "file", a regular (possibly sparse) file, and
+// "encoded", the format written by sparse.Encode.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type command struct {
+	usage string
+	run   func(fs *flag.FlagSet, args []string, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"map":     {"[-json] [-width N] FILE", runMap},
+	"stat":    {"FILE...", runStat},
+	"cat":     {"FILE...", runCat},
+	"copy":    {"[-zeros N] SRC DST", runCopy},
+	"dig":     {"[-n] [-block N] FILE...", runDig},
+	"diff":    {"[-zero-holes] A B", runDiff},
+	"convert": {"[-from FORMAT] [-to FORMAT] [-zeros N] SRC DST", runConvert},
+}
+
+// errUsage indicates the command was invoked incorrectly.
+var errUsage = fmt.Errorf("usage error")
+
+// exitError carries a specific exit status without an error message, such as
+// when diff finds differences.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "sparse: unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: sparse %s %s\n", args[0], cmd.usage)
+		fs.PrintDefaults()
+	}
+	err := cmd.run(fs, args[1:], stdout)
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case exitError:
+		return int(e)
+	}
+	if err == errUsage {
+		fs.Usage()
+		return 2
+	}
+	if err == flag.ErrHelp {
+		return 2
+	}
+	fmt.Fprintf(stderr, "sparse %s: %v\n", args[0], err)
+	return 1
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: sparse COMMAND [ARGS]\n\ncommands:\n")
+	for _, name := range []string{"map", "stat", "cat", "copy", "dig", "diff", "convert"} {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
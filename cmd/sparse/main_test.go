@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+const blockSize = 4096
+
+// testDir creates a temporary directory containing "sparse", a file with a
+// block of A at 0, a block of B at 2*blockSize and a size of 4*blockSize, and
+// "dense", a file with the same content but no holes.
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := bytes.Repeat([]byte{'A'}, blockSize)
+	b := bytes.Repeat([]byte{'B'}, blockSize)
+	zero := make([]byte, blockSize)
+
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(a, 0)
+	f.WriteAt(b, 2*blockSize)
+	f.Truncate(4 * blockSize)
+	f.Close()
+
+	dense := bytes.Join([][]byte{a, zero, b, zero}, nil)
+	if err := ioutil.WriteFile(filepath.Join(dir, "dense"), dense, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// sparseSupported reports whether holes are visible in files within dir.
+func sparseSupported(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, "sparse"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	es, _ := sparse.Extents(sparse.NewFile(f))
+	return len(es) == 2
+}
+
+func runTest(t *testing.T, args ...string) (stdout string, status int) {
+	var out, errOut bytes.Buffer
+	status = run(args, &out, &errOut)
+	if status != 0 {
+		t.Logf("sparse %s: status %d\n%s", strings.Join(args, " "), status, errOut.String())
+	}
+	return out.String(), status
+}
+
+func fileMap(t *testing.T, name string) *sparse.ExtentMap {
+	out, status := runTest(t, "map", "-json", name)
+	if status != 0 {
+		t.Fatalf("map %s failed", name)
+	}
+	var m sparse.ExtentMap
+	if err := json.Unmarshal([]byte(out), &m); err != nil {
+		t.Fatalf("map -json produced invalid JSON: %v", err)
+	}
+	return &m
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"bogus"},
+		{"map"},
+		{"map", "-bogus", "x"},
+		{"copy", "a"},
+		{"convert", "-from", "bogus", "a", "b"},
+	} {
+		if _, status := runTest(t, args...); status != 2 {
+			t.Errorf("sparse %v should exit with status 2, got %d", args, status)
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	if !sparseSupported(dir) {
+		t.Skip("file system does not support holes")
+	}
+	m := fileMap(t, filepath.Join(dir, "sparse"))
+	want := []sparse.Extent{{Off: 0, Len: blockSize}, {Off: 2 * blockSize, Len: blockSize}}
+	if m.Size != 4*blockSize || !reflect.DeepEqual(m.Extents, want) {
+		t.Errorf("map should report size %d and extents %v, got %d and %v", 4*blockSize, want, m.Size, m.Extents)
+	}
+
+	out, _ := runTest(t, "map", "-width", "4", filepath.Join(dir, "sparse"))
+	if !strings.HasSuffix(out, "|A.B.|\n") {
+		t.Errorf("map should end with an occupancy bar, got:\n%s", out)
+	}
+
+	out, _ = runTest(t, "stat", filepath.Join(dir, "sparse"))
+	if !strings.Contains(out, "50.0% sparse") {
+		t.Errorf("stat should report 50.0%% sparse, got %q", out)
+	}
+}
+
+func TestCat(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	want, _ := ioutil.ReadFile(filepath.Join(dir, "dense"))
+	out, status := runTest(t, "cat", filepath.Join(dir, "sparse"))
+	if status != 0 || out != string(want) {
+		t.Errorf("cat should produce the dense content, got %d bytes and status %d", len(out), status)
+	}
+}
+
+func TestCopyAndDiff(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	if !sparseSupported(dir) {
+		t.Skip("file system does not support holes")
+	}
+	sparseName := filepath.Join(dir, "sparse")
+	denseName := filepath.Join(dir, "dense")
+	copyName := filepath.Join(dir, "copy")
+
+	if _, status := runTest(t, "diff", sparseName, denseName); status != 1 {
+		t.Errorf("diff of sparse and dense files should exit with 1, got %d", status)
+	}
+	if _, status := runTest(t, "diff", "-zero-holes", sparseName, denseName); status != 0 {
+		t.Errorf("diff -zero-holes of sparse and dense files should exit with 0, got %d", status)
+	}
+
+	if _, status := runTest(t, "copy", "-zeros", "512", denseName, copyName); status != 0 {
+		t.Fatalf("copy failed")
+	}
+	if out, status := runTest(t, "diff", sparseName, copyName); status != 0 {
+		t.Errorf("copy -zeros of a dense file should produce holes, differs at:\n%s", out)
+	}
+
+	if _, status := runTest(t, "copy", sparseName, copyName); status != 0 {
+		t.Fatalf("copy failed")
+	}
+	if out, status := runTest(t, "diff", sparseName, copyName); status != 0 {
+		t.Errorf("copy of a sparse file should preserve holes, differs at:\n%s", out)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	denseName := filepath.Join(dir, "dense")
+	encName := filepath.Join(dir, "enc")
+	outName := filepath.Join(dir, "out")
+
+	if _, status := runTest(t, "convert", "-zeros", "512", denseName, encName); status != 0 {
+		t.Fatalf("convert to encoded failed")
+	}
+	f, _ := os.Open(encName)
+	b, err := sparse.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("convert should produce a valid encoding, got %v", err)
+	}
+	if got := b.Map(); got.DataBytes != 2*blockSize || got.Size != 4*blockSize {
+		t.Errorf("convert should have encoded %d data bytes of %d, got:\n%s", 2*blockSize, 4*blockSize, got)
+	}
+
+	if _, status := runTest(t, "convert", "-from", "encoded", "-to", "file", encName, outName); status != 0 {
+		t.Fatalf("convert to file failed")
+	}
+	if _, status := runTest(t, "diff", "-zero-holes", denseName, outName); status != 0 {
+		t.Errorf("convert round trip should preserve content")
+	}
+}
+
+func TestDig(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	if !sparseSupported(dir) {
+		t.Skip("file system does not support holes")
+	}
+	denseName := filepath.Join(dir, "dense")
+
+	out, status := runTest(t, "dig", "-n", denseName)
+	if status != 0 || !strings.Contains(out, "would reclaim 8192 bytes") {
+		t.Errorf("dig -n should report 8192 bytes, got %q", out)
+	}
+	if got := fileMap(t, denseName); got.DataBytes != 4*blockSize {
+		t.Errorf("dig -n should not modify the file, now has %d data bytes", got.DataBytes)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"dig", denseName}, &stdout, &stderr); status != 0 {
+		// The file system may support holes but not punching them.
+		msg := stderr.String()
+		if strings.Contains(msg, sparse.ErrPunchUnsupported.Error()) || strings.Contains(msg, "operation not supported") {
+			t.Skipf("dig cannot punch holes here: %s", msg)
+		}
+		t.Fatalf("dig failed with status %d: %s", status, msg)
+	}
+	if out, status := runTest(t, "diff", filepath.Join(dir, "sparse"), denseName); status != 0 {
+		t.Errorf("dig should leave the same layout as the sparse file, differs at:\n%s", out)
+	}
+}
+
+func TestZerosShortRuns(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	// Runs of zeros shorter than -zeros, which do not line up with the reads
+	// made while copying, followed by one long enough to become a hole.
+	var data []byte
+	for i := 0; i < 200; i++ {
+		data = append(data, bytes.Repeat([]byte{1}, 3000)...)
+		data = append(data, make([]byte, 3000)...)
+	}
+	data = append(data, make([]byte, 3*blockSize)...)
+	data = append(data, "end"...)
+	inName := filepath.Join(dir, "in")
+	if err := ioutil.WriteFile(inName, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	copyName := filepath.Join(dir, "copy")
+	if _, status := runTest(t, "copy", "-zeros", "4096", inName, copyName); status != 0 {
+		t.Fatalf("copy -zeros failed")
+	}
+	if got, _ := ioutil.ReadFile(copyName); !bytes.Equal(got, data) {
+		t.Errorf("copy -zeros should preserve content, got %d bytes", len(got))
+	}
+
+	encName := filepath.Join(dir, "enc")
+	if _, status := runTest(t, "convert", "-zeros", "4096", inName, encName); status != 0 {
+		t.Fatalf("convert -zeros failed")
+	}
+	f, _ := os.Open(encName)
+	b, err := sparse.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("convert -zeros should produce a valid encoding, got %v", err)
+	}
+	got := make([]byte, len(data)+1)
+	if n, _ := sparse.NewReadSeeker(b, nil).ReadAt(got, 0); n != len(data) || !bytes.Equal(got[:n], data) {
+		t.Errorf("convert -zeros should preserve content, got %d bytes", n)
+	}
+	// The last short run joins the long one.
+	if m := b.Map(); m.DataBytes != int64(len(data)-3000-3*blockSize) {
+		t.Errorf("convert -zeros should leave only the last run as a hole, got:\n%s", m)
+	}
+}
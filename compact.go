@@ -0,0 +1,185 @@
+package sparse
+
+import (
+	"fmt"
+)
+
+// CompactOptions controls how Compact merges segments.
+type CompactOptions struct {
+	// MaxGap is the largest hole between two segments that will be filled
+	// with zeros so that the segments can be merged.  If zero, only adjacent
+	// segments are merged.
+	MaxGap int64
+}
+
+// Check verifies that b's segments are in order and do not overlap, and that
+// its accounting of memory use and statistics is consistent.  It returns an error describing
+// the first problem found, or nil.  It is intended for tests and debugging.
+func (b *Buffer) Check() error {
+	var resident, spilledBytes int64
+	curOK := b.cur == nil
+	for i := range b.es {
+		s := &b.es[i]
+		if s == b.cur {
+			curOK = true
+		}
+		if s.off < 0 {
+			return fmt.Errorf("sparse: segment %d has negative offset %d", i, s.off)
+		}
+		if i > 0 && s.off < b.es[i-1].end() {
+			return fmt.Errorf("sparse: segment %d at %d overlaps segment %d ending at %d", i, s.off, i-1, b.es[i-1].end())
+		}
+		if s.cold != nil {
+			if s.data != nil {
+				return fmt.Errorf("sparse: segment %d at %d holds both cold and resident data", i, s.off)
+			}
+			if sp, ok := s.cold.(*spilled); ok {
+				spilledBytes += int64(sp.n)
+			}
+		} else {
+			resident += int64(len(s.data))
+		}
+	}
+	if !curOK {
+		return fmt.Errorf("sparse: current segment is not one of the buffer's segments")
+	}
+	if resident != b.resident {
+		return fmt.Errorf("sparse: %d bytes resident, but accounted as %d", resident, b.resident)
+	}
+	if b.store != nil && spilledBytes != b.store.used {
+		return fmt.Errorf("sparse: %d bytes spilled, but accounted as %d", spilledBytes, b.store.used)
+	}
+	var st segStats
+	st.tally(b.es, 0, len(b.es), 1)
+	if st.segments != b.stats.segments || st.data != b.stats.data || st.capacity != b.stats.capacity ||
+		st.adjacent != b.stats.adjacent || st.compressed != b.stats.compressed ||
+		st.compressedMem != b.stats.compressedMem || !sameCounts(st.sizes, b.stats.sizes) {
+		return fmt.Errorf("sparse: statistics are %+v, but accounted as %+v", st, b.stats)
+	}
+	if st.large.top(st.sizes, -1) != b.stats.large.top(b.stats.sizes, -1) ||
+		st.small.top(st.sizes, 1) != b.stats.small.top(b.stats.sizes, 1) {
+		return fmt.Errorf("sparse: largest and smallest segments are %d and %d, but accounted as %d and %d",
+			st.large.top(st.sizes, -1), st.small.top(st.sizes, 1),
+			b.stats.large.top(b.stats.sizes, -1), b.stats.small.top(b.stats.sizes, 1))
+	}
+	return nil
+}
+
+func sameCounts(a, b map[int64]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Compact merges adjacent segments, and segments separated by holes of no
+// more than opts.MaxGap bytes, into single segments.  This bounds the
+// fragmentation caused by many small writes with StoreAt, which does not
+// merge segments, at the cost of copying their data.  Holes that are bridged
+// become zeros held as data.  Segments not held in memory are read back to be
+// merged, and each merged segment is then compressed, deduplicated or spilled
+// as b's settings require before the next is merged.  If a segment cannot be
+// read back, the error is reported by Err and its run is left unmerged.
+func (b *Buffer) Compact(opts CompactOptions) {
+	es := b.es[:0]
+	for i := 0; i < len(b.es); {
+		j := i + 1
+		for j < len(b.es) && b.es[j].off-b.es[j-1].end() <= opts.MaxGap {
+			j++
+		}
+		if j-i == 1 {
+			es = append(es, b.es[i])
+		} else if m, err := b.merged(b.es[i:j]); err != nil {
+			b.setErr(err)
+			es = append(es, b.es[i:j]...)
+		} else {
+			b.cool(&m)
+			es = append(es, m)
+		}
+		i = j
+	}
+	for i := len(es); i < len(b.es); i++ {
+		b.es[i] = segment{} // zero the segment to free any memory
+	}
+	b.es = es
+	b.cur = nil
+	b.recount()
+	b.dedupCold(0, len(b.es))
+	b.compressCold(0, len(b.es))
+	b.spillCold()
+}
+
+// merged returns a single resident segment holding the data of segs, with
+// any holes between them filled with zeros, and releases the data of segs.
+func (b *Buffer) merged(segs []segment) (segment, error) {
+	start, end := segs[0].off, segs[len(segs)-1].end()
+	m := segment{off: start, data: make([]byte, end-start)}
+	for i := range segs {
+		s := &segs[i]
+		if _, err := s.ReadAt(m.data[s.off-start:s.end()-start], s.off); err != nil {
+			return segment{}, err
+		}
+		if s.used > m.used {
+			m.used = s.used
+		}
+	}
+	for i := range segs {
+		if s := &segs[i]; s.cold != nil {
+			s.cold.release()
+		} else {
+			b.resident -= int64(len(s.data))
+		}
+	}
+	b.resident += int64(len(m.data))
+	return m, nil
+}
+
+// cool moves the data of m, a merged segment not yet in b.es, out of memory
+// as dedupCold, compressCold and spillCold would, so that compacting data held
+// out of memory does not bring all of it into memory at once.
+func (b *Buffer) cool(m *segment) {
+	if m.used == b.tick || len(m.data) == 0 {
+		return
+	}
+	switch {
+	case b.blocks != nil:
+		b.resident -= int64(len(m.data))
+		m.cold, m.data = b.blocks.dedup(m.data, m.off), nil
+	case b.comp != nil && len(m.data) >= b.comp.minSize:
+		b.resident -= int64(len(m.data))
+		m.cold, m.data = b.comp.compress(m.data), nil
+	case b.limit > 0 && b.resident > b.limit && b.err == nil:
+		if err := b.spill(m); err != nil {
+			b.setErr(err)
+		}
+	}
+}
+
+// SetAutoCompact makes b compact itself with opts whenever a write leaves it
+// with more than threshold segments.  A threshold of 0 disables automatic
+// compaction.
+func (b *Buffer) SetAutoCompact(threshold int, opts CompactOptions) {
+	b.compactThreshold = threshold
+	b.compactAt = threshold
+	b.compactOpts = opts
+	b.autoCompact()
+}
+
+func (b *Buffer) autoCompact() {
+	if b.compactThreshold <= 0 || len(b.es) <= b.compactAt {
+		return
+	}
+	b.Compact(b.compactOpts)
+	// If compaction could not bring the segment count down far enough, wait
+	// for it to double before trying again, so that each write does not pay
+	// for a compaction that achieves nothing.
+	b.compactAt = 2 * len(b.es)
+	if b.compactAt < b.compactThreshold {
+		b.compactAt = b.compactThreshold
+	}
+}
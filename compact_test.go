@@ -0,0 +1,154 @@
+package sparse_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func TestCompact(t *testing.T) {
+	var sb sparse.Buffer
+	for i := 0; i < 6; i++ {
+		sb.StoreAt([]byte{byte('A' + i)}, int64(i))
+	}
+	sb.StoreAt([]byte("GG"), 8)
+	sb.StoreAt([]byte("HH"), 14)
+	if es, _ := sparse.Extents(&sb); len(es) != 8 {
+		t.Fatalf("StoreAt should leave 8 segments, got %v", es)
+	}
+
+	sb.Compact(sparse.CompactOptions{})
+	want := []sparse.Extent{{0, 6}, {8, 2}, {14, 2}}
+	if got, _ := sparse.Extents(&sb); !reflect.DeepEqual(got, want) {
+		t.Errorf("Compact should leave extents %v, got %v", want, got)
+	}
+	if err := sb.Check(); err != nil {
+		t.Errorf("Check after Compact returned %v", err)
+	}
+
+	sb.Compact(sparse.CompactOptions{MaxGap: 2})
+	want = []sparse.Extent{{0, 10}, {14, 2}}
+	if got, _ := sparse.Extents(&sb); !reflect.DeepEqual(got, want) {
+		t.Errorf("Compact with MaxGap 2 should leave extents %v, got %v", want, got)
+	}
+	if got, want := readAll(t, &sb), "ABCDEF..GG....HH"; got != want {
+		t.Errorf("Compact should leave %q, got %q", want, got)
+	}
+	if resident, _ := sb.MemoryUsage(); resident != 12 {
+		t.Errorf("Compact should leave 12 bytes resident, got %d", resident)
+	}
+	if err := sb.Check(); err != nil {
+		t.Errorf("Check after Compact returned %v", err)
+	}
+}
+
+func TestCompactSpilled(t *testing.T) {
+	var sb sparse.Buffer
+	sb.SetMemoryLimit(4, &memStore{})
+	for i := 0; i < 8; i++ {
+		sb.StoreAt([]byte{byte('A' + i)}, int64(i))
+	}
+	sb.Compact(sparse.CompactOptions{})
+	if got, want := readAll(t, &sb), "ABCDEFGH"; got != want {
+		t.Errorf("Compact should leave %q, got %q", want, got)
+	}
+	if err := sb.Check(); err != nil {
+		t.Errorf("Check after Compact returned %v", err)
+	}
+}
+
+func TestCompactCold(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		setup func(sb *sparse.Buffer)
+	}{
+		{"Compressed", func(sb *sparse.Buffer) {
+			sb.SetCompression(&sparse.CompressOptions{ChunkSize: 4, MinSize: 1})
+		}},
+		{"Deduped", func(sb *sparse.Buffer) { sb.SetBlockStore(sparse.NewBlockStore(4)) }},
+		{"Spilled", func(sb *sparse.Buffer) { sb.SetMemoryLimit(1, &memStore{}) }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var sb sparse.Buffer
+			c.setup(&sb)
+			for i := 0; i < 8; i++ {
+				sb.StoreAt([]byte{byte('A' + i)}, int64(i))
+			}
+			sb.StoreAt([]byte("JJ"), 9)
+			sb.StoreAt([]byte("Z"), 20) // the last written, left in memory
+			if st := sb.Stats(); st.Segments != 10 {
+				t.Fatalf("StoreAt should leave 10 segments, got %d", st.Segments)
+			}
+
+			sb.Compact(sparse.CompactOptions{MaxGap: 1})
+			want := []sparse.Extent{{Off: 0, Len: 11}, {Off: 20, Len: 1}}
+			if got, _ := sparse.Extents(&sb); !reflect.DeepEqual(got, want) {
+				t.Errorf("Compact should merge segments held out of memory into %v, got %v", want, got)
+			}
+			if got, want := readAll(t, &sb), "ABCDEFGH.JJ.........Z"; got != want {
+				t.Errorf("Compact should leave %q, got %q", want, got)
+			}
+			if resident, _ := sb.MemoryUsage(); resident > 1 {
+				t.Errorf("Compact should move merged data out of memory, got %d bytes resident", resident)
+			}
+			if err := sb.Err(); err != nil {
+				t.Errorf("Err returned %v", err)
+			}
+			if err := sb.Check(); err != nil {
+				t.Errorf("Check after Compact returned %v", err)
+			}
+
+			var auto sparse.Buffer
+			c.setup(&auto)
+			auto.SetAutoCompact(16, sparse.CompactOptions{})
+			for i := 0; i < 200; i++ {
+				auto.StoreAt([]byte{byte('A' + i%26)}, int64(i))
+			}
+			if st := auto.Stats(); st.Segments > 17 {
+				t.Errorf("auto-compaction should limit segments to 17, got %d", st.Segments)
+			}
+			if err := auto.Check(); err != nil {
+				t.Errorf("Check after auto-compaction returned %v", err)
+			}
+		})
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	var sb sparse.Buffer
+	sb.SetAutoCompact(16, sparse.CompactOptions{})
+	for i := 0; i < 1000; i++ {
+		sb.StoreAt([]byte{byte('A' + i%26)}, int64(i))
+		if es, _ := sparse.Extents(&sb); len(es) > 17 {
+			t.Fatalf("auto-compaction should limit segments to 17, got %d after %d writes", len(es), i+1)
+		}
+	}
+	if es, _ := sparse.Extents(&sb); len(es) == 1000 {
+		t.Errorf("auto-compaction should have merged some segments")
+	}
+	if err := sb.Check(); err != nil {
+		t.Errorf("Check returned %v", err)
+	}
+}
+
+func TestAutoCompactUnmarshal(t *testing.T) {
+	var src sparse.Buffer
+	src.WriteAt([]byte("AAA"), 0)
+	data, _ := src.MarshalBinary()
+
+	var sb sparse.Buffer
+	sb.SetAutoCompact(16, sparse.CompactOptions{})
+	if err := sb.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary returned error %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		sb.StoreAt([]byte{byte('A' + i%26)}, int64(i+3))
+	}
+	if es, _ := sparse.Extents(&sb); len(es) > 17 {
+		t.Errorf("UnmarshalBinary should keep auto-compaction, got %d segments", len(es))
+	}
+	if err := sb.Check(); err != nil {
+		t.Errorf("Check returned %v", err)
+	}
+}
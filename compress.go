@@ -0,0 +1,273 @@
+package sparse
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+)
+
+// CompressOptions controls how a Buffer compresses its segments.
+type CompressOptions struct {
+	// Level is the flate compression level.  If zero, flate.DefaultCompression
+	// is used.
+	Level int
+
+	// ChunkSize is the number of bytes compressed independently of each
+	// other, so that reading a few bytes needs only one chunk decompressed.
+	// If zero, 64 KiB is used.
+	ChunkSize int
+
+	// CacheChunks is the number of decompressed chunks kept for reads.  If
+	// zero, 8 are kept.
+	CacheChunks int
+
+	// MinSize is the size of the smallest segment worth compressing.  If
+	// zero, segments of less than 256 bytes are left alone.
+	MinSize int
+}
+
+const (
+	defaultChunkSize   = 16 * DefaultBlockSize
+	defaultCacheChunks = 8
+	defaultMinCompress = 256
+)
+
+// compressor compresses segments for a Buffer.
+type compressor struct {
+	w         *flate.Writer
+	buf       bytes.Buffer
+	chunkSize int
+	minSize   int
+	cache     *chunkCache
+}
+
+// chunk is a chunk of a segment's bytes, compressed independently of the
+// others.
+type chunk struct {
+	data []byte
+	raw  bool // data could not be compressed, so is held as is
+}
+
+// compressed is coldData held compressed in memory.  The segment's bytes are
+// the decompressed chunks, less skip bytes at the start, truncated to n bytes.
+// Every chunk but the last decompresses to chunkSize bytes.  Chunks may be
+// shared with other segments after a split, so are never modified.
+type compressed struct {
+	cache     *chunkCache
+	chunkSize int
+	chunks    []*chunk
+	skip      int
+	n         int
+}
+
+func (c *compressed) size() int { return c.n }
+
+func (c *compressed) readAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(c.n) {
+		return 0, io.EOF
+	}
+	if rem := int64(c.n) - off; int64(len(p)) > rem {
+		p = p[:rem]
+		err = io.EOF
+	}
+	pos := int64(c.skip) + off
+	for n < len(p) {
+		data, derr := c.cache.get(c.chunks[pos/int64(c.chunkSize)])
+		if derr != nil {
+			return n, derr
+		}
+		nn := copy(p[n:], data[pos%int64(c.chunkSize):])
+		n += nn
+		pos += int64(nn)
+	}
+	return n, err
+}
+
+func (c *compressed) truncate(n int) {
+	k := (c.skip + n + c.chunkSize - 1) / c.chunkSize
+	c.cache.drop(c.chunks[k:])
+	c.chunks = append([]*chunk(nil), c.chunks[:k]...)
+	c.n = n
+}
+
+func (c *compressed) split(n int) coldData {
+	first := (c.skip + n) / c.chunkSize
+	right := &compressed{
+		cache:     c.cache,
+		chunkSize: c.chunkSize,
+		chunks:    append([]*chunk(nil), c.chunks[first:]...),
+		skip:      (c.skip + n) % c.chunkSize,
+		n:         c.n - n,
+	}
+	// The chunk at the split may now belong to both, so truncate only what
+	// lies wholly beyond it.
+	k := (c.skip + n + c.chunkSize - 1) / c.chunkSize
+	c.chunks = append([]*chunk(nil), c.chunks[:k]...)
+	c.n = n
+	return right
+}
+
+func (c *compressed) release() {
+	c.cache.drop(c.chunks)
+	c.chunks = nil
+	c.n = 0
+}
+
+// memSize returns the number of bytes of memory holding c's chunks.
+func (c *compressed) memSize() (n int64) {
+	for _, ch := range c.chunks {
+		n += int64(len(ch.data))
+	}
+	return
+}
+
+// compress returns data compressed as coldData.
+func (z *compressor) compress(data []byte) *compressed {
+	c := &compressed{cache: z.cache, chunkSize: z.chunkSize, n: len(data)}
+	for off := 0; off < len(data); off += z.chunkSize {
+		end := off + z.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		z.buf.Reset()
+		z.w.Reset(&z.buf)
+		// Writes to a bytes.Buffer cannot fail.
+		z.w.Write(data[off:end])
+		z.w.Close()
+		ch := &chunk{data: append([]byte(nil), z.buf.Bytes()...)}
+		if len(ch.data) >= end-off {
+			ch = &chunk{data: append([]byte(nil), data[off:end]...), raw: true}
+		}
+		c.chunks = append(c.chunks, ch)
+	}
+	return c
+}
+
+// chunkCache is a small cache of decompressed chunks, evicting the least
+// recently used.  Like the Buffer using it, it is not safe for concurrent
+// use.
+type chunkCache struct {
+	max  int
+	r    io.ReadCloser
+	ents []cacheEntry // least recently used first
+}
+
+type cacheEntry struct {
+	ch   *chunk
+	data []byte
+}
+
+// get returns the decompressed content of ch.
+func (cc *chunkCache) get(ch *chunk) ([]byte, error) {
+	if ch.raw {
+		return ch.data, nil
+	}
+	for i, e := range cc.ents {
+		if e.ch == ch {
+			copy(cc.ents[i:], cc.ents[i+1:])
+			cc.ents[len(cc.ents)-1] = e
+			return e.data, nil
+		}
+	}
+	src := bytes.NewReader(ch.data)
+	if cc.r == nil {
+		cc.r = flate.NewReader(src)
+	} else if err := cc.r.(flate.Resetter).Reset(src, nil); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(cc.r)
+	if err != nil {
+		return nil, err
+	}
+	if len(cc.ents) >= cc.max {
+		copy(cc.ents, cc.ents[1:])
+		cc.ents[len(cc.ents)-1] = cacheEntry{}
+		cc.ents = cc.ents[:len(cc.ents)-1]
+	}
+	cc.ents = append(cc.ents, cacheEntry{ch, data})
+	return data, nil
+}
+
+// drop removes any entries for chunks from the cache.
+func (cc *chunkCache) drop(chunks []*chunk) {
+	ents := cc.ents[:0]
+	for _, e := range cc.ents {
+		keep := true
+		for _, ch := range chunks {
+			if e.ch == ch {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			ents = append(ents, e)
+		}
+	}
+	for i := len(ents); i < len(cc.ents); i++ {
+		cc.ents[i] = cacheEntry{}
+	}
+	cc.ents = ents
+}
+
+// SetCompression makes b compress the data it holds in memory, using opts,
+// or stops it compressing if opts is nil.  Segments are compressed when a
+// write goes elsewhere, and decompressed a chunk at a time as they are read,
+// keeping the most recently read chunks.  A segment is brought back into
+// memory uncompressed only when it is modified.  Compressed segments are
+// never spilled by SetMemoryLimit.  Stats reports how well the data
+// compresses.
+//
+// Stopping compression does not decompress segments already compressed.  An
+// error is returned only if opts.Level is invalid.
+func (b *Buffer) SetCompression(opts *CompressOptions) error {
+	if opts == nil {
+		b.comp = nil
+		return nil
+	}
+	level := opts.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	w, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return err
+	}
+	z := &compressor{
+		w:         w,
+		chunkSize: opts.ChunkSize,
+		minSize:   opts.MinSize,
+		cache:     &chunkCache{max: opts.CacheChunks},
+	}
+	if z.chunkSize <= 0 {
+		z.chunkSize = defaultChunkSize
+	}
+	if z.minSize <= 0 {
+		z.minSize = defaultMinCompress
+	}
+	if z.cache.max <= 0 {
+		z.cache.max = defaultCacheChunks
+	}
+	b.comp = z
+	b.compressCold(0, len(b.es))
+	return nil
+}
+
+// compressCold compresses the segments b.es[i:j] held in memory, other than
+// the one most recently written.
+func (b *Buffer) compressCold(i, j int) {
+	if b.comp == nil {
+		return
+	}
+	for ; i < j; i++ {
+		s := &b.es[i]
+		if s.cold != nil || len(s.data) < b.comp.minSize || s.used == b.tick {
+			continue
+		}
+		b.stats.tally(b.es, i, i+1, -1)
+		b.resident -= int64(len(s.data))
+		s.cold = b.comp.compress(s.data)
+		s.data = nil
+		b.stats.tally(b.es, i, i+1, 1)
+	}
+}
@@ -0,0 +1,171 @@
+package sparse_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsetest"
+)
+
+func TestCompressConformance(t *testing.T) {
+	sparsetest.TestReadWriteFinder(t, func(t *testing.T) sparse.ReadWriteFinder {
+		sb := new(sparse.Buffer)
+		sb.SetCompression(&sparse.CompressOptions{ChunkSize: 4, CacheChunks: 2, MinSize: 1})
+		return sb
+	})
+}
+
+func TestCompress(t *testing.T) {
+	var sb sparse.Buffer
+	if err := sb.SetCompression(&sparse.CompressOptions{ChunkSize: 1000}); err != nil {
+		t.Fatalf("SetCompression should succeed, got %v", err)
+	}
+	logs := bytes.Repeat([]byte("INFO all is well\n"), 300)
+	sb.WriteAt(logs, 0)
+	if st := sb.Stats(); st.Compressed != 0 || st.Resident != int64(len(logs)) {
+		t.Errorf("the segment being written should not be compressed, got %+v", st)
+	}
+
+	sb.WriteAt([]byte("x"), 10000)
+	st := sb.Stats()
+	if st.Compressed != int64(len(logs)) || st.Resident != 1 {
+		t.Errorf("writing elsewhere should compress the first segment, got %+v", st)
+	}
+	if st.CompressedMem <= 0 || st.CompressedMem >= st.Compressed/4 {
+		t.Errorf("repetitive data should compress well, got %d bytes from %d", st.CompressedMem, st.Compressed)
+	}
+	if err := sb.Check(); err != nil {
+		t.Error(err)
+	}
+
+	// Reads decompress as needed, across chunk boundaries.
+	p := make([]byte, 100)
+	if n, err := sparse.NewReadSeeker(&sb, nil).ReadAt(p, 950); n != len(p) || err != nil || !bytes.Equal(p, logs[950:1050]) {
+		t.Errorf("ReadAt should read the compressed data, got %d, %v, %q", n, err, p[:n])
+	}
+
+	// Modifying a compressed segment brings it back into memory.
+	sb.WriteAt([]byte("WARN"), 17)
+	copy(logs[17:], "WARN")
+	if st := sb.Stats(); st.Compressed != 0 || st.Resident != int64(len(logs))+1 {
+		t.Errorf("modifying a segment should decompress it, got %+v", st)
+	}
+	sb.Seek(0, io.SeekStart)
+	got := make([]byte, len(logs))
+	if n, err := io.ReadFull(sparse.NewReader(&sb, nil), got); n != len(got) || err != nil || !bytes.Equal(got, logs) {
+		t.Errorf("Buffer should read back what was written, got %d, %v", n, err)
+	}
+	if err := sb.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompressUnmarshal(t *testing.T) {
+	logs := bytes.Repeat([]byte("INFO all is well\n"), 300)
+	var src sparse.Buffer
+	src.WriteAt(logs, 0)
+	src.WriteAt([]byte("x"), 10000)
+	data, _ := src.MarshalBinary()
+
+	var sb sparse.Buffer
+	sb.SetCompression(&sparse.CompressOptions{})
+	if err := sb.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary returned error %v", err)
+	}
+	if st := sb.Stats(); st.Compressed != int64(len(logs)) || st.Resident != 1 {
+		t.Errorf("UnmarshalBinary should compress the decoded segments, got %+v", st)
+	}
+	sb.WriteAt(logs, 20000)
+	sb.WriteAt([]byte("y"), 30000)
+	if st := sb.Stats(); st.Compressed != 2*int64(len(logs)) {
+		t.Errorf("UnmarshalBinary should keep compressing later writes, got %+v", st)
+	}
+	if err := sb.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompressEachWrite(t *testing.T) {
+	var sb sparse.Buffer
+	sb.SetCompression(&sparse.CompressOptions{MinSize: 10})
+	chunk := bytes.Repeat([]byte("a"), 100)
+	for i := 0; i < 100; i++ {
+		sb.WriteAt(chunk, int64(i)*1000)
+	}
+	if st := sb.Stats(); st.Compressed != 99*100 || st.Resident != 100 {
+		t.Errorf("each write should compress the one before it, got %+v", st)
+	}
+
+	// Both halves of a segment split while being written are compressed.
+	sb.WriteAt(chunk, 200000)
+	sb.PunchHole(200040, 20)
+	sb.Seek(200000, io.SeekStart)
+	sb.Read(make([]byte, 10))
+	sb.WriteAt(chunk, 300000)
+	if st := sb.Stats(); st.Compressed != 100*100+80 || st.Resident != 100 {
+		t.Errorf("the halves of a split segment should be compressed, got %+v", st)
+	}
+
+	// A write joining segments leaves only the joined one in memory.
+	sb.WriteAt(chunk, 300100)
+	sb.WriteAt(chunk, 299900)
+	sb.WriteAt([]byte("x"), 400000)
+	if st := sb.Stats(); st.Compressed != 100*100+80+300 || st.Resident != 1 {
+		t.Errorf("joined segments should be compressed, got %+v", st)
+	}
+	if err := sb.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompressRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var sb sparse.Buffer
+	sb.SetCompression(&sparse.CompressOptions{ChunkSize: 16, CacheChunks: 3, MinSize: 8})
+	var m []byte
+	var compressed bool
+	for i := 0; i < 2000; i++ {
+		off := r.Intn(400)
+		n := r.Intn(64)
+		switch r.Intn(4) {
+		case 0:
+			sb.PunchHole(int64(off), int64(n))
+			if off < len(m) {
+				end := off + n
+				if end > len(m) {
+					end = len(m)
+				}
+				copy(m[off:end], make([]byte, end-off))
+			}
+		case 1:
+			sb.Truncate(int64(off))
+			if off < len(m) {
+				m = m[:off]
+			} else {
+				m = append(m, make([]byte, off-len(m))...)
+			}
+		default:
+			p := bytes.Repeat([]byte{byte('a' + r.Intn(4))}, n)
+			sb.WriteAt(p, int64(off))
+			if end := off + n; end > len(m) {
+				m = append(m, make([]byte, end-len(m))...)
+			}
+			copy(m[off:], p)
+		}
+		if err := sb.Check(); err != nil {
+			t.Fatalf("op %d: %v", i, err)
+		}
+		if got, want := readAll(t, &sb), printable(m); got != want {
+			t.Fatalf("op %d: Buffer should read %q, got %q", i, want, got)
+		}
+		if sb.Stats().Compressed > 0 {
+			compressed = true
+		}
+	}
+	if !compressed {
+		t.Errorf("some segments should have been compressed")
+	}
+}
@@ -2,15 +2,19 @@ package sparse
 
 import (
 	"io"
+	"io/ioutil"
 )
 
 // Copy copies the sparse data from r to appropriate locations within w.  Returns the
 // number of bytes copied, excluding regions skipped.  Seeks within w will be relative
 // to the current file position.
 func Copy(w io.WriteSeeker, r Reader) (n int64, err error) {
+	// Hide any WriteTo or ReadFrom methods from io.Copy, since they would copy
+	// beyond the end of the current segment.
+	dst, src := struct{ io.Writer }{w}, struct{ io.Reader }{r}
 	for {
 		var nn, skip int64
-		nn, err = io.Copy(w, r)
+		nn, err = io.Copy(dst, src)
 		n += nn
 		if err != nil {
 			break
@@ -30,3 +34,158 @@ func Copy(w io.WriteSeeker, r Reader) (n int64, err error) {
 	}
 	return
 }
+
+// copyChunk is the size of the buffers used to copy data and write zeros.
+const copyChunk = 32 * 1024
+
+// WriteTo writes the content of b from the file position to the end to w,
+// with holes as zeros, and leaves the file position at the end.  If w is also
+// an io.Seeker, holes that would land beyond the end of w are seeked over
+// rather than written, so that they can remain holes in w.  The last byte is
+// always written, so that w ends up the right length.  Returns the number of
+// bytes written, which excludes holes seeked over.
+func (b *Buffer) WriteTo(w io.Writer) (n int64, err error) {
+	size := b.Size()
+	pos := b.filePos
+
+	// Holes at and after skipFrom can be seeked over, since w holds nothing
+	// there.
+	skipFrom := size
+	ws, _ := w.(io.Seeker)
+	if ws != nil {
+		cur, err := ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		end, err := ws.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = ws.Seek(cur, io.SeekStart); err != nil {
+			return 0, err
+		}
+		skipFrom = pos
+		if end > cur {
+			skipFrom += end - cur
+		}
+	}
+
+	buf := make([]byte, copyChunk)
+	for pos < size && err == nil {
+		next := size
+		if ofs, _, ferr := b.Find(pos); ferr == nil {
+			next = ofs
+			if next < pos {
+				next = pos
+			}
+		}
+		if next > pos {
+			var nn int64
+			nn, err = writeHole(w, ws, pos, next, skipFrom, size)
+			n += nn
+			pos = next
+			continue
+		}
+		var nr, nw int
+		if nr, err = b.Read(buf); nr == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrNoProgress
+			}
+			break
+		}
+		nw, err = w.Write(buf[:nr])
+		n += int64(nw)
+		pos += int64(nw)
+	}
+	b.filePos = pos
+	b.cur = nil
+	return
+}
+
+// writeHole writes or seeks over the hole within from:to, so that w holds
+// zeros there.  Zeros are written before skipFrom, where w may hold data of
+// its own, and for the last byte of a hole ending at size.  If ws is nil, the
+// whole hole is written.
+func writeHole(w io.Writer, ws io.Seeker, from, to, skipFrom, size int64) (n int64, err error) {
+	seekFrom, seekTo := to, to
+	if ws != nil {
+		seekFrom, seekTo = skipFrom, to
+		if seekFrom < from {
+			seekFrom = from
+		}
+		if to == size {
+			seekTo--
+		}
+		if seekFrom > seekTo {
+			seekFrom = seekTo
+		}
+	}
+	if n, err = writeZeros(w, seekFrom-from); err != nil {
+		return
+	}
+	if seekTo > seekFrom {
+		if _, err = ws.Seek(seekTo-seekFrom, io.SeekCurrent); err != nil {
+			return
+		}
+	}
+	nn, err := writeZeros(w, to-seekTo)
+	return n + nn, err
+}
+
+func writeZeros(w io.Writer, n int64) (written int64, err error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	zeros := make([]byte, copyChunk)
+	for written < n && err == nil {
+		chunk := zeros
+		if rem := n - written; rem < int64(len(chunk)) {
+			chunk = chunk[:rem]
+		}
+		var nn int
+		nn, err = w.Write(chunk)
+		written += int64(nn)
+	}
+	return
+}
+
+// ReadFrom reads from r until EOF, and writes what it reads to b at the file
+// position, as Write would.  Runs of DefaultBlockSize or more zeros are not
+// stored, but leave holes in b, as Make would find them.  Returns the number
+// of bytes read from r, including zeros.
+func (b *Buffer) ReadFrom(r io.Reader) (n int64, err error) {
+	m := Make(r, DefaultBlockSize)
+	pos := b.filePos
+	for {
+		var data []byte
+		if data, err = ioutil.ReadAll(m); len(data) > 0 {
+			n += int64(len(data))
+			if _, werr := b.writeAt(data, pos, true); werr != nil && err == nil {
+				err = werr
+			}
+			pos += int64(len(data))
+		}
+		if err != nil {
+			break
+		}
+		var skip int64
+		skip, err = m.Next()
+		if skip > 0 {
+			b.PunchHole(pos, skip)
+			pos += skip
+			n += skip
+			if pos > b.Size() {
+				b.Truncate(pos)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+	}
+	b.filePos = pos
+	b.cur = nil
+	return
+}
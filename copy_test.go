@@ -1,6 +1,10 @@
 package sparse_test
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
 	"testing"
 
 	"github.com/dnesting/sparse"
@@ -32,4 +36,84 @@ func TestCopy(t *testing.T) {
 	if string(buf[:n]) != "BBB" {
 		t.Errorf("Failed to copy, expected AAA, got %q", buf[:n])
 	}
+
+	if eq, ofs, err := sparse.Equal(&a, &b, &sparse.EqualOptions{Strict: true}); !eq || err != nil {
+		t.Errorf("Copy should produce an identical buffer, differs at %d (err=%v)", ofs, err)
+	}
+}
+
+func TestBufferWriteTo(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAA"), 2)
+	sb.WriteAt([]byte("BBB"), 7)
+	sb.Truncate(12)
+
+	var out bytes.Buffer
+	n, err := sb.WriteTo(&out)
+	if want := "..AAA..BBB.."; n != 12 || err != nil || printable(out.Bytes()) != want {
+		t.Errorf("WriteTo should write %q, got %d, %v, %q", want, n, err, printable(out.Bytes()))
+	}
+	if n, err := sb.WriteTo(&out); n != 0 || err != nil {
+		t.Errorf("WriteTo at the end should write nothing, got %d, %v", n, err)
+	}
+
+	// A destination that can seek gets holes where it had nothing before.
+	var dst sparse.Buffer
+	dst.WriteAt([]byte("XXXX"), 0)
+	dst.Seek(0, io.SeekStart)
+	sb.Seek(0, io.SeekStart)
+	n, err = sb.WriteTo(&dst)
+	if n != 9 || err != nil {
+		t.Errorf("WriteTo should write 9 bytes, got %d, %v", n, err)
+	}
+	if got, want := readAll(t, &dst), "..AAA..BBB.."; got != want {
+		t.Errorf("WriteTo should leave %q, got %q", want, got)
+	}
+	want := []sparse.Extent{{0, 5}, {7, 3}, {11, 1}}
+	if got, _ := sparse.Extents(&dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("WriteTo should leave extents %v, got %v", want, got)
+	}
+}
+
+func TestBufferReadFrom(t *testing.T) {
+	in := append([]byte("AAA"), make([]byte, sparse.DefaultBlockSize)...)
+	in = append(in, "BB\000\000CC"...)
+	in = append(in, make([]byte, sparse.DefaultBlockSize+1)...)
+
+	var sb sparse.Buffer
+	sb.WriteAt(bytes.Repeat([]byte("X"), 10), 5)
+	sb.Seek(2, io.SeekStart)
+	n, err := sb.ReadFrom(bytes.NewReader(in))
+	if n != int64(len(in)) || err != nil {
+		t.Errorf("ReadFrom should return %d, nil, got %d, %v", len(in), n, err)
+	}
+	if size := sb.Size(); size != int64(len(in))+2 {
+		t.Errorf("ReadFrom should leave Size %d, got %d", len(in)+2, size)
+	}
+	want := []sparse.Extent{{2, 3}, {sparse.DefaultBlockSize + 5, 6}}
+	if got, _ := sparse.Extents(&sb); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFrom should leave extents %v, got %v", want, got)
+	}
+	sb.Seek(0, io.SeekStart)
+	got, _ := ioutil.ReadAll(sparse.NewReader(&sb, nil))
+	if !bytes.Equal(got[2:], in) {
+		t.Errorf("ReadFrom should store what it read")
+	}
+}
+
+func TestBufferIOCopy(t *testing.T) {
+	var src, dst sparse.Buffer
+	src.WriteAt([]byte("AAA"), 2)
+	src.Truncate(sparse.DefaultBlockSize * 2)
+	if n, err := io.Copy(&dst, struct{ io.Reader }{sparse.NewReader(&src, nil)}); n != src.Size() || err != nil {
+		t.Errorf("io.Copy should copy %d bytes, got %d, %v", src.Size(), n, err)
+	}
+	if eq, ofs, err := sparse.Equal(&src, &dst, nil); !eq || err != nil {
+		t.Errorf("io.Copy into a Buffer should copy its content, differs at %d (err=%v)", ofs, err)
+	}
+	// The leading zeros are too few to leave a hole, but the trailing ones are
+	// not.
+	if st := dst.Stats(); st.DataBytes != 5 {
+		t.Errorf("io.Copy into a Buffer should store 5 bytes of data, got %d", st.DataBytes)
+	}
 }
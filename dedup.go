@@ -0,0 +1,217 @@
+package sparse
+
+import (
+	"crypto/sha256"
+	"io"
+	"sync"
+)
+
+// BlockStore is a store of chunks of data keyed by their content, shared by
+// any number of Buffers, so that data held by several of them is stored only
+// once.  Chunks are reference counted, and are dropped when no Buffer holds
+// them any more.  A BlockStore is safe for concurrent use by Buffers used from
+// different goroutines.
+type BlockStore struct {
+	chunkSize int
+
+	mu     sync.Mutex
+	chunks map[hashSum]*storedChunk
+	bytes  int64
+	refs   int64
+}
+
+// storedChunk is a chunk of data held by a BlockStore.
+type storedChunk struct {
+	sum  hashSum
+	data []byte
+	refs int
+}
+
+// BlockStoreStats describes the contents of a BlockStore.
+type BlockStoreStats struct {
+	Chunks     int   // number of distinct chunks held
+	Bytes      int64 // bytes of data held in those chunks
+	References int64 // number of references to them by segments
+}
+
+// NewBlockStore returns an empty BlockStore, which splits data into chunks
+// at multiples of chunkSize bytes from the start of each Buffer, so that
+// identical data at the same offsets in different Buffers shares chunks.  If
+// chunkSize is zero, DefaultBlockSize is used.
+func NewBlockStore(chunkSize int) *BlockStore {
+	if chunkSize <= 0 {
+		chunkSize = DefaultBlockSize
+	}
+	return &BlockStore{chunkSize: chunkSize, chunks: make(map[hashSum]*storedChunk)}
+}
+
+// Stats returns statistics about the contents of s.
+func (s *BlockStore) Stats() BlockStoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return BlockStoreStats{len(s.chunks), s.bytes, s.refs}
+}
+
+// put returns a reference to a chunk holding a copy of p.
+func (s *BlockStore) put(p []byte) *storedChunk {
+	sum := sha256.Sum256(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.chunks[sum]
+	if !ok {
+		c = &storedChunk{sum: sum, data: append([]byte(nil), p...)}
+		s.chunks[sum] = c
+		s.bytes += int64(len(p))
+	}
+	c.refs++
+	s.refs++
+	return c
+}
+
+// retain adds a reference to c.
+func (s *BlockStore) retain(c *storedChunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.refs++
+	s.refs++
+}
+
+// release removes a reference to each of cs, dropping those no longer
+// referenced.
+func (s *BlockStore) release(cs []*storedChunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range cs {
+		s.refs--
+		if c.refs--; c.refs == 0 {
+			delete(s.chunks, c.sum)
+			s.bytes -= int64(len(c.data))
+		}
+	}
+}
+
+// deduped is coldData held in a BlockStore.  The chunks cover consecutive
+// cells of chunkSize bytes.  The first chunk may hold only the end of its
+// cell, starting at first.  The segment's bytes start skip bytes into the
+// cells, and run for n bytes.
+type deduped struct {
+	store  *BlockStore
+	chunks []*storedChunk
+	first  int
+	skip   int
+	n      int
+}
+
+func (d *deduped) size() int { return d.n }
+
+func (d *deduped) readAt(p []byte, off int64) (n int, err error) {
+	cs := d.store.chunkSize
+	pos := d.skip + int(off)
+	for n < len(p) && pos < d.skip+d.n {
+		cell := pos / cs
+		within := pos % cs
+		if cell == 0 {
+			within -= d.first
+		}
+		nn := copy(p[n:], d.chunks[cell].data[within:])
+		if rem := d.skip + d.n - pos; nn > rem {
+			nn = rem
+		}
+		n += nn
+		pos += nn
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// cells returns the number of cells covering the first n bytes of d.
+func (d *deduped) cells(n int) int {
+	cs := d.store.chunkSize
+	return (d.skip + n + cs - 1) / cs
+}
+
+func (d *deduped) truncate(n int) {
+	k := d.cells(n)
+	d.store.release(d.chunks[k:])
+	d.chunks = append([]*storedChunk(nil), d.chunks[:k]...)
+	d.n = n
+}
+
+func (d *deduped) split(n int) coldData {
+	cs := d.store.chunkSize
+	k := (d.skip + n) / cs
+	right := &deduped{
+		store:  d.store,
+		chunks: append([]*storedChunk(nil), d.chunks[k:]...),
+		skip:   d.skip + n - k*cs,
+		n:      d.n - n,
+	}
+	if k == 0 {
+		right.first = d.first
+	}
+	keep := d.cells(n)
+	if keep > k {
+		// The chunk at the split now belongs to both.
+		d.store.retain(d.chunks[k])
+	}
+	d.chunks = append([]*storedChunk(nil), d.chunks[:keep]...)
+	d.n = n
+	return right
+}
+
+func (d *deduped) release() {
+	d.store.release(d.chunks)
+	d.chunks = nil
+	d.n = 0
+}
+
+// dedup returns data, which is to be stored at off, as coldData held in s.
+func (s *BlockStore) dedup(data []byte, off int64) *deduped {
+	cs := s.chunkSize
+	d := &deduped{store: s, first: int(off % int64(cs)), n: len(data)}
+	d.skip = d.first
+	for i := 0; i < len(data); {
+		end := i + cs - int((off+int64(i))%int64(cs))
+		if end > len(data) {
+			end = len(data)
+		}
+		d.chunks = append(d.chunks, s.put(data[i:end]))
+		i = end
+	}
+	return d
+}
+
+// SetBlockStore makes b move the data it holds in memory into s, or stops
+// it doing so if s is nil.  Segments are moved when a write goes elsewhere,
+// and are read directly from s.  A segment is brought back into memory only
+// when it is modified, and its chunks are released from s when it is
+// modified, truncated, punched out or deleted.  Segments held in s are
+// neither compressed by SetCompression nor spilled by SetMemoryLimit.
+//
+// Stopping does not bring segments already in s back into memory.  Close or
+// Reset releases them.
+func (b *Buffer) SetBlockStore(s *BlockStore) {
+	b.blocks = s
+	b.dedupCold(0, len(b.es))
+}
+
+// dedupCold moves the segments b.es[i:j] held in memory, other than the one
+// most recently written, into b's BlockStore.
+func (b *Buffer) dedupCold(i, j int) {
+	if b.blocks == nil {
+		return
+	}
+	for ; i < j; i++ {
+		s := &b.es[i]
+		if s.cold != nil || len(s.data) == 0 || s.used == b.tick {
+			continue
+		}
+		b.stats.tally(b.es, i, i+1, -1)
+		b.resident -= int64(len(s.data))
+		s.cold = b.blocks.dedup(s.data, s.off)
+		s.data = nil
+		b.stats.tally(b.es, i, i+1, 1)
+	}
+}
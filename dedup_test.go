@@ -0,0 +1,150 @@
+package sparse_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsetest"
+)
+
+func TestBlockStoreConformance(t *testing.T) {
+	sparsetest.TestReadWriteFinder(t, func(t *testing.T) sparse.ReadWriteFinder {
+		sb := new(sparse.Buffer)
+		sb.SetBlockStore(sparse.NewBlockStore(4))
+		return sb
+	})
+}
+
+func TestBlockStoreUnmarshal(t *testing.T) {
+	image := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	var src sparse.Buffer
+	src.WriteAt(image, 0)
+	src.WriteAt([]byte("x"), 1000)
+	data, _ := src.MarshalBinary()
+
+	store := sparse.NewBlockStore(16)
+	var sb sparse.Buffer
+	sb.SetBlockStore(store)
+	if err := sb.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary returned error %v", err)
+	}
+	if st := sb.Stats(); st.Resident != 1 {
+		t.Errorf("UnmarshalBinary should move the decoded segments into the store, got %d resident", st.Resident)
+	}
+	sb.WriteAt(image, 2000)
+	sb.WriteAt([]byte("y"), 3000)
+	// Two images of 8 identical chunks, and the "x" moved out by the writes.
+	want := sparse.BlockStoreStats{Chunks: 2, Bytes: 17, References: 17}
+	if got := store.Stats(); got != want {
+		t.Errorf("UnmarshalBinary should keep deduplicating later writes, Stats should be %+v, got %+v", want, got)
+	}
+	if err := sb.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBlockStoreShared(t *testing.T) {
+	store := sparse.NewBlockStore(8)
+	image := bytes.Repeat([]byte("0123456789abcdef"), 8)
+
+	var bufs []*sparse.Buffer
+	for i := 0; i < 10; i++ {
+		sb := new(sparse.Buffer)
+		sb.SetBlockStore(store)
+		sb.WriteAt(image, 100)
+		sb.WriteAt([]byte{byte('A' + i)}, 1000) // differs between images
+		bufs = append(bufs, sb)
+	}
+	// Each image holds 128 bytes of common data starting at 100, in chunks of
+	// 8 aligned to multiples of 8, so 4+8+4 bytes at the edges, and two
+	// distinct 8-byte chunks between.
+	want := sparse.BlockStoreStats{Chunks: 4, Bytes: 4 + 2*8 + 4, References: 10 * 17}
+	if got := store.Stats(); got != want {
+		t.Errorf("Stats should be %+v, got %+v", want, got)
+	}
+	for _, sb := range bufs {
+		if got := readAll(t, sb)[100:228]; got != string(image) {
+			t.Errorf("Buffer should read back the image, got %q", got)
+		}
+		if st := sb.Stats(); st.Resident != 1 {
+			t.Errorf("only the last write should be resident, got %d", st.Resident)
+		}
+	}
+
+	// Overwriting, punching and truncating release references.  The write
+	// to bufs[0] also moves its last write into the store.
+	bufs[0].WriteAt([]byte("X"), 104)
+	bufs[1].PunchHole(100, 128)
+	bufs[2].Truncate(100)
+	if got := store.Stats().References; got != 7*17+1 {
+		t.Errorf("References should be %d, got %d", 7*17+1, got)
+	}
+	for _, sb := range bufs {
+		sb.Close()
+	}
+	if got := store.Stats(); got != (sparse.BlockStoreStats{}) {
+		t.Errorf("a store no longer referenced should be empty, got %+v", got)
+	}
+}
+
+// twinBuffer is a Buffer whose changes are mirrored to a twin sharing its
+// BlockStore, so that the conformance suite exercises chunks referenced by
+// more than one Buffer.  Close checks that the two still match, and that the
+// store is empty once both are closed.
+type twinBuffer struct {
+	*sparse.Buffer
+	twin  *sparse.Buffer
+	store *sparse.BlockStore
+	t     *testing.T
+}
+
+func newTwinBuffer(t *testing.T) sparse.ReadWriteFinder {
+	b := &twinBuffer{new(sparse.Buffer), new(sparse.Buffer), sparse.NewBlockStore(8), t}
+	b.SetBlockStore(b.store)
+	b.twin.SetBlockStore(b.store)
+	return b
+}
+
+func (b *twinBuffer) WriteAt(p []byte, off int64) (int, error) {
+	b.twin.WriteAt(p, off)
+	return b.Buffer.WriteAt(p, off)
+}
+
+func (b *twinBuffer) Write(p []byte) (int, error) {
+	pos, _ := b.Seek(0, io.SeekCurrent)
+	b.twin.WriteAt(p, pos)
+	return b.Buffer.Write(p)
+}
+
+func (b *twinBuffer) Truncate(ofs int64) {
+	b.twin.Truncate(ofs)
+	b.Buffer.Truncate(ofs)
+}
+
+func (b *twinBuffer) PunchHole(off, size int64) {
+	b.twin.PunchHole(off, size)
+	b.Buffer.PunchHole(off, size)
+}
+
+func (b *twinBuffer) Close() error {
+	for _, sb := range []*sparse.Buffer{b.Buffer, b.twin} {
+		if err := sb.Check(); err != nil {
+			b.t.Errorf("Check returned %v", err)
+		}
+	}
+	if eq, ofs, err := sparse.Equal(b.Buffer, b.twin, &sparse.EqualOptions{Strict: true}); !eq || err != nil {
+		b.t.Errorf("twin Buffers should match, differ at %d (err=%v)", ofs, err)
+	}
+	b.Buffer.Close()
+	b.twin.Close()
+	if got := b.store.Stats(); got != (sparse.BlockStoreStats{}) {
+		b.t.Errorf("a store no longer referenced should be empty, got %+v", got)
+	}
+	return nil
+}
+
+func TestBlockStoreSharedConformance(t *testing.T) {
+	sparsetest.TestReadWriteFinder(t, newTwinBuffer)
+}
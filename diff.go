@@ -0,0 +1,354 @@
+package sparse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// DiffOptions controls how sparse sources are compared.
+type DiffOptions struct {
+	// ZeroHoles causes holes to be treated as equal to explicit zeros.  By
+	// default, a hole in one source and data in the other is always a
+	// difference, even if that data is all zeros.
+	ZeroHoles bool
+}
+
+func (o *DiffOptions) zeroHoles() bool { return o != nil && o.ZeroHoles }
+
+const diffChunk = 32 * 1024
+
+// diff calls fn for each range of a and b that differs.  Ranges are never
+// larger than diffChunk and never span data and holes in b.  If the range is
+// data in b, data holds b's content for the range, valid only until fn
+// returns.  Ranges beyond the smaller of the two sizes always differ.  If
+// limit is not negative, only ranges before limit are compared.
+func diff(a, b ReadFinder, opts *DiffOptions, limit int64, fn func(off int64, data []byte, size int64) error) error {
+	minSize := a.Size()
+	if s := b.Size(); s < minSize {
+		minSize = s
+	}
+	pa := make([]byte, diffChunk)
+	pb := make([]byte, diffChunk)
+
+	// runs calls fn for each run of bytes that differ between x and y.
+	runs := func(off int64, x, y []byte, bData bool) error {
+		for i := 0; i < len(x); {
+			if x[i] == y[i] {
+				i++
+				continue
+			}
+			j := i + 1
+			for j < len(x) && x[j] != y[j] {
+				j++
+			}
+			var data []byte
+			if bData {
+				data = y[i:j]
+			}
+			if err := fn(off+int64(i), data, int64(j-i)); err != nil {
+				return err
+			}
+			i = j
+		}
+		return nil
+	}
+
+	compare := func(off, end int64, aData, bData bool) error {
+		for off < end {
+			n := end - off
+			if n > diffChunk {
+				n = diffChunk
+			}
+			x, y := pa[:n], pb[:n]
+			if aData {
+				if err := readExtent(a, x, off); err != nil {
+					return err
+				}
+			}
+			if bData {
+				if err := readExtent(b, y, off); err != nil {
+					return err
+				}
+			}
+			var err error
+			switch {
+			case off >= minSize || (aData != bData && !opts.zeroHoles()):
+				var data []byte
+				if bData {
+					data = y
+				}
+				err = fn(off, data, n)
+			case aData && bData:
+				err = runs(off, x, y, true)
+			case aData:
+				err = runs(off, x, make([]byte, n), false)
+			default:
+				err = runs(off, make([]byte, n), y, true)
+			}
+			if err != nil {
+				return err
+			}
+			off += n
+		}
+		return nil
+	}
+
+	err := walkRegions(a, b, func(off, end int64, aData, bData bool) error {
+		if limit >= 0 {
+			if off >= limit {
+				return errLimit
+			}
+			if end > limit {
+				end = limit
+			}
+		}
+		if !aData && !bData && end <= minSize {
+			return nil
+		}
+		if off < minSize && minSize < end {
+			if err := compare(off, minSize, aData, bData); err != nil {
+				return err
+			}
+			off = minSize
+		}
+		return compare(off, end, aData, bData)
+	})
+	if err == errLimit {
+		err = nil
+	}
+	return err
+}
+
+var errLimit = errors.New("limit reached")
+
+// Diff compares a and b and returns the ranges that differ between them, in
+// order.  Adjacent ranges are coalesced.  A range lying beyond the size of
+// one of the sources but not the other is always considered to differ.  This
+// will move the file positions of both a and b.
+func Diff(a, b ReadFinder, opts *DiffOptions) (es []Extent, err error) {
+	err = diff(a, b, opts, -1, func(off int64, _ []byte, size int64) error {
+		if n := len(es); n > 0 && es[n-1].End() == off {
+			es[n-1].Len += size
+		} else {
+			es = append(es, Extent{off, size})
+		}
+		return nil
+	})
+	return
+}
+
+// PatchOp is a single change within a Patch.  If Data is nil, the range
+// Off:Off+Len is a hole in the target, otherwise Data holds the Len bytes of
+// target content at Off.
+type PatchOp struct {
+	Off  int64
+	Len  int64
+	Data []byte
+}
+
+// Patch describes how to transform one sparse source into another.
+type Patch struct {
+	// Size is the size of the target.
+	Size int64
+	Ops  []PatchOp
+}
+
+// MakePatch builds a Patch that, when applied to a copy of a, produces the
+// content of b.  This will move the file positions of both a and b.
+func MakePatch(a, b ReadFinder, opts *DiffOptions) (*Patch, error) {
+	p := &Patch{Size: b.Size()}
+	err := diff(a, b, opts, -1, func(off int64, data []byte, size int64) error {
+		if data == nil && off >= p.Size {
+			// Truncation will take care of this.
+			return nil
+		}
+		if n := len(p.Ops); n > 0 {
+			if op := &p.Ops[n-1]; op.End() == off && (op.Data == nil) == (data == nil) {
+				op.Len += size
+				if data != nil {
+					op.Data = append(op.Data, data...)
+				}
+				return nil
+			}
+		}
+		op := PatchOp{Off: off, Len: size}
+		if data != nil {
+			op.Data = append([]byte(nil), data...)
+		}
+		p.Ops = append(p.Ops, op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// End returns the offset after this operation, or op.Off+op.Len.
+func (op PatchOp) End() int64 { return op.Off + op.Len }
+
+// Apply applies the patch to w.  If w implements a PunchHole method, as
+// ReadWriteFinder does, it is used for holes.  If w is an *os.File, holes are
+// punched where the platform and file system support it.  Otherwise holes are
+// written as zeros.  If w implements a Truncate method, as ReadWriteFinder and
+// *os.File do, it will be used to set the size of w to p.Size.
+func (p *Patch) Apply(w io.WriterAt) error {
+	var zeros []byte
+	for _, op := range p.Ops {
+		if op.Data != nil {
+			if _, err := w.WriteAt(op.Data, op.Off); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeHoleAt(w, op.Off, op.Len, &zeros); err != nil {
+			return err
+		}
+	}
+	return setSize(w, p.Size)
+}
+
+// writeHoleAt leaves a hole in w at off:off+size, using a PunchHole method if
+// w has one, punching a hole if w is a file, or otherwise writing zeros,
+// allocating *zeros if needed.
+func writeHoleAt(w io.WriterAt, off, size int64, zeros *[]byte) error {
+	if ph, ok := w.(interface{ PunchHole(off, size int64) }); ok {
+		ph.PunchHole(off, size)
+		return nil
+	}
+	if f, ok := w.(*os.File); ok && punchHole(f, off, size) == nil {
+		return nil
+	}
+	if *zeros == nil {
+		*zeros = make([]byte, diffChunk)
+	}
+	for end := off + size; off < end; {
+		n := end - off
+		if n > int64(len(*zeros)) {
+			n = int64(len(*zeros))
+		}
+		if _, err := w.WriteAt((*zeros)[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// setSize sets the size of w with its Truncate method, if it has one.
+func setSize(w io.WriterAt, size int64) error {
+	switch t := w.(type) {
+	case interface{ Truncate(int64) }:
+		t.Truncate(size)
+	case interface{ Truncate(int64) error }:
+		return t.Truncate(size)
+	}
+	return nil
+}
+
+var patchMagic = [4]byte{'S', 'P', 'A', 'T'}
+
+const patchVersion = 1
+
+var errPatchFormat = errors.New("sparse: invalid patch format")
+
+// patch ops are encoded as an offset, a length, and a kind.
+const (
+	patchHole = 0
+	patchData = 1
+)
+
+// patchHeader follows patchMagic in an encoded Patch.
+type patchHeader struct {
+	Version uint32
+	Size    int64
+	NumOps  uint64
+}
+
+// patchOpHeader precedes each op in an encoded Patch, and is followed by
+// Len bytes of data if Kind is patchData.
+type patchOpHeader struct {
+	Off, Len int64
+	Kind     byte
+}
+
+func writePatchHeader(w io.Writer, size int64, numOps int) error {
+	if _, err := w.Write(patchMagic[:]); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, patchHeader{patchVersion, size, uint64(numOps)})
+}
+
+func readPatchHeader(r io.Reader) (hdr patchHeader, err error) {
+	var magic [4]byte
+	if _, err = io.ReadFull(r, magic[:]); err != nil {
+		return
+	}
+	if magic != patchMagic {
+		return hdr, errPatchFormat
+	}
+	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return
+	}
+	if hdr.Version != patchVersion {
+		return hdr, errPatchFormat
+	}
+	return
+}
+
+func readPatchOp(r io.Reader) (op patchOpHeader, err error) {
+	if err = binary.Read(r, binary.BigEndian, &op); err != nil {
+		return
+	}
+	if op.Off < 0 || op.Len < 0 || op.Kind > patchData {
+		return op, errPatchFormat
+	}
+	return
+}
+
+// WriteTo writes an encoded form of p to w, suitable for ReadPatch.
+func (p *Patch) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	writePatchHeader(&buf, p.Size, len(p.Ops))
+	for _, op := range p.Ops {
+		kind := byte(patchHole)
+		if op.Data != nil {
+			kind = patchData
+		}
+		binary.Write(&buf, binary.BigEndian, patchOpHeader{op.Off, op.Len, kind})
+		buf.Write(op.Data)
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadPatch decodes a Patch previously encoded with Patch.WriteTo.
+func ReadPatch(r io.Reader) (*Patch, error) {
+	hdr, err := readPatchHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &Patch{Size: hdr.Size}
+	for i := uint64(0); i < hdr.NumOps; i++ {
+		op, err := readPatchOp(r)
+		if err != nil {
+			return nil, err
+		}
+		po := PatchOp{Off: op.Off, Len: op.Len}
+		if op.Kind == patchData {
+			// Avoid trusting op.Len for an allocation before we've seen the data.
+			var data bytes.Buffer
+			if _, err := io.CopyN(&data, r, op.Len); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			po.Data = data.Bytes()
+		}
+		p.Ops = append(p.Ops, po)
+	}
+	return p, nil
+}
@@ -0,0 +1,107 @@
+package sparse_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+// layout builds a Buffer from a string where '.' is a hole, '_' is an explicit
+// zero byte, and anything else is data.  Trailing holes extend the size.
+func layout(s string) *sparse.Buffer {
+	var sb sparse.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '.':
+		case '_':
+			sb.WriteAt([]byte{0}, int64(i))
+		default:
+			sb.WriteAt([]byte{s[i]}, int64(i))
+		}
+	}
+	sb.Truncate(int64(len(s)))
+	return &sb
+}
+
+func TestDiff(t *testing.T) {
+	for _, c := range []struct {
+		a, b      string
+		zeroHoles bool
+		want      []sparse.Extent
+	}{
+		{"", "", false, nil},
+		{"AAA..BBB", "AAA..BBB", false, nil},
+		{"AAA..BBB", "AXA..BBB", false, []sparse.Extent{{1, 1}}},
+		{"AAA..BBB", "AAA..BBBB", false, []sparse.Extent{{8, 1}}},
+		{"AAA..BBB", "AAA..BB", false, []sparse.Extent{{7, 1}}},
+		{"AAA..BBB", "AAA", false, []sparse.Extent{{3, 5}}},
+		{"AAA..", "AAA", false, []sparse.Extent{{3, 2}}},
+		{"AAA..BBB", "AAAC.BBB", false, []sparse.Extent{{3, 1}}},
+		{"AAA__BBB", "AAA..BBB", false, []sparse.Extent{{3, 2}}},
+		{"AAA__BBB", "AAA..BBB", true, nil},
+		{"AAA_XBBB", "AAA..BBB", true, []sparse.Extent{{4, 1}}},
+		{"ABCDEFGH", "AxCxxFGx", false, []sparse.Extent{{1, 1}, {3, 2}, {7, 1}}},
+		{"....", "..AA", false, []sparse.Extent{{2, 2}}},
+	} {
+		t.Run(fmt.Sprintf("%s/%s/%v", c.a, c.b, c.zeroHoles), func(t *testing.T) {
+			got, err := sparse.Diff(layout(c.a), layout(c.b), &sparse.DiffOptions{ZeroHoles: c.zeroHoles})
+			if err != nil {
+				t.Fatalf("Diff returned error %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Diff should return %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestPatch(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+	}{
+		{"AAA..BBB", "AXA..BBB"},
+		{"AAA..BBB", "AAA..BBBCC.."},
+		{"AAA..BBB", "AAA"},
+		{"AAA..BBB", "...DD..."},
+		{"", "..AA.."},
+	} {
+		t.Run(c.a+"/"+c.b, func(t *testing.T) {
+			p, err := sparse.MakePatch(layout(c.a), layout(c.b), nil)
+			if err != nil {
+				t.Fatalf("MakePatch returned error %v", err)
+			}
+
+			// Round-trip through the encoded form.
+			var enc bytes.Buffer
+			if _, err := p.WriteTo(&enc); err != nil {
+				t.Fatalf("WriteTo returned error %v", err)
+			}
+			if p, err = sparse.ReadPatch(&enc); err != nil {
+				t.Fatalf("ReadPatch returned error %v", err)
+			}
+
+			target := layout(c.a)
+			if err := p.Apply(target); err != nil {
+				t.Fatalf("Apply returned error %v", err)
+			}
+			// Holes are punched rather than written as zeros, so the
+			// layout should match as well as the content.
+			got, err := sparse.Diff(target, layout(c.b), nil)
+			if err != nil {
+				t.Fatalf("Diff returned error %v", err)
+			}
+			if len(got) > 0 {
+				t.Errorf("Patched target should match %q, differs at %v", c.b, got)
+			}
+		})
+	}
+}
+
+func TestReadPatchInvalid(t *testing.T) {
+	if _, err := sparse.ReadPatch(bytes.NewBufferString("NOPE")); err == nil {
+		t.Errorf("ReadPatch should fail on bad magic")
+	}
+}
@@ -0,0 +1,144 @@
+package sparse
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	// ErrPunchUnsupported is returned when holes cannot be punched in files
+	// on this platform.
+	ErrPunchUnsupported = errors.New("sparse: punching holes is not supported on this platform")
+
+	// ErrModified is returned by DigHoles if the file appears to have been
+	// modified by someone else while it was being scanned.
+	ErrModified = errors.New("sparse: file modified during DigHoles")
+)
+
+// DefaultBlockSize is the block size used by DigHoles when none is given.
+const DefaultBlockSize = 4096
+
+// DigOptions controls DigHoles.
+type DigOptions struct {
+	// BlockSize is the granularity at which holes are punched.  Only
+	// block-aligned runs of whole blocks of zeros are considered.  If zero,
+	// DefaultBlockSize is used.
+	BlockSize int64
+
+	// DryRun reports the bytes that would be reclaimed without modifying
+	// the file.
+	DryRun bool
+}
+
+// DigHoles scans the data in f for blocks consisting entirely of zeros, and
+// punches holes over them in place, leaving the size and content of the file
+// unchanged.  Returns the number of bytes deallocated, or with DryRun, the
+// number of bytes that would be.
+//
+// If the size or modification time of f changes while it is being scanned,
+// DigHoles returns ErrModified without punching any holes.  Each range is
+// checked again immediately before its hole is punched, but callers should
+// still avoid concurrent writes to f.
+func DigHoles(f *os.File, opts *DigOptions) (reclaimed int64, err error) {
+	var o DigOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+
+	before, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	zeros, err := zeroBlocks(f, o.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	after, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		return 0, ErrModified
+	}
+
+	var buf []byte
+	for _, e := range zeros {
+		if !o.DryRun {
+			if buf == nil {
+				buf = make([]byte, diffChunk)
+			}
+			if ok, err := isZero(f, e, buf); err != nil {
+				return reclaimed, err
+			} else if !ok {
+				return reclaimed, ErrModified
+			}
+			if err := punchHole(f, e.Off, e.Len); err != nil {
+				return reclaimed, err
+			}
+		}
+		reclaimed += e.Len
+	}
+	return reclaimed, nil
+}
+
+// zeroBlocks returns the block-aligned extents of zeros found within the data
+// of f.  Holes already in f are not included.
+func zeroBlocks(f *os.File, blockSize int64) (zeros []Extent, err error) {
+	es, err := Extents(NewFile(f))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range es {
+		m := Make(io.NewSectionReader(f, e.Off, e.Len), blockSize)
+		pos := e.Off
+		for {
+			n, err := io.Copy(ioutil.Discard, m)
+			if err != nil {
+				return nil, err
+			}
+			pos += n
+			skip, err := m.Next()
+			if skip > 0 {
+				// Shrink the run of zeros to whole blocks.
+				start := (pos + blockSize - 1) / blockSize * blockSize
+				end := (pos + skip) / blockSize * blockSize
+				if start < end {
+					zeros = appendExtent(zeros, Extent{start, end - start})
+				}
+				pos += skip
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return zeros, nil
+}
+
+// isZero reports whether the range e of f consists entirely of zeros.
+func isZero(f *os.File, e Extent, buf []byte) (bool, error) {
+	for off := e.Off; off < e.End(); {
+		n := e.End() - off
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return false, err
+		}
+		for _, c := range buf[:n] {
+			if c != 0 {
+				return false, nil
+			}
+		}
+		off += n
+	}
+	return true, nil
+}
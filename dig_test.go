@@ -0,0 +1,93 @@
+package sparse_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+// denseFile creates a temporary file from blocks, where each character of
+// blocks is a block of that byte, and '.' is a block of zeros.
+func denseFile(t *testing.T, blocks string) *os.File {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(blocks); i++ {
+		c := blocks[i]
+		if c == '.' {
+			c = 0
+		}
+		f.WriteAt(bytes.Repeat([]byte{c}, blockSize), int64(i*blockSize))
+	}
+	f.Sync()
+	return f
+}
+
+func TestDigHoles(t *testing.T) {
+	f := denseFile(t, "A..B.")
+	defer cleanup(f)
+	before, _ := ioutil.ReadFile(f.Name())
+
+	n, err := sparse.DigHoles(f, &sparse.DigOptions{DryRun: true})
+	if n != 3*blockSize || err != nil {
+		t.Errorf("DigHoles with DryRun should find %d bytes, got %d, %v", 3*blockSize, n, err)
+	}
+	if es, _ := sparse.Extents(sparse.NewFile(f)); len(es) != 1 {
+		t.Errorf("DigHoles with DryRun should not modify the file, extents now %v", es)
+	}
+
+	n, err = sparse.DigHoles(f, nil)
+	if err == sparse.ErrPunchUnsupported {
+		t.Skip(err)
+	}
+	if n != 3*blockSize || err != nil {
+		t.Fatalf("DigHoles should reclaim %d bytes, got %d, %v", 3*blockSize, n, err)
+	}
+	want := []sparse.Extent{{Off: 0, Len: blockSize}, {Off: 3 * blockSize, Len: blockSize}}
+	if es, _ := sparse.Extents(sparse.NewFile(f)); !reflect.DeepEqual(es, want) {
+		t.Errorf("DigHoles should leave extents %v, got %v", want, es)
+	}
+	if after, _ := ioutil.ReadFile(f.Name()); !bytes.Equal(before, after) {
+		t.Errorf("DigHoles should not change the content of the file")
+	}
+
+	if n, err = sparse.DigHoles(f, nil); n != 0 || err != nil {
+		t.Errorf("DigHoles should find nothing more to reclaim, got %d, %v", n, err)
+	}
+}
+
+func TestDigHolesUnaligned(t *testing.T) {
+	f := denseFile(t, "AA")
+	defer cleanup(f)
+	// A run of blockSize zeros that straddles a block boundary.
+	f.WriteAt(make([]byte, blockSize), blockSize/2)
+
+	if n, err := sparse.DigHoles(f, &sparse.DigOptions{DryRun: true}); n != 0 || err != nil {
+		t.Errorf("DigHoles should only consider whole blocks, got %d, %v", n, err)
+	}
+	if n, err := sparse.DigHoles(f, &sparse.DigOptions{BlockSize: blockSize / 2, DryRun: true}); n != blockSize || err != nil {
+		t.Errorf("DigHoles with a smaller BlockSize should find %d bytes, got %d, %v", blockSize, n, err)
+	}
+}
+
+func TestDigHolesShortZeros(t *testing.T) {
+	f := denseFile(t, "")
+	defer cleanup(f)
+	// Runs of zeros shorter than a block, which do not line up with the
+	// reads made while scanning.
+	var data []byte
+	for i := 0; i < 200; i++ {
+		data = append(data, bytes.Repeat([]byte{1}, 3000)...)
+		data = append(data, make([]byte, 3000)...)
+	}
+	f.WriteAt(data, 0)
+
+	if n, err := sparse.DigHoles(f, &sparse.DigOptions{DryRun: true}); n != 0 || err != nil {
+		t.Errorf("DigHoles should find no whole blocks of zeros, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,193 @@
+package sparse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// The encoded form of sparse data is:
+//
+//   magic        "SPRS"
+//   version      uint16
+//   flags        uint16, currently always 0
+//   size         int64, the logical size including any trailing hole
+//   count        uint64, the number of extents
+//   extents      count × {off int64, len int64}
+//   header crc   uint32, CRC-32C of everything above
+//   data         for each extent, len bytes followed by their CRC-32C
+//
+// All integers are big-endian.  Extents are sorted and do not overlap.
+
+var encodeMagic = [4]byte{'S', 'P', 'R', 'S'}
+
+const encodeVersion = 1
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrFormat is returned when decoding data that is not in the expected format.
+	ErrFormat = errors.New("sparse: invalid encoded data")
+	// ErrChecksum is returned when decoding data that fails checksum verification.
+	ErrChecksum = errors.New("sparse: checksum mismatch")
+)
+
+type encodeHeader struct {
+	Magic   [4]byte
+	Version uint16
+	Flags   uint16
+	Size    int64
+	Count   uint64
+}
+
+// Encode writes the extents and data of r to w in a self-describing format
+// that can be read with Decode.  This will move the file position of r.
+func Encode(w io.Writer, r ReadFinder) error {
+	es, err := Extents(r)
+	if err != nil {
+		return err
+	}
+	return encode(w, r.Size(), es, func(p []byte, off int64) error {
+		return readExtent(r, p, off)
+	})
+}
+
+func encode(w io.Writer, size int64, es []Extent, readAt func(p []byte, off int64) error) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	hw := io.MultiWriter(bw, crc)
+
+	binary.Write(hw, binary.BigEndian, encodeHeader{encodeMagic, encodeVersion, 0, size, uint64(len(es))})
+	for _, e := range es {
+		binary.Write(hw, binary.BigEndian, e)
+	}
+	binary.Write(bw, binary.BigEndian, crc.Sum32())
+
+	buf := make([]byte, diffChunk)
+	for _, e := range es {
+		crc.Reset()
+		for off := e.Off; off < e.End(); {
+			n := e.End() - off
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			if err := readAt(buf[:n], off); err != nil {
+				return err
+			}
+			hw.Write(buf[:n])
+			off += n
+		}
+		binary.Write(bw, binary.BigEndian, crc.Sum32())
+	}
+	return bw.Flush()
+}
+
+// Decode reads sparse data previously written by Encode and returns it as a
+// new Buffer.  Each extent is stored as its own segment, so the Buffer will
+// have the same extents and Size as the original.
+func Decode(r io.Reader) (*Buffer, error) {
+	b := &Buffer{}
+	if err := b.decode(r); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Buffer) decode(r io.Reader) error {
+	crc := crc32.New(crcTable)
+	hr := io.TeeReader(r, crc)
+
+	var hdr encodeHeader
+	if err := binary.Read(hr, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	if hdr.Magic != encodeMagic || hdr.Version != encodeVersion || hdr.Flags != 0 || hdr.Size < 0 {
+		return ErrFormat
+	}
+
+	var es []Extent
+	var last int64
+	for i := uint64(0); i < hdr.Count; i++ {
+		var e Extent
+		if err := binary.Read(hr, binary.BigEndian, &e); err != nil {
+			return unexpected(err)
+		}
+		if e.Off < last || e.Len < 0 || e.End() > hdr.Size {
+			return ErrFormat
+		}
+		last = e.End()
+		es = append(es, e)
+	}
+	var sum uint32
+	if err := binary.Read(r, binary.BigEndian, &sum); err != nil {
+		return unexpected(err)
+	}
+	if sum != crc.Sum32() {
+		return ErrChecksum
+	}
+
+	for _, e := range es {
+		crc.Reset()
+		// Avoid trusting e.Len for an allocation before we've seen the data.
+		var data bytes.Buffer
+		if _, err := io.CopyN(&data, hr, e.Len); err != nil {
+			return unexpected(err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &sum); err != nil {
+			return unexpected(err)
+		}
+		if sum != crc.Sum32() {
+			return ErrChecksum
+		}
+		if e.Len > 0 {
+			b.StoreAt(data.Bytes(), e.Off)
+		}
+	}
+	b.Truncate(hdr.Size)
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the format written
+// by Encode.  Unlike Encode, it does not move the file position.
+func (b *Buffer) MarshalBinary() ([]byte, error) {
+	es := b.extents()
+	var out bytes.Buffer
+	err := encode(&out, b.Size(), es, func(p []byte, off int64) error {
+		return b.readAt(p, off)
+	})
+	return out.Bytes(), err
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, replacing the
+// contents of b with data previously produced by MarshalBinary or Encode.
+func (b *Buffer) UnmarshalBinary(data []byte) error {
+	var nb Buffer
+	r := bytes.NewReader(data)
+	if err := nb.decode(r); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return ErrFormat
+	}
+	b.Reset()
+	// The settings of b apply to the decoded data as to data written to it.
+	nb.limit, nb.store, nb.err = b.limit, b.store, b.err
+	nb.compactThreshold, nb.compactAt, nb.compactOpts = b.compactThreshold, b.compactThreshold, b.compactOpts
+	nb.comp, nb.blocks = b.comp, b.blocks
+	*b = nb
+	b.autoCompact()
+	b.dedupCold(0, len(b.es))
+	b.compressCold(0, len(b.es))
+	b.spillCold()
+	return nil
+}
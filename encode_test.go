@@ -0,0 +1,81 @@
+package sparse_test
+
+import (
+	"bytes"
+	"encoding"
+	"io"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*sparse.Buffer)(nil)
+	_ encoding.BinaryUnmarshaler = (*sparse.Buffer)(nil)
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, s := range []string{"", "....", "AAA", "..AAA..BBB", "AAA..BBB....."} {
+		var enc bytes.Buffer
+		if err := sparse.Encode(&enc, layout(s)); err != nil {
+			t.Fatalf("Encode(%q) returned error %v", s, err)
+		}
+		got, err := sparse.Decode(&enc)
+		if err != nil {
+			t.Fatalf("Decode(%q) returned error %v", s, err)
+		}
+		if eq, ofs, _ := sparse.Equal(got, layout(s), &sparse.EqualOptions{Strict: true}); !eq {
+			t.Errorf("Decode(%q) should round-trip, differs at %d", s, ofs)
+		}
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	var sb sparse.Buffer
+	sb.StoreAt([]byte("AAA"), 2)
+	sb.StoreAt([]byte("BBB"), 5)
+	sb.Truncate(20)
+	sb.Seek(3, io.SeekStart)
+
+	data, err := sb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary returned error %v", err)
+	}
+	if pos, _ := sb.Seek(0, io.SeekCurrent); pos != 3 {
+		t.Errorf("MarshalBinary should not move the file position, now at %d", pos)
+	}
+
+	var got sparse.Buffer
+	got.WriteAt([]byte("old"), 100)
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary returned error %v", err)
+	}
+	if got.Size() != 20 {
+		t.Errorf("UnmarshalBinary should preserve Size 20, got %d", got.Size())
+	}
+	if eq, ofs, _ := sparse.Equal(&got, &sb, &sparse.EqualOptions{Strict: true}); !eq {
+		t.Errorf("UnmarshalBinary should round-trip, differs at %d", ofs)
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAA"), 2)
+	data, _ := sb.MarshalBinary()
+
+	for i := range data {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 0x40
+		if _, err := sparse.Decode(bytes.NewReader(bad)); err == nil {
+			t.Errorf("Decode should fail with byte %d corrupted", i)
+		}
+	}
+	for i := range data {
+		if _, err := sparse.Decode(bytes.NewReader(data[:i])); err == nil {
+			t.Errorf("Decode should fail when truncated to %d bytes", i)
+		}
+	}
+	if err := sb.UnmarshalBinary(append(data, 0)); err != sparse.ErrFormat {
+		t.Errorf("UnmarshalBinary should reject trailing data, got %v", err)
+	}
+}
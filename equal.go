@@ -0,0 +1,97 @@
+package sparse
+
+import (
+	"errors"
+)
+
+// EqualOptions controls how Equal compares sparse sources.
+type EqualOptions struct {
+	// Strict requires both sources to also have identical extents, as
+	// reported by Extents with adjacent extents coalesced, so that data stored
+	// in pieces matches the same data stored whole.  By default only the
+	// logical content is compared, and holes are equal to explicit zeros.
+	Strict bool
+}
+
+var errStopDiff = errors.New("stop diff")
+
+// Equal reports whether a and b hold the same content and have the same size.
+// Regions that are holes in both are skipped without reading.  If they are not
+// equal, ofs is the first offset at which they differ.  This will move the
+// file positions of both a and b.
+func Equal(a, b ReadFinder, opts *EqualOptions) (eq bool, ofs int64, err error) {
+	strict := opts != nil && opts.Strict
+	ofs = -1
+	if strict {
+		if ofs, err = firstLayoutDiff(a, b); err != nil {
+			return false, 0, err
+		}
+		if ofs == 0 {
+			return false, 0, nil
+		}
+	}
+	// Content differences at or after a layout difference cannot move ofs, so
+	// only the range before it is compared.
+	err = diff(a, b, &DiffOptions{ZeroHoles: !strict}, ofs, func(off int64, _ []byte, _ int64) error {
+		if ofs < 0 || off < ofs {
+			ofs = off
+		}
+		return errStopDiff
+	})
+	if err == errStopDiff {
+		err = nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	if ofs < 0 {
+		return true, 0, nil
+	}
+	return false, ofs, nil
+}
+
+// firstLayoutDiff returns the first offset at which the coalesced extents of
+// a and b differ, or -1 if they are the same.
+func firstLayoutDiff(a, b Finder) (int64, error) {
+	ea, err := coalescedExtents(a)
+	if err != nil {
+		return 0, err
+	}
+	eb, err := coalescedExtents(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(ea) || i < len(eb); i++ {
+		switch {
+		case i == len(ea):
+			return eb[i].Off, nil
+		case i == len(eb):
+			return ea[i].Off, nil
+		case ea[i].Off != eb[i].Off:
+			if ea[i].Off < eb[i].Off {
+				return ea[i].Off, nil
+			}
+			return eb[i].Off, nil
+		case ea[i].Len != eb[i].Len:
+			if ea[i].End() < eb[i].End() {
+				return ea[i].End(), nil
+			}
+			return eb[i].End(), nil
+		}
+	}
+	return -1, nil
+}
+
+// coalescedExtents returns the extents of f as Extents does, with adjacent
+// extents merged into one.
+func coalescedExtents(f Finder) ([]Extent, error) {
+	es, err := Extents(f)
+	if err != nil {
+		return nil, err
+	}
+	var out []Extent
+	for _, e := range es {
+		out = appendExtent(out, e)
+	}
+	return out, nil
+}
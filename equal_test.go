@@ -0,0 +1,90 @@
+package sparse_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func TestEqual(t *testing.T) {
+	for _, c := range []struct {
+		a, b   string
+		strict bool
+		eq     bool
+		ofs    int64
+	}{
+		{"", "", false, true, 0},
+		{"AAA..BBB", "AAA..BBB", false, true, 0},
+		{"AAA..BBB", "AAA..BBB", true, true, 0},
+		{"AAA..BBB", "AAA..BXB", false, false, 6},
+		{"AAA..BBB", "AAA..BBB.", false, false, 8},
+		{"AAA__BBB", "AAA..BBB", false, true, 0},
+		{"AAA__BBB", "AAA..BBB", true, false, 3},
+		{"AAA._BBB", "AAA..BBB", true, false, 4},
+		{"........", "......_.", false, true, 0},
+		{"........", "......_.", true, false, 6},
+	} {
+		t.Run(fmt.Sprintf("%s/%s/%v", c.a, c.b, c.strict), func(t *testing.T) {
+			eq, ofs, err := sparse.Equal(layout(c.a), layout(c.b), &sparse.EqualOptions{Strict: c.strict})
+			if err != nil {
+				t.Fatalf("Equal returned error %v", err)
+			}
+			if eq != c.eq || ofs != c.ofs {
+				t.Errorf("Equal should return %v, %d, got %v, %d", c.eq, c.ofs, eq, ofs)
+			}
+		})
+	}
+}
+
+func TestEqualStrictAdjacent(t *testing.T) {
+	// WriteAt merges adjacent writes into one extent while StoreAt does not,
+	// but Strict compares the layout with adjacent extents coalesced.
+	var a, b sparse.Buffer
+	a.WriteAt([]byte("AAA"), 0)
+	a.WriteAt([]byte("BBB"), 3)
+	b.StoreAt([]byte("AAA"), 0)
+	b.StoreAt([]byte("BBB"), 3)
+
+	if eq, ofs, _ := sparse.Equal(&a, &b, nil); !eq {
+		t.Errorf("Equal should consider adjacent segments logically equal, got false at %d", ofs)
+	}
+	if eq, ofs, err := sparse.Equal(&a, &b, &sparse.EqualOptions{Strict: true}); !eq || err != nil {
+		t.Errorf("Equal with Strict should consider adjacent segments equal, got false at %d (err=%v)", ofs, err)
+	}
+	b.StoreAt([]byte("CCC"), 7)
+	a.WriteAt([]byte("CCC"), 6)
+	if eq, ofs, _ := sparse.Equal(&a, &b, &sparse.EqualOptions{Strict: true}); eq || ofs != 6 {
+		t.Errorf("Equal with Strict should differ at 6, got %v, %d", eq, ofs)
+	}
+}
+
+// countingBuffer counts the bytes read from a Buffer.
+type countingBuffer struct {
+	*sparse.Buffer
+	n int
+}
+
+func (c *countingBuffer) Read(p []byte) (int, error) {
+	n, err := c.Buffer.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestEqualStrictStopsAtLayout(t *testing.T) {
+	// The layouts differ at 3, so the content after it need not be read.
+	big := make([]byte, 1<<20)
+	var a, b sparse.Buffer
+	a.WriteAt([]byte("AAA"), 0)
+	a.WriteAt(big, 3)
+	b.WriteAt([]byte("AAA"), 0)
+	b.Truncate(a.Size())
+	ca, cb := &countingBuffer{Buffer: &a}, &countingBuffer{Buffer: &b}
+
+	if eq, ofs, err := sparse.Equal(ca, cb, &sparse.EqualOptions{Strict: true}); eq || ofs != 3 || err != nil {
+		t.Errorf("Equal with Strict should differ at 3, got %v, %d, %v", eq, ofs, err)
+	}
+	if ca.n > 3 || cb.n > 3 {
+		t.Errorf("Equal with Strict should read only the 3 bytes before the layout differs, read %d and %d", ca.n, cb.n)
+	}
+}
@@ -0,0 +1,10 @@
+package sparse
+
+import "os"
+
+// DisableMmapPunchHole makes MmapBuffer.PunchHole behave as if punching holes
+// were not supported, until the returned function is called.
+func DisableMmapPunchHole() (restore func()) {
+	mmapPunchHole = func(*os.File, int64, int64) error { return ErrPunchUnsupported }
+	return func() { mmapPunchHole = punchHole }
+}
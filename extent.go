@@ -0,0 +1,107 @@
+package sparse
+
+import (
+	"io"
+)
+
+// Extent identifies a contiguous range of Len bytes starting at Off.
+type Extent struct {
+	Off int64 `json:"offset"`
+	Len int64 `json:"length"`
+}
+
+// End returns the offset after this extent, or e.Off+e.Len.
+func (e Extent) End() int64 { return e.Off + e.Len }
+
+// Extents returns the extents of data in f, in order, as reported by Find.
+// Zero-length segments are omitted.  This will move the file position of f.
+func Extents(f Finder) (es []Extent, err error) {
+	var ofs int64
+	for {
+		var n, size int64
+		if n, size, err = f.Find(ofs); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if n+size <= ofs {
+			// Zero-length segment at ofs, or a misbehaving Finder.  Make sure we
+			// still make progress.
+			ofs++
+			continue
+		}
+		if n < ofs {
+			// We landed in the middle of a segment we've already recorded.
+			n, size = ofs, n+size-ofs
+		}
+		if size > 0 {
+			es = append(es, Extent{n, size})
+		}
+		ofs = n + size
+	}
+}
+
+// readExtent reads len(p) bytes from r at off, which is expected to lie
+// entirely within data.
+func readExtent(r ReadFinder, p []byte, off int64) error {
+	if _, _, err := r.Find(off); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	_, err := io.ReadFull(r, p)
+	return err
+}
+
+// walkRegions calls fn for each consecutive range of offsets up to the larger
+// of a.Size() and b.Size() over which neither a nor b transitions between data
+// and hole.
+func walkRegions(a, b Finder, fn func(off, end int64, aData, bData bool) error) error {
+	ea, err := Extents(a)
+	if err != nil {
+		return err
+	}
+	eb, err := Extents(b)
+	if err != nil {
+		return err
+	}
+	size := a.Size()
+	if s := b.Size(); s > size {
+		size = s
+	}
+
+	// next returns whether pos lies within es[*i], and the offset at which
+	// that stops being true.
+	next := func(es []Extent, i *int, pos int64) (bool, int64) {
+		for *i < len(es) && es[*i].End() <= pos {
+			*i++
+		}
+		if *i == len(es) {
+			return false, size
+		}
+		if e := es[*i]; e.Off <= pos {
+			return true, e.End()
+		}
+		return false, es[*i].Off
+	}
+
+	var i, j int
+	for pos := int64(0); pos < size; {
+		aData, aEnd := next(ea, &i, pos)
+		bData, bEnd := next(eb, &j, pos)
+		end := aEnd
+		if bEnd < end {
+			end = bEnd
+		}
+		if end > size {
+			end = size
+		}
+		if err := fn(pos, end, aData, bData); err != nil {
+			return err
+		}
+		pos = end
+	}
+	return nil
+}
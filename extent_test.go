@@ -0,0 +1,28 @@
+package sparse_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func TestExtents(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAA"), 2)
+	sb.StoreAt([]byte("BBB"), 5)
+	sb.WriteAt([]byte("CCC"), 10)
+	sb.Truncate(20)
+
+	got, err := sparse.Extents(&sb)
+	if err != nil {
+		t.Fatalf("Extents returned error %v", err)
+	}
+	want := []sparse.Extent{{2, 3}, {5, 3}, {10, 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Extents should return %v, got %v", want, got)
+	}
+	if got[0].End() != 5 {
+		t.Errorf("End should return 5, got %d", got[0].End())
+	}
+}
@@ -0,0 +1,131 @@
+package sparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// ExtentMap describes the layout of sparse data, suitable for rendering as
+// JSON with encoding/json or as text with String or WriteText.
+type ExtentMap struct {
+	Size      int64    `json:"size"`
+	DataBytes int64    `json:"dataBytes"`
+	HoleBytes int64    `json:"holeBytes"`
+	Extents   []Extent `json:"extents"`
+}
+
+// MapOf returns an ExtentMap describing the data in f.  This will move the
+// file position of f.
+func MapOf(f Finder) (*ExtentMap, error) {
+	es, err := Extents(f)
+	if err != nil {
+		return nil, err
+	}
+	return newExtentMap(f.Size(), es), nil
+}
+
+func newExtentMap(size int64, es []Extent) *ExtentMap {
+	m := &ExtentMap{Size: size, Extents: es}
+	if m.Extents == nil {
+		// Render as [] rather than null.
+		m.Extents = []Extent{}
+	}
+	for _, e := range es {
+		m.DataBytes += e.Len
+	}
+	m.HoleBytes = size - m.DataBytes
+	return m
+}
+
+// Map returns an ExtentMap describing the data in b.  Unlike MapOf, this does
+// not move the file position.
+func (b *Buffer) Map() *ExtentMap {
+	es := b.extents()
+	return newExtentMap(b.Size(), es)
+}
+
+// Bar renders the map as a line of at most width characters between '|'
+// delimiters, in the style of:
+//
+//	|....AAAAA..B..CCCCC|
+//
+// Each extent is drawn with a letter and holes with '.'.  If Size exceeds
+// width, each character represents Size/width bytes, and is drawn as the
+// first extent found within that range.  A width of zero or less renders an
+// empty bar.
+func (m *ExtentMap) Bar(width int) string {
+	cells := m.Size
+	if cells > int64(width) {
+		cells = int64(width)
+	}
+	if cells <= 0 {
+		return "||"
+	}
+	bar := bytes.Repeat([]byte{'.'}, int(cells))
+	for i, e := range m.Extents {
+		if e.Len <= 0 || e.Off >= m.Size || e.End() <= 0 {
+			continue
+		}
+		// Cells first:last cover the extent, rounding outward.
+		first, _ := scale(e.Off, cells, m.Size)
+		last, rem := scale(e.End(), cells, m.Size)
+		if rem == 0 {
+			last--
+		}
+		for c := first; c <= last && c < cells; c++ {
+			if bar[c] == '.' {
+				bar[c] = byte('A' + i%26)
+			}
+		}
+	}
+	return "|" + string(bar) + "|"
+}
+
+// scale returns off*cells/size and its remainder, without overflowing.  off is
+// clamped to 0:size, and cells must be at most size.
+func scale(off, cells, size int64) (q int64, rem uint64) {
+	if off < 0 {
+		off = 0
+	} else if off > size {
+		off = size
+	}
+	hi, lo := bits.Mul64(uint64(off), uint64(cells))
+	uq, rem := bits.Div64(hi, lo, uint64(size))
+	return int64(uq), rem
+}
+
+// String renders the map as text, as with WriteText using a bar width of 64.
+func (m *ExtentMap) String() string {
+	var buf bytes.Buffer
+	m.WriteText(&buf, 64)
+	return buf.String()
+}
+
+// WriteText writes a human-readable table of the data and holes in the map
+// to w, followed by totals and an occupancy bar of the given width.
+func (m *ExtentMap) WriteText(w io.Writer, width int) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%12s %12s %12s\n", "offset", "end", "length")
+	var pos int64
+	row := func(off, end int64, kind string) {
+		fmt.Fprintf(&buf, "%12d %12d %12d  %s\n", off, end, end-off, kind)
+	}
+	for _, e := range m.Extents {
+		if pos < e.Off {
+			row(pos, e.Off, "hole")
+		}
+		row(e.Off, e.End(), "data")
+		pos = e.End()
+	}
+	if pos < m.Size {
+		row(pos, m.Size, "hole")
+	}
+	fmt.Fprintf(&buf, "size %d, data %d in %d extents, holes %d\n", m.Size, m.DataBytes, len(m.Extents), m.HoleBytes)
+	if width > 0 {
+		fmt.Fprintf(&buf, "%s\n", m.Bar(width))
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
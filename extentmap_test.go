@@ -0,0 +1,81 @@
+package sparse_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func TestExtentMapJSON(t *testing.T) {
+	m, err := sparse.MapOf(layout("..AAA..B..."))
+	if err != nil {
+		t.Fatalf("MapOf returned error %v", err)
+	}
+	got, _ := json.Marshal(m)
+	want := `{"size":11,"dataBytes":4,"holeBytes":7,"extents":[{"offset":2,"length":3},{"offset":7,"length":1}]}`
+	if string(got) != want {
+		t.Errorf("JSON should be %s, got %s", want, got)
+	}
+
+	var sb sparse.Buffer
+	got, _ = json.Marshal(sb.Map())
+	want = `{"size":0,"dataBytes":0,"holeBytes":0,"extents":[]}`
+	if string(got) != want {
+		t.Errorf("JSON of empty Buffer should be %s, got %s", want, got)
+	}
+}
+
+func TestExtentMapBar(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAAAA"), 4)
+	sb.WriteAt([]byte("B"), 11)
+	sb.WriteAt([]byte("CCCCC"), 14)
+	for _, c := range []struct {
+		width int
+		want  string
+	}{
+		{80, "|....AAAAA..B..CCCCC|"},
+		{19, "|....AAAAA..B..CCCCC|"},
+		{10, "|..AAABBCCC|"},
+		{1, "|A|"},
+		{0, "||"},
+		{-1, "||"},
+	} {
+		if got := sb.Map().Bar(c.width); got != c.want {
+			t.Errorf("Bar(%d) should be %s, got %s", c.width, c.want, got)
+		}
+	}
+
+	// Offsets near the largest size must not overflow when scaled.
+	m := &sparse.ExtentMap{Size: math.MaxInt64, Extents: []sparse.Extent{
+		{Off: 0, Len: 1 << 60},
+		{Off: math.MaxInt64 - 10, Len: 10},
+	}}
+	if got, want := m.Bar(4), "|A..B|"; got != want {
+		t.Errorf("Bar(4) of a huge map should be %s, got %s", want, got)
+	}
+}
+
+func ExampleExtentMap() {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAAAA"), 4)
+	sb.WriteAt([]byte("B"), 11)
+	sb.WriteAt([]byte("CCCCC"), 14)
+	sb.Truncate(24)
+	fmt.Print(sb.Map())
+
+	// Output:
+	//       offset          end       length
+	//            0            4            4  hole
+	//            4            9            5  data
+	//            9           11            2  hole
+	//           11           12            1  data
+	//           12           14            2  hole
+	//           14           19            5  data
+	//           19           24            5  hole
+	// size 24, data 11 in 3 extents, holes 13
+	// |....AAAAA..B..CCCCC.....|
+}
@@ -0,0 +1,219 @@
+package sparse
+
+import (
+	"io"
+	"sort"
+)
+
+// ExtentSet is a set of offsets, held as a sorted list of non-overlapping,
+// non-adjacent extents.  A zero-value ExtentSet is empty and ready to use.
+type ExtentSet struct {
+	es []Extent
+}
+
+// NewExtentSet returns a set containing the offsets covered by es, which
+// may be given in any order and may overlap.
+func NewExtentSet(es ...Extent) *ExtentSet {
+	s := &ExtentSet{}
+	for _, e := range es {
+		s.Add(e)
+	}
+	return s
+}
+
+// Extents returns a copy of the extents in s, in order.
+func (s *ExtentSet) Extents() []Extent {
+	if len(s.es) == 0 {
+		return nil
+	}
+	return append([]Extent(nil), s.es...)
+}
+
+// Total returns the number of offsets in s.
+func (s *ExtentSet) Total() (n int64) {
+	for _, e := range s.es {
+		n += e.Len
+	}
+	return
+}
+
+// search returns the index of the first extent in s ending at or after off.
+func (s *ExtentSet) search(off int64) int {
+	return sort.Search(len(s.es), func(i int) bool { return s.es[i].End() >= off })
+}
+
+// Add adds the offsets covered by e to s.
+func (s *ExtentSet) Add(e Extent) {
+	if e.Len <= 0 {
+		return
+	}
+	// Extents i:j overlap or are adjacent to e, and will be replaced by it.
+	i := s.search(e.Off)
+	j := i
+	for j < len(s.es) && s.es[j].Off <= e.End() {
+		j++
+	}
+	if i < j {
+		if s.es[i].Off < e.Off {
+			e.Len += e.Off - s.es[i].Off
+			e.Off = s.es[i].Off
+		}
+		if end := s.es[j-1].End(); end > e.End() {
+			e.Len = end - e.Off
+		}
+	}
+	s.replace(i, j, e)
+}
+
+// Remove removes the offsets covered by e from s.
+func (s *ExtentSet) Remove(e Extent) {
+	if e.Len <= 0 {
+		return
+	}
+	// Extents i:j overlap e, and will be replaced by whatever remains of them.
+	i := s.search(e.Off + 1)
+	j := i
+	for j < len(s.es) && s.es[j].Off < e.End() {
+		j++
+	}
+	if i == j {
+		return
+	}
+	var keep []Extent
+	if l := s.es[i]; l.Off < e.Off {
+		keep = append(keep, Extent{l.Off, e.Off - l.Off})
+	}
+	if r := s.es[j-1]; r.End() > e.End() {
+		keep = append(keep, Extent{e.End(), r.End() - e.End()})
+	}
+	s.replace(i, j, keep...)
+}
+
+// replace replaces s.es[i:j] with es.
+func (s *ExtentSet) replace(i, j int, es ...Extent) {
+	tail := len(s.es) - j
+	if d := len(es) - (j - i); d > 0 {
+		s.es = append(s.es, es[:d]...)
+	}
+	copy(s.es[i+len(es):], s.es[j:j+tail])
+	copy(s.es[i:], es)
+	s.es = s.es[:i+len(es)+tail]
+}
+
+// Contains reports whether off is in s.
+func (s *ExtentSet) Contains(off int64) bool {
+	i := s.search(off + 1)
+	return i < len(s.es) && s.es[i].Off <= off
+}
+
+// appendExtent appends e to es, coalescing it with the last extent if they
+// are adjacent.  e must not lie before the end of the last extent.
+func appendExtent(es []Extent, e Extent) []Extent {
+	if e.Len <= 0 {
+		return es
+	}
+	if n := len(es); n > 0 && es[n-1].End() == e.Off {
+		es[n-1].Len += e.Len
+		return es
+	}
+	return append(es, e)
+}
+
+// Union returns a new set containing the offsets in either s or o.
+func (s *ExtentSet) Union(o *ExtentSet) *ExtentSet {
+	var es []Extent
+	a, b := s.es, o.es
+	for len(a) > 0 || len(b) > 0 {
+		var e Extent
+		if len(b) == 0 || (len(a) > 0 && a[0].Off <= b[0].Off) {
+			e, a = a[0], a[1:]
+		} else {
+			e, b = b[0], b[1:]
+		}
+		if n := len(es); n > 0 && es[n-1].End() >= e.Off {
+			if e.End() > es[n-1].End() {
+				es[n-1].Len = e.End() - es[n-1].Off
+			}
+			continue
+		}
+		es = append(es, e)
+	}
+	return &ExtentSet{es}
+}
+
+// Intersect returns a new set containing the offsets in both s and o.
+func (s *ExtentSet) Intersect(o *ExtentSet) *ExtentSet {
+	var es []Extent
+	a, b := s.es, o.es
+	for len(a) > 0 && len(b) > 0 {
+		off, end := a[0].Off, a[0].End()
+		if b[0].Off > off {
+			off = b[0].Off
+		}
+		if b[0].End() < end {
+			end = b[0].End()
+		}
+		es = appendExtent(es, Extent{off, end - off})
+		if a[0].End() < b[0].End() {
+			a = a[1:]
+		} else {
+			b = b[1:]
+		}
+	}
+	return &ExtentSet{es}
+}
+
+// Subtract returns a new set containing the offsets in s but not in o.
+func (s *ExtentSet) Subtract(o *ExtentSet) *ExtentSet {
+	var es []Extent
+	b := o.es
+	for _, e := range s.es {
+		for len(b) > 0 && b[0].End() <= e.Off {
+			b = b[1:]
+		}
+		for i := 0; i < len(b) && b[i].Off < e.End(); i++ {
+			es = appendExtent(es, Extent{e.Off, b[i].Off - e.Off})
+			if b[i].End() >= e.End() {
+				e.Len = 0
+				break
+			}
+			e = Extent{b[i].End(), e.End() - b[i].End()}
+		}
+		es = appendExtent(es, e)
+	}
+	return &ExtentSet{es}
+}
+
+// Complement returns a new set containing the offsets in 0:size that are
+// not in s.
+func (s *ExtentSet) Complement(size int64) *ExtentSet {
+	return NewExtentSet(Extent{0, size}).Subtract(s)
+}
+
+// Finder returns a view of s as a Finder, where the offsets in s are data
+// and everything else is a hole.  The Finder's Size is size, or the end of
+// the last extent in s if that is larger.  Changes to s are visible through
+// the Finder.
+func (s *ExtentSet) Finder(size int64) Finder {
+	return extentSetFinder{s, size}
+}
+
+type extentSetFinder struct {
+	s    *ExtentSet
+	size int64
+}
+
+func (f extentSetFinder) Find(ofs int64) (int64, int64, error) {
+	i := f.s.search(ofs + 1)
+	if i == len(f.s.es) {
+		return 0, 0, io.EOF
+	}
+	return f.s.es[i].Off, f.s.es[i].Len, nil
+}
+
+func (f extentSetFinder) Size() int64 {
+	if n := len(f.s.es); n > 0 && f.s.es[n-1].End() > f.size {
+		return f.s.es[n-1].End()
+	}
+	return f.size
+}
@@ -0,0 +1,160 @@
+package sparse_test
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+// bitModel is a trivially correct model of an ExtentSet.
+type bitModel []bool
+
+func (m bitModel) set(e sparse.Extent, v bool) {
+	for i := e.Off; i < e.End(); i++ {
+		m[i] = v
+	}
+}
+
+func (m bitModel) extents() (es []sparse.Extent) {
+	for i := 0; i < len(m); i++ {
+		if !m[i] {
+			continue
+		}
+		j := i
+		for j < len(m) && m[j] {
+			j++
+		}
+		es = append(es, sparse.Extent{Off: int64(i), Len: int64(j - i)})
+		i = j
+	}
+	return
+}
+
+const modelSize = 64
+
+func randomExtent(r *rand.Rand) sparse.Extent {
+	off := r.Int63n(modelSize)
+	return sparse.Extent{Off: off, Len: r.Int63n(modelSize - off + 1)}
+}
+
+func randomSet(r *rand.Rand) (*sparse.ExtentSet, bitModel) {
+	s := &sparse.ExtentSet{}
+	m := make(bitModel, modelSize)
+	for i := r.Intn(6); i > 0; i-- {
+		e := randomExtent(r)
+		if r.Intn(3) == 0 {
+			s.Remove(e)
+			m.set(e, false)
+		} else {
+			s.Add(e)
+			m.set(e, true)
+		}
+	}
+	return s, m
+}
+
+// checkSetOps checks a and b, and the results of the set operations on them,
+// against their models ma and mb.
+func checkSetOps(t *testing.T, a, b *sparse.ExtentSet, ma, mb bitModel) {
+	t.Helper()
+	if got, want := a.Extents(), ma.extents(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Add/Remove should produce %v, got %v", want, got)
+	}
+
+	union := make(bitModel, modelSize)
+	inter := make(bitModel, modelSize)
+	sub := make(bitModel, modelSize)
+	comp := make(bitModel, modelSize)
+	for j := range ma {
+		union[j] = ma[j] || mb[j]
+		inter[j] = ma[j] && mb[j]
+		sub[j] = ma[j] && !mb[j]
+		comp[j] = !ma[j]
+		if a.Contains(int64(j)) != ma[j] {
+			t.Fatalf("%v.Contains(%d) should be %v", a.Extents(), j, ma[j])
+		}
+	}
+	for _, c := range []struct {
+		op   string
+		got  *sparse.ExtentSet
+		want bitModel
+	}{
+		{"Union", a.Union(b), union},
+		{"Intersect", a.Intersect(b), inter},
+		{"Subtract", a.Subtract(b), sub},
+		{"Complement", a.Complement(modelSize), comp},
+	} {
+		if got, want := c.got.Extents(), c.want.extents(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%v %s %v should be %v, got %v", a.Extents(), c.op, b.Extents(), want, got)
+		}
+	}
+}
+
+func TestExtentSetRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		a, ma := randomSet(r)
+		b, mb := randomSet(r)
+		checkSetOps(t, a, b, ma, mb)
+	}
+}
+
+// FuzzExtentSet builds two sets from operations decoded from its input, and
+// checks the set operations on them against bitModels.  Each operation takes
+// three bytes: the operation, an offset and a length.  The low bit of the
+// operation picks the set, and the next bit whether to Add or Remove.
+func FuzzExtentSet(f *testing.F) {
+	f.Add([]byte{0, 2, 5, 1, 4, 8, 0, 20, 3, 3, 21, 1})
+	f.Add([]byte{0, 0, 64, 3, 10, 10, 1, 5, 30, 2, 40, 0})
+	f.Add([]byte{1, 63, 1, 0, 0, 1, 0, 1, 1, 2, 1, 0})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		sets := [2]*sparse.ExtentSet{{}, {}}
+		models := [2]bitModel{make(bitModel, modelSize), make(bitModel, modelSize)}
+		for i := 0; i+2 < len(ops); i += 3 {
+			off := int64(ops[i+1]) % modelSize
+			e := sparse.Extent{Off: off, Len: int64(ops[i+2]) % (modelSize - off + 1)}
+			s, m := sets[ops[i]&1], models[ops[i]&1]
+			if ops[i]&2 != 0 {
+				s.Remove(e)
+				m.set(e, false)
+			} else {
+				s.Add(e)
+				m.set(e, true)
+			}
+		}
+		checkSetOps(t, sets[0], sets[1], models[0], models[1])
+		checkSetOps(t, sets[1], sets[0], models[1], models[0])
+	})
+}
+
+func TestExtentSetFinder(t *testing.T) {
+	s := sparse.NewExtentSet(sparse.Extent{Off: 2, Len: 3}, sparse.Extent{Off: 7, Len: 3})
+	f := s.Finder(20)
+	if f.Size() != 20 {
+		t.Errorf("Finder should have Size 20, got %d", f.Size())
+	}
+	got, err := sparse.Extents(f)
+	if err != nil || !reflect.DeepEqual(got, s.Extents()) {
+		t.Errorf("Extents of Finder should be %v, got %v (err=%v)", s.Extents(), got, err)
+	}
+	if ofs, size, err := f.Find(3); ofs != 2 || size != 3 || err != nil {
+		t.Errorf("Find(3) should return 2, 3, nil, got %d, %d, %v", ofs, size, err)
+	}
+	if ofs, size, err := f.Find(5); ofs != 7 || size != 3 || err != nil {
+		t.Errorf("Find(5) should return 7, 3, nil, got %d, %d, %v", ofs, size, err)
+	}
+}
+
+func TestBufferExtentSet(t *testing.T) {
+	var sb sparse.Buffer
+	sb.StoreAt([]byte("AAA"), 2)
+	sb.StoreAt([]byte("BBB"), 5)
+	sb.WriteAt([]byte("CCC"), 10)
+
+	want := []sparse.Extent{{Off: 2, Len: 6}, {Off: 10, Len: 3}}
+	if got := sb.ExtentSet().Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtentSet should coalesce to %v, got %v", want, got)
+	}
+}
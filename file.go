@@ -0,0 +1,131 @@
+package sparse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// File implements Reader and ReadFinder for an *os.File, using SeekData and
+// SeekHole to locate data on operating systems and file systems that support
+// them.  Where they are not supported, the entire file is treated as a single
+// segment of data.  File maintains its own file position and does not depend
+// on or preserve the file position of the underlying *os.File.
+//
+// The granularity of data segments is determined by the file system, and is
+// typically a multiple of its block size.
+type File struct {
+	f       *os.File
+	filePos int64
+	segEnd  int64 // end of the data segment containing filePos, if > filePos
+	noSeek  bool  // SeekData and SeekHole are not supported
+}
+
+// NewFile returns a File reading sparse data from f.
+func NewFile(f *os.File) *File {
+	return &File{f: f}
+}
+
+// Size returns the current size of the file, or 0 if it cannot be determined.
+func (f *File) Size() int64 {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// seekData returns the offset of the next data at or after ofs, and the offset
+// of the hole following it.  Returns io.EOF if there is no data at or after
+// ofs.
+func (f *File) seekData(ofs int64) (data, hole int64, err error) {
+	if !f.noSeek {
+		data, err = f.f.Seek(ofs, SeekData)
+		if err == nil {
+			hole, err = f.f.Seek(data, SeekHole)
+		}
+		if errors.Is(err, syscall.ENXIO) {
+			return 0, 0, io.EOF
+		}
+		if errors.Is(err, syscall.EINVAL) && ofs >= 0 {
+			f.noSeek = true
+		} else {
+			return
+		}
+	}
+	size := f.Size()
+	if ofs >= size {
+		return 0, 0, io.EOF
+	}
+	return ofs, size, nil
+}
+
+// Find moves the file position to the data at or after ofs.  Since file
+// systems do not report where a segment of data begins, if ofs lies within
+// data, readerOfs will be ofs.  Returns io.EOF if there is no data at or after
+// ofs.
+func (f *File) Find(ofs int64) (readerOfs, size int64, err error) {
+	data, hole, err := f.seekData(ofs)
+	if err != nil {
+		return 0, 0, err
+	}
+	f.filePos, f.segEnd = data, hole
+	return data, hole - data, nil
+}
+
+// Read reads up to len(p) bytes of data at the current file position.  If
+// the file position lies within a hole, returns io.EOF without reading any
+// bytes.
+func (f *File) Read(p []byte) (n int, err error) {
+	if f.filePos >= f.segEnd {
+		data, hole, err := f.seekData(f.filePos)
+		if err != nil {
+			return 0, err
+		}
+		if data != f.filePos {
+			return 0, io.EOF
+		}
+		f.segEnd = hole
+	}
+	if max := f.segEnd - f.filePos; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err = f.f.ReadAt(p, f.filePos)
+	f.filePos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+// Next advances to the next segment of data after the current file position.
+// If there is no further data, advances to the end of the file.  Returns
+// io.EOF if the file position is already at or beyond the end of the file.
+func (f *File) Next() (skip int64, err error) {
+	start := f.filePos
+	ofs := start
+	if f.filePos < f.segEnd {
+		ofs = f.segEnd
+	} else if data, hole, err := f.seekData(start); err == nil && data == start {
+		ofs = hole
+	}
+	if _, _, err = f.Find(ofs); err != nil {
+		size := f.Size()
+		if start >= size {
+			return 0, io.EOF
+		}
+		f.filePos, f.segEnd = size, size
+		return size - start, nil
+	}
+	return f.filePos - start, nil
+}
+
+// Seek sets the file position used by Read, as with Buffer.Seek.
+func (f *File) Seek(ofs int64, whence int) (int64, error) {
+	pos, err := resolveSeek(ofs, whence, f.filePos, f.Size(), f)
+	if err == nil {
+		f.filePos, f.segEnd = pos, 0
+	}
+	return pos, err
+}
@@ -0,0 +1,179 @@
+package sparse_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsetest"
+)
+
+var (
+	_ sparse.Reader     = (*sparse.File)(nil)
+	_ sparse.ReadFinder = (*sparse.File)(nil)
+	_ io.Seeker         = (*sparse.File)(nil)
+)
+
+const blockSize = 4096
+
+func cleanup(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// sparseFile creates a temporary file with a block of A at 0, a block of B at
+// 2*blockSize and a size of 4*blockSize.  Skips the test if the file system
+// doesn't appear to support holes.  Callers should clean up the file with
+// cleanup.
+func sparseFile(t *testing.T) *os.File {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(bytes.Repeat([]byte{'A'}, blockSize), 0)
+	f.WriteAt(bytes.Repeat([]byte{'B'}, blockSize), 2*blockSize)
+	f.Truncate(4 * blockSize)
+
+	if es, _ := sparse.Extents(sparse.NewFile(f)); len(es) == 1 {
+		cleanup(f)
+		t.Skip("file system does not support SeekData and SeekHole")
+	}
+	return f
+}
+
+// fileOf returns a File holding the layout of m.  File systems only hold holes
+// of whole blocks, so the test is skipped if the file cannot hold the layout
+// exactly.
+func fileOf(t *testing.T, m *sparsetest.Model) *sparse.File {
+	m.Coalesce()
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cleanup(f) })
+	var want []sparse.Extent
+	for _, s := range m.Segments() {
+		f.WriteAt(s.Data, s.Off)
+		want = append(want, sparse.Extent{Off: s.Off, Len: int64(len(s.Data))})
+	}
+	f.Truncate(m.Size())
+
+	sf := sparse.NewFile(f)
+	if es, err := sparse.Extents(sf); err != nil || !reflect.DeepEqual(es, want) {
+		t.Skipf("file system cannot hold extents %v, got %v, %v", want, es, err)
+	}
+	sf.Seek(0, io.SeekStart)
+	return sf
+}
+
+func TestFileReaderConformance(t *testing.T) {
+	sparsetest.TestReader(t, func(t *testing.T, m *sparsetest.Model) sparse.Reader {
+		return fileOf(t, m)
+	})
+}
+
+func TestFileReadFinderConformance(t *testing.T) {
+	sparsetest.TestReadFinder(t, func(t *testing.T, m *sparsetest.Model) sparse.ReadFinder {
+		return fileOf(t, m)
+	})
+}
+
+func TestFileExtents(t *testing.T) {
+	f := sparseFile(t)
+	defer cleanup(f)
+	sf := sparse.NewFile(f)
+	got, err := sparse.Extents(sf)
+	if err != nil {
+		t.Fatalf("Extents returned error %v", err)
+	}
+	want := []sparse.Extent{{Off: 0, Len: blockSize}, {Off: 2 * blockSize, Len: blockSize}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Extents should be %v, got %v", want, got)
+	}
+	if sf.Size() != 4*blockSize {
+		t.Errorf("Size should be %d, got %d", 4*blockSize, sf.Size())
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	f := sparseFile(t)
+	defer cleanup(f)
+	sf := sparse.NewFile(f)
+
+	for _, want := range []struct {
+		data string
+		skip int64
+		err  error
+	}{
+		{"A", blockSize, nil},
+		{"B", blockSize, nil},
+		{"", 0, io.EOF},
+	} {
+		d, _ := ioutil.ReadAll(sf)
+		if len(d) > 1 && bytes.Count(d, d[:1]) == len(d) {
+			d = d[:1]
+		}
+		if string(d) != want.data {
+			t.Errorf("Read should return a block of %q, got %q", want.data, d)
+		}
+		if skip, err := sf.Next(); skip != want.skip || err != want.err {
+			t.Errorf("Next should return %d, %v, got %d, %v", want.skip, want.err, skip, err)
+		}
+	}
+}
+
+func TestFileCopy(t *testing.T) {
+	f := sparseFile(t)
+	defer cleanup(f)
+	var sb sparse.Buffer
+	if _, err := sparse.Copy(&sb, sparse.NewFile(f)); err != nil {
+		t.Fatalf("Copy returned error %v", err)
+	}
+	sb.Truncate(4 * blockSize)
+	if eq, ofs, err := sparse.Equal(&sb, sparse.NewFile(f), &sparse.EqualOptions{Strict: true}); !eq || err != nil {
+		t.Errorf("Copy from File should match, differs at %d (err=%v)", ofs, err)
+	}
+}
+
+func TestFileEqualStored(t *testing.T) {
+	f := sparseFile(t)
+	defer cleanup(f)
+	// The file holds each block as one extent, while this Buffer holds the
+	// first in two pieces.
+	var sb sparse.Buffer
+	sb.StoreAt(bytes.Repeat([]byte{'A'}, blockSize/2), 0)
+	sb.StoreAt(bytes.Repeat([]byte{'A'}, blockSize/2), blockSize/2)
+	sb.StoreAt(bytes.Repeat([]byte{'B'}, blockSize), 2*blockSize)
+	sb.Truncate(4 * blockSize)
+	if eq, ofs, err := sparse.Equal(&sb, sparse.NewFile(f), &sparse.EqualOptions{Strict: true}); !eq || err != nil {
+		t.Errorf("Equal with Strict should match a File, differs at %d (err=%v)", ofs, err)
+	}
+}
+
+func TestFileSeek(t *testing.T) {
+	f := sparseFile(t)
+	defer cleanup(f)
+	sf := sparse.NewFile(f)
+	for _, c := range []struct {
+		ofs    int64
+		whence int
+		want   int64
+	}{
+		{0, sparse.SeekData, 0},
+		{0, sparse.SeekHole, blockSize},
+		{blockSize, sparse.SeekData, 2 * blockSize},
+		{2 * blockSize, sparse.SeekHole, 3 * blockSize},
+		{3 * blockSize, sparse.SeekHole, 3 * blockSize},
+	} {
+		if got, err := sf.Seek(c.ofs, c.whence); got != c.want || err != nil {
+			t.Errorf("Seek(%d, %d) should return %d, got %d, %v", c.ofs, c.whence, c.want, got, err)
+		}
+	}
+	if _, err := sf.Seek(3*blockSize, sparse.SeekData); err != sparse.ErrSeekEOF {
+		t.Errorf("Seek beyond the last data should return ErrSeekEOF, got %v", err)
+	}
+}
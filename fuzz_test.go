@@ -0,0 +1,175 @@
+package sparse_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+// flatModel is a trivially correct model of a Buffer, holding its content as a
+// flat slice with a mask of which bytes hold data.
+type flatModel struct {
+	data []byte
+	mask []bool
+	pos  int64
+}
+
+func (m *flatModel) grow(n int64) {
+	if n > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, n-int64(len(m.data)))...)
+		m.mask = append(m.mask, make([]bool, n-int64(len(m.mask)))...)
+	}
+}
+
+func (m *flatModel) writeAt(p []byte, off int64) {
+	m.grow(off + int64(len(p)))
+	copy(m.data[off:], p)
+	for i := range p {
+		m.mask[off+int64(i)] = true
+	}
+}
+
+func (m *flatModel) truncate(ofs int64) {
+	m.grow(ofs)
+	m.data, m.mask = m.data[:ofs], m.mask[:ofs]
+}
+
+func (m *flatModel) punchHole(off, size int64) {
+	for i := off; i < off+size && i < int64(len(m.data)); i++ {
+		m.data[i], m.mask[i] = 0, false
+	}
+}
+
+func (m *flatModel) extents() (es []sparse.Extent) {
+	for i := int64(0); i < int64(len(m.mask)); i++ {
+		if !m.mask[i] {
+			continue
+		}
+		j := i
+		for j < int64(len(m.mask)) && m.mask[j] {
+			j++
+		}
+		es = append(es, sparse.Extent{Off: i, Len: j - i})
+		i = j
+	}
+	return
+}
+
+// checkBuffer reports any difference between sb and m, and any violation of
+// the invariants of the extents of sb.  Unless merged is false, adjacent
+// extents are considered a violation, since only StoreAt avoids merging them.
+func checkBuffer(t *testing.T, sb *sparse.Buffer, m *flatModel, merged bool) {
+	t.Helper()
+	if err := sb.Check(); err != nil {
+		t.Fatalf("Check returned %v", err)
+	}
+	if sb.Size() != int64(len(m.data)) {
+		t.Fatalf("Size should be %d, got %d", len(m.data), sb.Size())
+	}
+	es, err := sparse.Extents(sb)
+	if err != nil {
+		t.Fatalf("Extents returned error %v", err)
+	}
+	var covered []sparse.Extent
+	for i, e := range es {
+		if e.Len <= 0 || e.End() > sb.Size() {
+			t.Fatalf("extent %v is empty or beyond Size %d", e, sb.Size())
+		}
+		if i > 0 {
+			prev := es[i-1]
+			if e.Off < prev.End() {
+				t.Fatalf("extents %v and %v are out of order or overlap", prev, e)
+			}
+			if merged && e.Off == prev.End() {
+				t.Fatalf("extents %v and %v should have been merged", prev, e)
+			}
+		}
+		if n := len(covered); n > 0 && covered[n-1].End() == e.Off {
+			covered[n-1].Len += e.Len
+		} else {
+			covered = append(covered, e)
+		}
+	}
+	if want := m.extents(); len(covered) != len(want) {
+		t.Fatalf("extents should be %v, got %v", want, es)
+	} else {
+		for i := range want {
+			if covered[i] != want[i] {
+				t.Fatalf("extents should be %v, got %v", want, es)
+			}
+		}
+	}
+
+	sb.Seek(0, io.SeekStart)
+	got, err := ioutil.ReadAll(sparse.NewReader(sb, nil))
+	if err != nil {
+		t.Fatalf("reading returned error %v", err)
+	}
+	if !bytes.Equal(got, m.data) {
+		t.Fatalf("content should be %q, got %q", m.data, got)
+	}
+	sb.Seek(m.pos, io.SeekStart)
+}
+
+// opCompact is the operation byte for Compact in FuzzBuffer.
+const opCompact = 0xff
+
+// FuzzBuffer applies a series of operations decoded from its input to both a
+// Buffer and a flatModel, and checks that they agree after each one.  Each
+// operation takes three bytes: the operation, an offset and a length.
+func FuzzBuffer(f *testing.F) {
+	f.Add([]byte{0, 5, 3, 0, 13, 3, 0, 0, 2, 0, 3, 2, 0, 7, 3})
+	f.Add([]byte{1, 5, 3, 1, 8, 3, 1, 2, 3, 0, 4, 6, 2, 6, 0})
+	f.Add([]byte{3, 3, 4, 4, 0, 2, 5, 1, 4, 2, 2, 0, 4, 0, 1})
+	// Zero-length writes, which once caused panics and lost data.
+	f.Add([]byte{1, 3, 3, 1, 7, 0, 1, 6, 2, 0, 2, 0, 1, 1, 0})
+	f.Add([]byte{1, 5, 3, 1, 8, 3, opCompact, 0, 0, 1, 2, 3, opCompact, 0, 0})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		if len(ops) > 3*100 {
+			// Long inputs are slow to check and rarely find anything new.
+			ops = ops[:3*100]
+		}
+		var sb sparse.Buffer
+		var m flatModel
+		merged := true
+		for i := 0; i+2 < len(ops); i += 3 {
+			off, n := int64(ops[i+1]%64), int(ops[i+2]%16)
+			p := bytes.Repeat([]byte{byte('A' + i/3%26)}, n)
+			// The seeds in testdata depend on this mapping, so new operations
+			// take reserved values rather than changing it.
+			op := ops[i] % 6
+			if ops[i] == opCompact {
+				op = 6
+			}
+			switch op {
+			case 0:
+				sb.WriteAt(p, off)
+				m.writeAt(p, off)
+			case 1:
+				sb.StoreAt(append([]byte(nil), p...), off)
+				m.writeAt(p, off)
+				merged = false
+			case 2:
+				sb.Truncate(off)
+				m.truncate(off)
+			case 3:
+				sb.Seek(off, io.SeekStart)
+				m.pos = off
+			case 4:
+				sb.Write(p)
+				m.writeAt(p, m.pos)
+				m.pos += int64(n)
+			case 5:
+				sb.PunchHole(off, int64(n))
+				m.punchHole(off, int64(n))
+			case 6:
+				sb.Compact(sparse.CompactOptions{})
+				merged = true
+			}
+			checkBuffer(t, &sb, &m, merged)
+		}
+	})
+}
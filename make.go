@@ -42,12 +42,16 @@ func (m *maker) Read(p []byte) (n int, err error) {
 			// Stop reading with io.EOF until we're advanced with Next.
 			break
 		}
-		for m.zeros > 0 {
-			// Scan counted m.zeros < m.tooManyZeros, so emit them as data.
+		for m.zeros > 0 && n < len(p) {
+			// Scan counted m.zeros < m.minZeros, so emit them as data.
 			p[n] = 0
 			n++
 			m.zeros--
 		}
+		if m.zeros > 0 {
+			// p is full; the rest of the zeros go out on the next call.
+			break
+		}
 		nn := copy(p[n:], m.data)
 		copy(m.data, m.data[nn:])
 		m.data = m.data[:len(m.data)-nn]
@@ -71,7 +71,35 @@ func TestFromReader(t *testing.T) {
 	}
 }
 
-func ExampleFromReader() {
+func TestMakeShortReads(t *testing.T) {
+	// Runs of zeros too short to be skipped, but longer than each read.
+	var in []byte
+	for i := 0; i < 20; i++ {
+		in = append(in, bytes.Repeat([]byte{1}, 300)...)
+		in = append(in, make([]byte, 300)...)
+	}
+	r := sparse.Make(bytes.NewReader(in), 400)
+	var got []byte
+	p := make([]byte, 100)
+	for {
+		n, err := r.Read(p)
+		got = append(got, p[:n]...)
+		if err == io.EOF {
+			if skip, err := r.Next(); skip != 0 || err != io.EOF {
+				t.Fatalf("Next should find nothing to skip, got %d, %v", skip, err)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read returned error %v", err)
+		}
+	}
+	if !bytes.Equal(got, in) {
+		t.Errorf("reading in small pieces should return the input unchanged, got %d bytes", len(got))
+	}
+}
+
+func ExampleMake() {
 	// This example creates a byte slice with spans of zeros in them, and converts
 	// that slice into sparse segments, showing how those spans then get iterated on.
 
@@ -0,0 +1,266 @@
+package sparse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Tree is a Merkle tree of SHA-256 hashes over the fixed-size blocks of
+// sparse data.  Holes read as zeros.  A subtree covering only holes hashes to
+// a constant that depends only on its height, so only the blocks holding data
+// are read and hashed, and only the subtrees above them are stored.  Building
+// or comparing trees of mostly empty data takes time proportional to the data,
+// not to the size.
+//
+// The leaves of the tree are the blocks, padded with holes to a power of two.
+// A leaf hashes the byte 0 followed by the block, and an interior node the
+// byte 1 followed by the hashes of its children.  The root hashes the byte 2
+// followed by the block size and size, as big-endian int64s, and the hash of
+// the top node, so that trees of different sizes have different roots.
+type Tree struct {
+	blockSize int64
+	size      int64
+	levels    [][]treeNode // levels[0] holds leaves, each level sorted by index
+	holes     []hashSum    // holes[l] is the hash of a subtree of height l of holes
+}
+
+type hashSum = [sha256.Size]byte
+
+type treeNode struct {
+	index int64
+	sum   hashSum
+}
+
+const (
+	leafPrefix = 0
+	nodePrefix = 1
+	rootPrefix = 2
+)
+
+var errTreeMismatch = errors.New("sparse: trees have different block sizes")
+
+// NewTree returns a Tree over the blocks of blockSize bytes of r.  If
+// blockSize is zero, DefaultBlockSize is used.  This will move the file
+// position of r.
+func NewTree(r ReadFinder, blockSize int64) (*Tree, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	t := &Tree{blockSize: blockSize, size: r.Size()}
+	nblocks := (t.size + blockSize - 1) / blockSize
+	height := 0
+	for int64(1)<<height < nblocks {
+		height++
+	}
+
+	t.holes = make([]hashSum, height+1)
+	t.holes[0] = leafSum(make([]byte, blockSize))
+	for l := 1; l <= height; l++ {
+		t.holes[l] = nodeSum(t.holes[l-1], t.holes[l-1])
+	}
+
+	var leaves []treeNode
+	err := dataBlocks(r, blockSize, func(i int64, p []byte) error {
+		leaves = append(leaves, treeNode{i, leafSum(p)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A short last block does not hash like a full block of holes.
+	if last := nblocks - 1; last >= 0 && t.size%blockSize != 0 {
+		if n := len(leaves); n == 0 || leaves[n-1].index != last {
+			leaves = append(leaves, treeNode{last, leafSum(make([]byte, t.size%blockSize))})
+		}
+	}
+
+	t.levels = append(t.levels, leaves)
+	for l := 0; l < height; l++ {
+		var up []treeNode
+		for _, n := range t.levels[l] {
+			p := n.index / 2
+			if k := len(up); k > 0 && up[k-1].index == p {
+				continue
+			}
+			up = append(up, treeNode{p, nodeSum(t.node(l, 2*p), t.node(l, 2*p+1))})
+		}
+		t.levels = append(t.levels, up)
+	}
+	return t, nil
+}
+
+func leafSum(p []byte) hashSum {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(p)
+	var sum hashSum
+	h.Sum(sum[:0])
+	return sum
+}
+
+func nodeSum(left, right hashSum) hashSum {
+	var buf [1 + 2*sha256.Size]byte
+	buf[0] = nodePrefix
+	copy(buf[1:], left[:])
+	copy(buf[1+sha256.Size:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+func rootSum(blockSize, size int64, top hashSum) []byte {
+	var buf [1 + 8 + 8 + sha256.Size]byte
+	buf[0] = rootPrefix
+	binary.BigEndian.PutUint64(buf[1:], uint64(blockSize))
+	binary.BigEndian.PutUint64(buf[9:], uint64(size))
+	copy(buf[17:], top[:])
+	sum := sha256.Sum256(buf[:])
+	return sum[:]
+}
+
+// height returns the height of the top node of t.
+func (t *Tree) height() int {
+	return len(t.levels) - 1
+}
+
+// node returns the hash of node i at level l of t.  Levels above the top of
+// t are treated as if t were padded with holes.
+func (t *Tree) node(l int, i int64) hashSum {
+	if l > t.height() {
+		if i != 0 {
+			return t.hole(l)
+		}
+		return nodeSum(t.node(l-1, 0), t.hole(l-1))
+	}
+	ns := t.levels[l]
+	k := sort.Search(len(ns), func(k int) bool { return ns[k].index >= i })
+	if k < len(ns) && ns[k].index == i {
+		return ns[k].sum
+	}
+	return t.hole(l)
+}
+
+// hole returns the hash of a subtree of height l covering only holes.
+func (t *Tree) hole(l int) hashSum {
+	if l < len(t.holes) {
+		return t.holes[l]
+	}
+	// Above the top of t, which only Diff with a taller tree needs.
+	sum := t.holes[len(t.holes)-1]
+	for k := len(t.holes) - 1; k < l; k++ {
+		sum = nodeSum(sum, sum)
+	}
+	return sum
+}
+
+// BlockSize returns the size of the blocks t was built over.
+func (t *Tree) BlockSize() int64 {
+	return t.blockSize
+}
+
+// Size returns the size of the data t was built over.
+func (t *Tree) Size() int64 {
+	return t.size
+}
+
+// Root returns the root hash of t.  Two trees with the same root cover the
+// same data, with the same block size.
+func (t *Tree) Root() []byte {
+	return rootSum(t.blockSize, t.size, t.node(t.height(), 0))
+}
+
+// Proof is a Merkle proof that a block belongs to the data a Tree was built
+// over.
+type Proof struct {
+	Index     int64    // the index of the block
+	BlockSize int64    // the block size of the Tree
+	Size      int64    // the size of the data the Tree was built over
+	Siblings  [][]byte // the hashes of the siblings of the block and of each node above it
+}
+
+// Proof returns a proof for block i of t.  The block may be a hole.
+func (t *Tree) Proof(i int64) (*Proof, error) {
+	if i < 0 || i*t.blockSize >= t.size {
+		return nil, errOffset
+	}
+	p := &Proof{Index: i, BlockSize: t.blockSize, Size: t.size}
+	for l := 0; l < t.height(); l++ {
+		sum := t.node(l, (i>>uint(l))^1)
+		p.Siblings = append(p.Siblings, sum[:])
+	}
+	return p, nil
+}
+
+// Verify reports whether block, the content of block p.Index with holes as
+// zeros, is proven by p to belong to data with the given root hash.
+func (p *Proof) Verify(root, block []byte) bool {
+	n := p.Size - p.Index*p.BlockSize
+	if n > p.BlockSize {
+		n = p.BlockSize
+	}
+	if p.Index < 0 || n <= 0 || int64(len(block)) != n {
+		return false
+	}
+	sum := leafSum(block)
+	for l, s := range p.Siblings {
+		var sib hashSum
+		if len(s) != len(sib) {
+			return false
+		}
+		copy(sib[:], s)
+		if (p.Index>>uint(l))&1 == 0 {
+			sum = nodeSum(sum, sib)
+		} else {
+			sum = nodeSum(sib, sum)
+		}
+	}
+	return bytes.Equal(rootSum(p.BlockSize, p.Size, sum), root)
+}
+
+// Diff returns the extents over which the data t and o were built over
+// differ, coalesced and in order.  Only subtrees whose hashes differ are
+// visited.  A difference in size is reported as a difference of the range
+// between the two sizes.  Returns an error if the trees have different block
+// sizes.
+func (t *Tree) Diff(o *Tree) ([]Extent, error) {
+	if t.blockSize != o.blockSize {
+		return nil, errTreeMismatch
+	}
+	minSize, maxSize := t.size, o.size
+	if minSize > maxSize {
+		minSize, maxSize = maxSize, minSize
+	}
+	height := t.height()
+	if h := o.height(); h > height {
+		height = h
+	}
+
+	var es []Extent
+	var walk func(l int, i int64)
+	walk = func(l int, i int64) {
+		if i<<uint(l)*t.blockSize >= minSize || t.node(l, i) == o.node(l, i) {
+			return
+		}
+		if l > 0 {
+			walk(l-1, 2*i)
+			walk(l-1, 2*i+1)
+			return
+		}
+		end := (i + 1) * t.blockSize
+		if end > maxSize {
+			end = maxSize
+		}
+		es = appendExtent(es, Extent{i * t.blockSize, end - i*t.blockSize})
+	}
+	walk(height, 0)
+
+	if maxSize > minSize {
+		start := minSize
+		if n := len(es); n > 0 && es[n-1].End() > start {
+			start = es[n-1].End()
+		}
+		es = appendExtent(es, Extent{start, maxSize - start})
+	}
+	return es, nil
+}
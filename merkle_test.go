@@ -0,0 +1,110 @@
+package sparse_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func newTree(t *testing.T, sb *sparse.Buffer, blockSize int64) *sparse.Tree {
+	tr, err := sparse.NewTree(sb, blockSize)
+	if err != nil {
+		t.Fatalf("NewTree should succeed, got %v", err)
+	}
+	return tr
+}
+
+func TestTreeRoot(t *testing.T) {
+	var a, b sparse.Buffer
+	a.WriteAt([]byte("AAAA"), 2)
+	a.Truncate(100)
+	b.WriteAt([]byte("\000\000AAAA\000\000"), 0)
+	b.WriteAt(make([]byte, 10), 50)
+	b.Truncate(100)
+	if ra, rb := newTree(t, &a, 8).Root(), newTree(t, &b, 8).Root(); !bytes.Equal(ra, rb) {
+		t.Errorf("holes and explicit zeros should have the same root")
+	}
+
+	b.WriteAt([]byte("B"), 60)
+	if ra, rb := newTree(t, &a, 8).Root(), newTree(t, &b, 8).Root(); bytes.Equal(ra, rb) {
+		t.Errorf("different data should have different roots")
+	}
+	b.PunchHole(60, 1)
+	b.Truncate(101)
+	if ra, rb := newTree(t, &a, 8).Root(), newTree(t, &b, 8).Root(); bytes.Equal(ra, rb) {
+		t.Errorf("different sizes should have different roots")
+	}
+}
+
+func TestTreeLarge(t *testing.T) {
+	// Only the blocks holding data are visited, so this is fast despite the
+	// size.
+	var a, b sparse.Buffer
+	a.WriteAt([]byte("AAAA"), 1<<30)
+	a.WriteAt([]byte("BBBB"), 1<<40-4)
+	b.WriteAt([]byte("AAAA"), 1<<30)
+	b.WriteAt([]byte("BBBC"), 1<<40-4)
+	b.WriteAt([]byte("CCCC"), 1<<35)
+	ta, tb := newTree(t, &a, 0), newTree(t, &b, 0)
+	want := []sparse.Extent{{1 << 35, sparse.DefaultBlockSize}, {1<<40 - sparse.DefaultBlockSize, sparse.DefaultBlockSize}}
+	if got, err := ta.Diff(tb); !reflect.DeepEqual(got, want) || err != nil {
+		t.Errorf("Diff should return %v, got %v, %v", want, got, err)
+	}
+	if got, err := tb.Diff(ta); !reflect.DeepEqual(got, want) || err != nil {
+		t.Errorf("Diff in reverse should return %v, got %v, %v", want, got, err)
+	}
+	if got, err := ta.Diff(ta); got != nil || err != nil {
+		t.Errorf("Diff with itself should return nothing, got %v, %v", got, err)
+	}
+}
+
+func TestTreeProof(t *testing.T) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAAAAAAA"), 0)
+	sb.WriteAt([]byte("BB"), 42)
+	sb.Truncate(45)
+	tr := newTree(t, &sb, 8)
+	root := tr.Root()
+
+	blocks := map[int64]string{
+		0: "AAAAAAAA",
+		2: "\000\000\000\000\000\000\000\000",
+		5: "\000\000BB\000",
+	}
+	for i, block := range blocks {
+		p, err := tr.Proof(i)
+		if err != nil {
+			t.Fatalf("Proof(%d) should succeed, got %v", i, err)
+		}
+		if !p.Verify(root, []byte(block)) {
+			t.Errorf("Proof(%d) should verify %q", i, block)
+		}
+		if p.Verify(root, []byte("XXXXXXXX")[:len(block)]) {
+			t.Errorf("Proof(%d) should not verify other data", i)
+		}
+	}
+	if _, err := tr.Proof(6); err == nil {
+		t.Errorf("Proof beyond the size should fail")
+	}
+}
+
+func TestTreeDiff(t *testing.T) {
+	var a, b sparse.Buffer
+	a.WriteAt(bytes.Repeat([]byte("A"), 40), 0)
+	a.Truncate(100)
+	b.WriteAt(bytes.Repeat([]byte("A"), 40), 0)
+	b.WriteAt([]byte("X"), 9)
+	b.PunchHole(30, 4)
+	b.WriteAt([]byte("Y"), 70)
+	b.Truncate(200)
+
+	want := []sparse.Extent{{8, 8}, {24, 16}, {64, 8}, {96, 104}}
+	if got, err := newTree(t, &a, 8).Diff(newTree(t, &b, 8)); !reflect.DeepEqual(got, want) || err != nil {
+		t.Errorf("Diff should return %v, got %v, %v", want, got, err)
+	}
+	if _, err := newTree(t, &a, 8).Diff(newTree(t, &b, 16)); err == nil {
+		t.Errorf("Diff of trees with different block sizes should fail")
+	}
+}
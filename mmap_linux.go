@@ -0,0 +1,281 @@
+package sparse
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// MmapBuffer is a sparse buffer backed by a memory-mapped file, allowing the
+// kernel to page data in and out as needed.  It offers the same methods as
+// Buffer, so it can be used in its place for working sets too large for
+// memory.  The file is kept the same size as the MmapBuffer, and holes in the
+// MmapBuffer are holes in the file.
+//
+// MmapBuffer tracks the extents of data written to it in its own index, which
+// is initialized from the file's existing data using SeekData and SeekHole.
+// Unlike Buffer, adjacent writes are always merged into one extent.
+type MmapBuffer struct {
+	f       *os.File
+	data    []byte // the mapping, which may extend beyond the end of f
+	index   ExtentSet
+	filePos int64
+	trunc   int64
+	err     error
+}
+
+// NewMmapBuffer maps f, which must be open for reading and writing, and returns
+// an MmapBuffer containing its data.  The MmapBuffer should be closed with
+// Close when no longer needed.  f remains owned by the caller, and should not
+// be modified while the MmapBuffer is in use.
+func NewMmapBuffer(f *os.File) (*MmapBuffer, error) {
+	b := &MmapBuffer{f: f}
+	es, err := Extents(NewFile(f))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range es {
+		b.index.Add(e)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b.trunc = fi.Size()
+	if err := b.remap(b.trunc); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// remap ensures the mapping covers at least size bytes.
+func (b *MmapBuffer) remap(size int64) error {
+	if size <= int64(len(b.data)) {
+		return nil
+	}
+	// Grow geometrically so that a series of appending writes doesn't remap
+	// every time.
+	n := int64(len(b.data)) * 2
+	if n < size {
+		n = size
+	}
+	if n < 1<<20 {
+		n = 1 << 20
+	}
+	if int64(int(n)) != n {
+		return syscall.ENOMEM
+	}
+	data, err := syscall.Mmap(int(b.f.Fd()), 0, int(n), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return &os.PathError{Op: "mmap", Path: b.f.Name(), Err: err}
+	}
+	if b.data != nil {
+		syscall.Munmap(b.data)
+	}
+	b.data = data
+	return nil
+}
+
+// Close unmaps the file.  It does not close the file.
+func (b *MmapBuffer) Close() error {
+	if b.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(b.data)
+	b.data = nil
+	return err
+}
+
+// Sync flushes changes made to the mapping to the file.
+func (b *MmapBuffer) Sync() error {
+	if len(b.data) == 0 {
+		return nil
+	}
+	_, _, e := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b.data[0])), uintptr(len(b.data)), syscall.MS_SYNC)
+	if e != 0 {
+		return &os.PathError{Op: "msync", Path: b.f.Name(), Err: e}
+	}
+	return nil
+}
+
+// Err returns the first error encountered by a method unable to return one,
+// such as Truncate or StoreAt.
+func (b *MmapBuffer) Err() error {
+	return b.err
+}
+
+func (b *MmapBuffer) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Size returns the apparent size of the buffer, which is the size of the
+// file.
+func (b *MmapBuffer) Size() int64 {
+	return b.trunc
+}
+
+// allocate ensures space is allocated in the file for off:off+size, extending
+// the file if needed, so that writing to the mapping cannot fail with SIGBUS.
+func (b *MmapBuffer) allocate(off, size int64) error {
+	err := syscall.Fallocate(int(b.f.Fd()), 0, off, size)
+	if err == syscall.EOPNOTSUPP {
+		// We'll have to take our chances with the file system.
+		err = nil
+		if off+size > b.trunc {
+			err = b.f.Truncate(off + size)
+		}
+	} else if err != nil {
+		err = &os.PathError{Op: "fallocate", Path: b.f.Name(), Err: err}
+	}
+	return err
+}
+
+// WriteAt writes p to the buffer at off.
+func (b *MmapBuffer) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errOffset
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(p))
+	if err = b.allocate(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	if end > b.trunc {
+		b.trunc = end
+	}
+	if err = b.remap(end); err != nil {
+		return 0, err
+	}
+	n = copy(b.data[off:], p)
+	b.index.Add(Extent{off, int64(n)})
+	return n, nil
+}
+
+// StoreAt writes p to the buffer at off.  Unlike Buffer, MmapBuffer always
+// copies p.  Errors are reported by Err.
+func (b *MmapBuffer) StoreAt(p []byte, off int64) {
+	if _, err := b.WriteAt(p, off); err != nil {
+		b.setErr(err)
+	}
+}
+
+// Write writes p at the current file position.
+func (b *MmapBuffer) Write(p []byte) (n int, err error) {
+	n, err = b.WriteAt(p, b.filePos)
+	b.filePos += int64(n)
+	return
+}
+
+// Truncate sets the size of the buffer to ofs.  Data at and after ofs is
+// deleted.  Errors are reported by Err.
+func (b *MmapBuffer) Truncate(ofs int64) {
+	if err := b.f.Truncate(ofs); err != nil {
+		b.setErr(err)
+		return
+	}
+	b.index.Remove(Extent{ofs, b.trunc - ofs})
+	b.trunc = ofs
+}
+
+// mmapPunchHole punches holes for MmapBuffer.  Tests replace it to exercise
+// the fallback used when punching holes is not supported.
+var mmapPunchHole = punchHole
+
+// PunchHole deletes any data within off:off+size, leaving a hole.  The size
+// is unchanged.  Errors are reported by Err.
+func (b *MmapBuffer) PunchHole(off, size int64) {
+	if off < 0 {
+		size += off
+		off = 0
+	}
+	if end := off + size; end > b.trunc {
+		size = b.trunc - off
+	}
+	if size <= 0 {
+		return
+	}
+	if err := mmapPunchHole(b.f, off, size); err != nil {
+		// Keep the promise that holes read as zeros.  Truncate may have grown
+		// the file beyond the mapping, but nothing was written there through
+		// it, so those bytes are already zeros.
+		end := off + size
+		if end > int64(len(b.data)) {
+			end = int64(len(b.data))
+		}
+		for i := off; i < end; i++ {
+			b.data[i] = 0
+		}
+	}
+	b.index.Remove(Extent{off, size})
+}
+
+// Find moves the file position to the first byte of data at or after off, and
+// returns the start and size of the extent containing it.  If there is no data
+// at or after off, returns io.EOF.
+func (b *MmapBuffer) Find(off int64) (readerOfs, size int64, err error) {
+	i := b.index.search(off + 1)
+	if i == len(b.index.es) {
+		return 0, 0, io.EOF
+	}
+	e := b.index.es[i]
+	b.filePos = off
+	if e.Off > off {
+		b.filePos = e.Off
+	}
+	return e.Off, e.Len, nil
+}
+
+// Read reads up to len(p) bytes of data at the current file position.  If the
+// file position lies within a hole, returns io.EOF without reading any bytes.
+func (b *MmapBuffer) Read(p []byte) (n int, err error) {
+	i := b.index.search(b.filePos + 1)
+	if i == len(b.index.es) || b.index.es[i].Off > b.filePos {
+		return 0, io.EOF
+	}
+	end := b.index.es[i].End()
+	if max := end - b.filePos; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n = copy(p, b.data[b.filePos:end])
+	b.filePos += int64(n)
+	return n, nil
+}
+
+// Next advances to the next extent of data after the current file position,
+// or to the end of the buffer if there is none.  Returns io.EOF if the file
+// position is already at or beyond the end of the buffer.
+func (b *MmapBuffer) Next() (skip int64, err error) {
+	start := b.filePos
+	i := b.index.search(start + 1)
+	if i < len(b.index.es) && b.index.es[i].Off <= start {
+		i++
+	}
+	if i < len(b.index.es) {
+		b.filePos = b.index.es[i].Off
+		return b.filePos - start, nil
+	}
+	if start < b.trunc {
+		b.filePos = b.trunc
+		return b.trunc - start, nil
+	}
+	return 0, io.EOF
+}
+
+// Seek sets the file position, as with Buffer.Seek.
+func (b *MmapBuffer) Seek(ofs int64, whence int) (int64, error) {
+	pos, err := resolveSeek(ofs, whence, b.filePos, b.Size(), b)
+	if err == nil {
+		b.filePos = pos
+	}
+	return pos, err
+}
+
+// ExtentSet returns the set of offsets at which b holds data.
+func (b *MmapBuffer) ExtentSet() *ExtentSet {
+	return &ExtentSet{b.index.Extents()}
+}
@@ -0,0 +1,191 @@
+package sparse_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsetest"
+)
+
+var _ sparse.ReadWriteFinder = (*sparse.MmapBuffer)(nil)
+
+// tempMmapBuffer is an MmapBuffer over a temporary file, which is removed when
+// it is closed.
+type tempMmapBuffer struct {
+	*sparse.MmapBuffer
+	f *os.File
+}
+
+func (b tempMmapBuffer) Close() error {
+	err := b.MmapBuffer.Close()
+	cleanup(b.f)
+	return err
+}
+
+func newTempMmapBuffer(t *testing.T) tempMmapBuffer {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := sparse.NewMmapBuffer(f)
+	if err != nil {
+		cleanup(f)
+		t.Fatalf("NewMmapBuffer returned error %v", err)
+	}
+	return tempMmapBuffer{mb, f}
+}
+
+func TestMmapBufferConformance(t *testing.T) {
+	sparsetest.TestReadWriteFinder(t, func(t *testing.T) sparse.ReadWriteFinder {
+		return newTempMmapBuffer(t)
+	})
+}
+
+// mmapBufferOf returns an MmapBuffer holding the same data as m.  Since
+// MmapBuffer merges adjacent writes and ignores empty ones, m is coalesced to
+// match.
+func mmapBufferOf(t *testing.T, m *sparsetest.Model) tempMmapBuffer {
+	m.Coalesce()
+	b := newTempMmapBuffer(t)
+	for _, s := range m.Segments() {
+		b.WriteAt(s.Data, s.Off)
+	}
+	if m.Size() > b.Size() {
+		b.Truncate(m.Size())
+	}
+	return b
+}
+
+func TestMmapBufferReaderConformance(t *testing.T) {
+	sparsetest.TestReader(t, func(t *testing.T, m *sparsetest.Model) sparse.Reader {
+		return mmapBufferOf(t, m)
+	})
+}
+
+func TestMmapBufferReadFinderConformance(t *testing.T) {
+	sparsetest.TestReadFinder(t, func(t *testing.T, m *sparsetest.Model) sparse.ReadFinder {
+		return mmapBufferOf(t, m)
+	})
+}
+
+func TestMmapBuffer(t *testing.T) {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(f)
+	mb, err := sparse.NewMmapBuffer(f)
+	if err != nil {
+		t.Fatalf("NewMmapBuffer returned error %v", err)
+	}
+	defer mb.Close()
+
+	var sb sparse.Buffer
+	r := rand.New(rand.NewSource(1))
+	var ops []string
+	for i := 0; i < 500; i++ {
+		off := r.Int63n(1 << 21)
+		p := bytes.Repeat([]byte{byte('A' + i%26)}, r.Intn(8192)+1)
+		if r.Intn(10) == 0 {
+			mb.Truncate(off)
+			sb.Truncate(off)
+			ops = append(ops, fmt.Sprintf("Truncate(%d)", off))
+		} else {
+			mb.WriteAt(p, off)
+			sb.WriteAt(p, off)
+			ops = append(ops, fmt.Sprintf("WriteAt(%d bytes, %d)", len(p), off))
+		}
+		if got, want := mb.ExtentSet().Extents(), sb.ExtentSet().Extents(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("extents should be %v, got %v after:\n%v", want, got, ops)
+		}
+	}
+	if err := mb.Err(); err != nil {
+		t.Fatalf("Err returned %v", err)
+	}
+	if eq, ofs, err := sparse.Equal(mb, &sb, nil); !eq || err != nil {
+		t.Fatalf("MmapBuffer should match Buffer, differs at %d (err=%v)", ofs, err)
+	}
+	if err := mb.Sync(); err != nil {
+		t.Errorf("Sync returned error %v", err)
+	}
+
+	// The file itself should have the same content.
+	if eq, ofs, err := sparse.Equal(sparse.NewFile(f), &sb, nil); !eq || err != nil {
+		t.Errorf("file should match Buffer, differs at %d (err=%v)", ofs, err)
+	}
+}
+
+func TestMmapBufferExisting(t *testing.T) {
+	f := sparseFile(t)
+	defer cleanup(f)
+	mb, err := sparse.NewMmapBuffer(f)
+	if err != nil {
+		t.Fatalf("NewMmapBuffer returned error %v", err)
+	}
+	defer mb.Close()
+
+	want := []sparse.Extent{{Off: 0, Len: blockSize}, {Off: 2 * blockSize, Len: blockSize}}
+	if got := mb.ExtentSet().Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("NewMmapBuffer should find extents %v, got %v", want, got)
+	}
+	if mb.Size() != 4*blockSize {
+		t.Errorf("Size should be %d, got %d", 4*blockSize, mb.Size())
+	}
+
+	var got []string
+	for {
+		skip, err := mb.Next()
+		if err != nil {
+			break
+		}
+		d, _ := ioutil.ReadAll(mb)
+		got = append(got, fmt.Sprintf("%d:%d", skip, len(d)))
+	}
+	if want := []string{"8192:4096", "4096:0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Next and Read should give %v, got %v", want, got)
+	}
+}
+
+func TestMmapBufferPunchHoleFallback(t *testing.T) {
+	defer sparse.DisableMmapPunchHole()()
+	mb := newTempMmapBuffer(t)
+	defer mb.Close()
+
+	// Grow the file well beyond the initial mapping, then punch across the
+	// whole of it, zeroing rather than punching.
+	mb.WriteAt([]byte("AAAA"), 0)
+	size := int64(4 << 20)
+	mb.Truncate(size)
+	mb.PunchHole(2, size)
+	if err := mb.Err(); err != nil {
+		t.Fatalf("Err returned %v", err)
+	}
+
+	want := []sparse.Extent{{Off: 0, Len: 2}}
+	if got := mb.ExtentSet().Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PunchHole should leave extents %v, got %v", want, got)
+	}
+	if mb.Size() != size {
+		t.Errorf("PunchHole should not change Size %d, got %d", size, mb.Size())
+	}
+	p := make([]byte, 4)
+	if _, err := mb.f.ReadAt(p, 0); err != nil || string(p) != "AA\000\000" {
+		t.Errorf("file should hold \"AA\\000\\000\", got %q, %v", p, err)
+	}
+
+	// A range starting before 0 is clamped to it.
+	mb.PunchHole(-1, 2)
+	want = []sparse.Extent{{Off: 1, Len: 1}}
+	if got := mb.ExtentSet().Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PunchHole(-1, 2) should leave extents %v, got %v", want, got)
+	}
+	if _, err := mb.f.ReadAt(p, 0); err != nil || string(p) != "\000A\000\000" {
+		t.Errorf("file should hold \"\\000A\\000\\000\", got %q, %v", p, err)
+	}
+}
@@ -0,0 +1,712 @@
+// Package nbd serves sparse data as a block device over the Network Block
+// Device protocol, as described at
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md.
+//
+// A Server speaks fixed newstyle negotiation, supporting the EXPORT_NAME,
+// ABORT, LIST, INFO, GO, STRUCTURED_REPLY and LIST_META_CONTEXT and
+// SET_META_CONTEXT options, and serves the READ, WRITE, DISC, FLUSH, TRIM,
+// WRITE_ZEROES and BLOCK_STATUS commands.  With structured replies, holes
+// are sent as such rather than as zeros, and the "base:allocation" metadata
+// context reports where they are.  TRIM and WRITE_ZEROES punch holes.
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/dnesting/sparse"
+)
+
+// Magic numbers.
+const (
+	nbdMagic             = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic             = 0x49484156454f5054 // "IHAVEOPT"
+	repMagic             = 0x0003e889045565a9
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+)
+
+// Handshake flags, sent by the server, and client flags, sent in response.
+const (
+	flagFixedNewstyle  = 1 << 0
+	flagNoZeroes       = 1 << 1
+	flagCFixedNewstyle = 1 << 0
+	flagCNoZeroes      = 1 << 1
+)
+
+// Options.
+const (
+	optExportName     = 1
+	optAbort          = 2
+	optList           = 3
+	optInfo           = 6
+	optGo             = 7
+	optStructuredRepl = 8
+	optListMetaCtx    = 9
+	optSetMetaCtx     = 10
+)
+
+// Option reply types.
+const (
+	repAck         = 1
+	repServer      = 2
+	repInfo        = 3
+	repMetaContext = 4
+	repErrUnsup    = 1<<31 + 1
+	repErrInvalid  = 1<<31 + 3
+	repErrUnknown  = 1<<31 + 6
+	repErrTooBig   = 1<<31 + 9
+)
+
+const infoExport = 0
+
+// Transmission flags.
+const (
+	flagHasFlags        = 1 << 0
+	flagReadOnly        = 1 << 1
+	flagSendFlush       = 1 << 2
+	flagSendFUA         = 1 << 3
+	flagSendTrim        = 1 << 5
+	flagSendWriteZeroes = 1 << 6
+	flagSendDF          = 1 << 7
+)
+
+// Commands.
+const (
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+	cmdBlockStatus = 7
+)
+
+// Command flags.
+const (
+	cmdFlagFUA    = 1 << 0
+	cmdFlagNoHole = 1 << 1
+	cmdFlagDF     = 1 << 2
+	cmdFlagReqOne = 1 << 3
+)
+
+// Structured reply flags and types.
+const (
+	replyFlagDone        = 1 << 0
+	replyTypeNone        = 0
+	replyTypeOffsetData  = 1
+	replyTypeOffsetHole  = 2
+	replyTypeBlockStatus = 5
+	replyTypeError       = 1<<15 + 1
+)
+
+// Error values, as errno values.
+const (
+	errPerm     = 1
+	errIO       = 5
+	errInval    = 22
+	errNoSpace  = 28
+	errOverflow = 75
+)
+
+// The base:allocation metadata context and its states.
+const (
+	allocationContext = "base:allocation"
+	allocationID      = 1
+	stateHole         = 1 << 0
+	stateZero         = 1 << 1
+)
+
+const (
+	// maxOption is the largest option data accepted during negotiation.
+	maxOption = 64 * 1024
+	// maxPayload is the largest read or write accepted.
+	maxPayload = 32 * 1024 * 1024
+)
+
+var errProtocol = errors.New("nbd: protocol error")
+
+// Server serves a sparse backend, such as a sparse.Buffer, as a block device.
+// The size of the device is the size of the backend when a client connects.
+// Clients connecting at the same time share the backend, and their commands
+// are carried out one at a time.
+type Server struct {
+	// Name is the name of the export.  Clients may also ask for the default
+	// export, with an empty name.
+	Name string
+
+	// Backend holds the data of the device.  If it has a Sync or Flush
+	// method returning an error, that is called to carry out FLUSH, and
+	// after writes with the FUA flag.
+	Backend sparse.ReadWriteFinder
+
+	// ReadOnly makes the device read-only.
+	ReadOnly bool
+
+	mu sync.Mutex // serializes use of Backend
+}
+
+// ListenAndServe listens on the unix socket at path, and serves clients
+// connecting to it.  It returns only when accepting a connection fails.
+func (s *Server) ListenAndServe(path string) error {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(l)
+}
+
+// Serve serves clients connecting to l, each in its own goroutine.  It
+// returns only when accepting a connection fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			s.ServeConn(c)
+		}()
+	}
+}
+
+// ServeConn negotiates with a client over rw, and serves it until it
+// disconnects.  Returns nil if the client disconnects as the protocol
+// expects, and otherwise the error that ended the connection.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	c := &conn{s: s, r: bufio.NewReader(rw), w: bufio.NewWriter(rw)}
+	ok, err := c.negotiate()
+	if err != nil || !ok {
+		return err
+	}
+	return c.transmit()
+}
+
+// conn is a connection to a client.
+type conn struct {
+	s          *Server
+	r          *bufio.Reader
+	w          *bufio.Writer
+	size       int64
+	structured bool // structured replies were negotiated
+	allocation bool // the base:allocation context was selected
+}
+
+func (c *conn) write(vs ...interface{}) {
+	for _, v := range vs {
+		// Errors writing to a bufio.Writer are reported by Flush.
+		binary.Write(c.w, binary.BigEndian, v)
+	}
+}
+
+func (c *conn) read(vs ...interface{}) error {
+	for _, v := range vs {
+		if err := binary.Read(c.r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flags returns the transmission flags of the export.  DF is only offered
+// with structured replies, since without them a read cannot be fragmented.
+func (c *conn) flags() uint16 {
+	f := uint16(flagHasFlags | flagSendFlush | flagSendFUA)
+	if c.structured {
+		f |= flagSendDF
+	}
+	if c.s.ReadOnly {
+		f |= flagReadOnly
+	} else {
+		f |= flagSendTrim | flagSendWriteZeroes
+	}
+	return f
+}
+
+// negotiate carries out the handshake and option haggling, and reports
+// whether the client moved on to transmission.
+func (c *conn) negotiate() (bool, error) {
+	c.write(uint64(nbdMagic), uint64(optMagic), uint16(flagFixedNewstyle|flagNoZeroes))
+	if err := c.w.Flush(); err != nil {
+		return false, err
+	}
+	var clientFlags uint32
+	if err := c.read(&clientFlags); err != nil {
+		return false, err
+	}
+	if clientFlags&^(flagCFixedNewstyle|flagCNoZeroes) != 0 {
+		return false, fmt.Errorf("nbd: unknown client flags %#x", clientFlags)
+	}
+	noZeroes := clientFlags&flagCNoZeroes != 0
+
+	for {
+		var magic uint64
+		var opt, n uint32
+		if err := c.read(&magic, &opt, &n); err != nil {
+			return false, err
+		}
+		if magic != optMagic {
+			return false, errProtocol
+		}
+		if n > maxOption {
+			if _, err := io.CopyN(ioutil.Discard, c.r, int64(n)); err != nil {
+				return false, err
+			}
+			if err := c.optReply(opt, repErrTooBig, nil); err != nil {
+				return false, err
+			}
+			continue
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return false, err
+		}
+
+		c.s.mu.Lock()
+		c.size = c.s.Backend.Size()
+		c.s.mu.Unlock()
+
+		var err error
+		switch opt {
+		case optExportName:
+			if !c.s.exports(string(data)) {
+				return false, fmt.Errorf("nbd: unknown export %q", data)
+			}
+			c.write(uint64(c.size), c.flags())
+			if !noZeroes {
+				c.w.Write(make([]byte, 124))
+			}
+			return true, c.w.Flush()
+		case optAbort:
+			c.optReply(opt, repAck, nil)
+			return false, nil
+		case optList:
+			if n != 0 {
+				err = c.optReply(opt, repErrInvalid, nil)
+				break
+			}
+			reply := make([]byte, 4+len(c.s.Name))
+			binary.BigEndian.PutUint32(reply, uint32(len(c.s.Name)))
+			copy(reply[4:], c.s.Name)
+			if err = c.optReply(opt, repServer, reply); err == nil {
+				err = c.optReply(opt, repAck, nil)
+			}
+		case optStructuredRepl:
+			if n != 0 {
+				err = c.optReply(opt, repErrInvalid, nil)
+				break
+			}
+			c.structured = true
+			err = c.optReply(opt, repAck, nil)
+		case optListMetaCtx, optSetMetaCtx:
+			err = c.metaContext(opt, data)
+		case optInfo, optGo:
+			var ok bool
+			if ok, err = c.info(opt, data); ok && err == nil && opt == optGo {
+				return true, nil
+			}
+		default:
+			err = c.optReply(opt, repErrUnsup, nil)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// exports reports whether name selects the export of s.
+func (s *Server) exports(name string) bool {
+	return name == "" || name == s.Name
+}
+
+func (c *conn) optReply(opt, typ uint32, data []byte) error {
+	c.write(uint64(repMagic), opt, typ, uint32(len(data)))
+	c.w.Write(data)
+	return c.w.Flush()
+}
+
+// parseName parses a 32-bit length and a name from the start of data.
+func parseName(data []byte) (name string, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return "", nil, false
+	}
+	return string(data[4 : 4+n]), data[4+n:], true
+}
+
+// info handles INFO and GO, and reports whether the export was found.
+func (c *conn) info(opt uint32, data []byte) (bool, error) {
+	name, rest, ok := parseName(data)
+	if !ok || len(rest) < 2 || len(rest) != 2+2*int(binary.BigEndian.Uint16(rest)) {
+		return false, c.optReply(opt, repErrInvalid, nil)
+	}
+	if !c.s.exports(name) {
+		return false, c.optReply(opt, repErrUnknown, nil)
+	}
+	// Only the required NBD_INFO_EXPORT is sent, whatever was requested.
+	reply := make([]byte, 12)
+	binary.BigEndian.PutUint16(reply, infoExport)
+	binary.BigEndian.PutUint64(reply[2:], uint64(c.size))
+	binary.BigEndian.PutUint16(reply[10:], c.flags())
+	if err := c.optReply(opt, repInfo, reply); err != nil {
+		return false, err
+	}
+	return true, c.optReply(opt, repAck, nil)
+}
+
+// metaContext handles LIST_META_CONTEXT and SET_META_CONTEXT.  The only
+// context offered is base:allocation.
+func (c *conn) metaContext(opt uint32, data []byte) error {
+	name, rest, ok := parseName(data)
+	if !ok || len(rest) < 4 {
+		return c.optReply(opt, repErrInvalid, nil)
+	}
+	if opt == optSetMetaCtx && !c.structured {
+		return c.optReply(opt, repErrInvalid, nil)
+	}
+	if !c.s.exports(name) {
+		return c.optReply(opt, repErrUnknown, nil)
+	}
+	count := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+	var queries []string
+	for i := uint32(0); i < count; i++ {
+		var q string
+		if q, rest, ok = parseName(rest); !ok {
+			return c.optReply(opt, repErrInvalid, nil)
+		}
+		queries = append(queries, q)
+	}
+	if len(rest) != 0 {
+		return c.optReply(opt, repErrInvalid, nil)
+	}
+
+	// Listing with no queries lists every context.
+	found := opt == optListMetaCtx && count == 0
+	for _, q := range queries {
+		if q == allocationContext || (opt == optListMetaCtx && q == "base:") {
+			found = true
+		}
+	}
+	if opt == optSetMetaCtx {
+		c.allocation = found
+	}
+	if found {
+		// Only a context being selected has an id; listing gives 0.
+		reply := make([]byte, 4+len(allocationContext))
+		if opt == optSetMetaCtx {
+			binary.BigEndian.PutUint32(reply, allocationID)
+		}
+		copy(reply[4:], allocationContext)
+		if err := c.optReply(opt, repMetaContext, reply); err != nil {
+			return err
+		}
+	}
+	return c.optReply(opt, repAck, nil)
+}
+
+// request is a command sent by a client.
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+// transmit serves commands until the client disconnects.
+func (c *conn) transmit() error {
+	for {
+		var req request
+		if err := c.read(&req); err != nil {
+			return err
+		}
+		if req.Magic != requestMagic {
+			return errProtocol
+		}
+		var err error
+		switch req.Type {
+		case cmdDisc:
+			return nil
+		case cmdRead:
+			err = c.handleRead(&req)
+		case cmdWrite:
+			err = c.handleWrite(&req)
+		case cmdFlush:
+			err = c.simpleReply(&req, c.flush())
+		case cmdTrim:
+			err = c.simpleReply(&req, c.fua(&req, c.punch(&req)))
+		case cmdWriteZeroes:
+			if req.Flags&cmdFlagNoHole != 0 {
+				err = c.simpleReply(&req, c.fua(&req, c.writeZeroes(&req)))
+			} else {
+				err = c.simpleReply(&req, c.fua(&req, c.punch(&req)))
+			}
+		case cmdBlockStatus:
+			err = c.handleBlockStatus(&req)
+		default:
+			err = c.simpleReply(&req, errInval)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// check returns the error for a request outside the device, or 0.
+func (c *conn) check(req *request, beyond uint32) uint32 {
+	if req.Length == 0 {
+		return errInval
+	}
+	if req.Offset > uint64(c.size) || uint64(req.Length) > uint64(c.size)-req.Offset {
+		return beyond
+	}
+	return 0
+}
+
+// checkWrite is check for requests modifying the device.
+func (c *conn) checkWrite(req *request) uint32 {
+	if c.s.ReadOnly {
+		return errPerm
+	}
+	return c.check(req, errNoSpace)
+}
+
+func (c *conn) simpleReply(req *request, errno uint32, data ...[]byte) error {
+	c.write(uint32(simpleReplyMagic), errno, req.Handle)
+	for _, p := range data {
+		c.w.Write(p)
+	}
+	return c.w.Flush()
+}
+
+// chunk writes the header of a structured reply chunk with n bytes of
+// payload, which the caller writes.
+func (c *conn) chunk(req *request, flags, typ uint16, n int) {
+	c.write(uint32(structuredReplyMagic), flags, typ, req.Handle, uint32(n))
+}
+
+// errorReply replies to req with errno, as a structured reply if those were
+// negotiated.
+func (c *conn) errorReply(req *request, errno uint32) error {
+	if !c.structured {
+		return c.simpleReply(req, errno)
+	}
+	c.chunk(req, replyFlagDone, replyTypeError, 6)
+	c.write(errno, uint16(0))
+	return c.w.Flush()
+}
+
+// piece is a run of data or of a hole.
+type piece struct {
+	off, len int64
+	data     bool
+}
+
+// pieces returns the runs of data and holes within off:end of the backend,
+// which the caller must have locked.
+func (c *conn) pieces(off, end int64) (ps []piece, err error) {
+	for search := off; off < end; {
+		n, size, ferr := c.s.Backend.Find(search)
+		if ferr == io.EOF {
+			n, size = end, 0
+		} else if ferr != nil {
+			return nil, ferr
+		} else if n+size <= search {
+			search++ // a zero-length segment
+			continue
+		}
+		if n > off {
+			if n > end {
+				n = end
+			}
+			ps = append(ps, piece{off, n - off, false})
+			off = n
+		}
+		if dend := n + size; off < end && dend > off {
+			if dend > end {
+				dend = end
+			}
+			ps = append(ps, piece{off, dend - off, true})
+			off = dend
+		}
+		search = off
+	}
+	return ps, nil
+}
+
+func (c *conn) handleRead(req *request) error {
+	if errno := c.check(req, errInval); errno != 0 {
+		return c.errorReply(req, errno)
+	}
+	if req.Length > maxPayload {
+		return c.errorReply(req, errOverflow)
+	}
+	off, end := int64(req.Offset), int64(req.Offset)+int64(req.Length)
+	buf := make([]byte, req.Length)
+
+	c.s.mu.Lock()
+	ps, err := c.pieces(off, end)
+	if err == nil {
+		rs := sparse.NewReadSeeker(c.s.Backend, nil)
+		for _, p := range ps {
+			if !p.data {
+				continue
+			}
+			if _, err = rs.ReadAt(buf[p.off-off:p.off-off+p.len], p.off); err == io.EOF {
+				err = nil
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	c.s.mu.Unlock()
+	if err != nil {
+		return c.errorReply(req, errIO)
+	}
+
+	if !c.structured {
+		return c.simpleReply(req, 0, buf)
+	}
+	if req.Flags&cmdFlagDF != 0 {
+		// The client wants the read in one chunk, so holes go as zeros.
+		ps = []piece{{off, end - off, true}}
+	}
+	for i, p := range ps {
+		var flags uint16
+		if i == len(ps)-1 {
+			flags = replyFlagDone
+		}
+		if p.data {
+			c.chunk(req, flags, replyTypeOffsetData, 8+int(p.len))
+			c.write(uint64(p.off))
+			c.w.Write(buf[p.off-off : p.off-off+p.len])
+		} else {
+			c.chunk(req, flags, replyTypeOffsetHole, 12)
+			c.write(uint64(p.off), uint32(p.len))
+		}
+	}
+	return c.w.Flush()
+}
+
+func (c *conn) handleWrite(req *request) error {
+	if req.Length > maxPayload {
+		// We must still consume the data to stay in step with the client.
+		if _, err := io.CopyN(ioutil.Discard, c.r, int64(req.Length)); err != nil {
+			return err
+		}
+		return c.simpleReply(req, errOverflow)
+	}
+	data := make([]byte, req.Length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if errno := c.checkWrite(req); errno != 0 {
+		return c.simpleReply(req, errno)
+	}
+	c.s.mu.Lock()
+	_, err := c.s.Backend.WriteAt(data, int64(req.Offset))
+	c.s.mu.Unlock()
+	if err != nil {
+		return c.simpleReply(req, errIO)
+	}
+	return c.simpleReply(req, c.fua(req, 0))
+}
+
+func (c *conn) punch(req *request) uint32 {
+	if errno := c.checkWrite(req); errno != 0 {
+		return errno
+	}
+	c.s.mu.Lock()
+	c.s.Backend.PunchHole(int64(req.Offset), int64(req.Length))
+	c.s.mu.Unlock()
+	return 0
+}
+
+func (c *conn) writeZeroes(req *request) uint32 {
+	if errno := c.checkWrite(req); errno != 0 {
+		return errno
+	}
+	zeros := make([]byte, 64*1024)
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	for off, end := int64(req.Offset), int64(req.Offset)+int64(req.Length); off < end; {
+		n := end - off
+		if n > int64(len(zeros)) {
+			n = int64(len(zeros))
+		}
+		if _, err := c.s.Backend.WriteAt(zeros[:n], off); err != nil {
+			return errIO
+		}
+		off += n
+	}
+	return 0
+}
+
+func (c *conn) flush() uint32 {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	var err error
+	switch b := c.s.Backend.(type) {
+	case interface{ Sync() error }:
+		err = b.Sync()
+	case interface{ Flush() error }:
+		err = b.Flush()
+	}
+	if err != nil {
+		return errIO
+	}
+	return 0
+}
+
+// fua flushes the backend after a successful write, trim or write of zeros
+// with the FUA flag, so that it is on stable storage before the reply.
+func (c *conn) fua(req *request, errno uint32) uint32 {
+	if errno == 0 && req.Flags&cmdFlagFUA != 0 {
+		errno = c.flush()
+	}
+	return errno
+}
+
+func (c *conn) handleBlockStatus(req *request) error {
+	if !c.structured || !c.allocation {
+		return c.errorReply(req, errInval)
+	}
+	if errno := c.check(req, errInval); errno != 0 {
+		return c.errorReply(req, errno)
+	}
+	off, end := int64(req.Offset), int64(req.Offset)+int64(req.Length)
+	c.s.mu.Lock()
+	ps, err := c.pieces(off, end)
+	c.s.mu.Unlock()
+	if err != nil {
+		return c.errorReply(req, errIO)
+	}
+	if req.Flags&cmdFlagReqOne != 0 {
+		ps = ps[:1]
+	}
+	c.chunk(req, replyFlagDone, replyTypeBlockStatus, 4+8*len(ps))
+	c.write(uint32(allocationID))
+	for _, p := range ps {
+		var state uint32
+		if !p.data {
+			state = stateHole | stateZero
+		}
+		c.write(uint32(p.len), state)
+	}
+	return c.w.Flush()
+}
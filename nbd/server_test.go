@@ -0,0 +1,509 @@
+package nbd_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/nbd"
+)
+
+// The protocol, as seen by the client.
+const (
+	optMagic             = 0x49484156454f5054
+	repMagic             = 0x0003e889045565a9
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+
+	optExportName  = 1
+	optAbort       = 2
+	optList        = 3
+	optInfo        = 6
+	optGo          = 7
+	optStructured  = 8
+	optListMetaCtx = 9
+	optSetMetaCtx  = 10
+
+	repAck        = 1
+	repServer     = 2
+	repInfo       = 3
+	repMetaCtx    = 4
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+
+	flagReadOnly = 1 << 1
+	flagSendDF   = 1 << 7
+
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+	cmdBlockStatus = 7
+
+	cmdFlagFUA    = 1 << 0
+	cmdFlagNoHole = 1 << 1
+	cmdFlagDF     = 1 << 2
+	cmdFlagReqOne = 1 << 3
+
+	replyFlagDone = 1
+	typeData      = 1
+	typeHole      = 2
+	typeStatus    = 5
+	typeError     = 1<<15 + 1
+
+	errPerm    = 1
+	errInval   = 22
+	errNoSpace = 28
+)
+
+// client is a minimal NBD client.
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	handle uint64
+}
+
+func (c *client) write(vs ...interface{}) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	for _, v := range vs {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatalf("write to server: %v", err)
+	}
+}
+
+func (c *client) read(vs ...interface{}) {
+	c.t.Helper()
+	for _, v := range vs {
+		if err := binary.Read(c.r, binary.BigEndian, v); err != nil {
+			c.t.Fatalf("read from server: %v", err)
+		}
+	}
+}
+
+// serve starts serving s over a pipe, returning a client that has completed
+// the handshake, sending clientFlags, and a channel receiving the result of
+// ServeConn.
+func serve(t *testing.T, s *nbd.Server, clientFlags uint32) (*client, chan error) {
+	cc, sc := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeConn(sc)
+		sc.Close()
+	}()
+	t.Cleanup(func() { cc.Close() })
+	c := &client{t: t, conn: cc, r: bufio.NewReader(cc)}
+	var magic, opt uint64
+	var flags uint16
+	c.read(&magic, &opt, &flags)
+	if magic != 0x4e42444d41474943 || opt != optMagic || flags != 3 {
+		t.Fatalf("handshake should be NBDMAGIC IHAVEOPT 3, got %#x %#x %d", magic, opt, flags)
+	}
+	c.write(clientFlags)
+	return c, done
+}
+
+type optReply struct {
+	typ  uint32
+	data []byte
+}
+
+// opt sends an option, and returns the replies up to an ACK or an error.
+func (c *client) opt(opt uint32, data []byte) []optReply {
+	c.t.Helper()
+	c.write(uint64(optMagic), opt, uint32(len(data)), data)
+	var rs []optReply
+	for {
+		var magic uint64
+		var ropt, typ, n uint32
+		c.read(&magic, &ropt, &typ, &n)
+		if magic != repMagic || ropt != opt {
+			c.t.Fatalf("option reply should have magic %#x and option %d, got %#x and %d", repMagic, opt, magic, ropt)
+		}
+		r := optReply{typ, make([]byte, n)}
+		c.read(r.data)
+		rs = append(rs, r)
+		if typ == repAck || typ >= 1<<31 {
+			return rs
+		}
+	}
+}
+
+func name(s string) []byte {
+	b := make([]byte, 4+len(s))
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	copy(b[4:], s)
+	return b
+}
+
+// negotiate negotiates structured replies and base:allocation, and goes to
+// transmission.  Returns the size and transmission flags.
+func (c *client) negotiate(export string) (int64, uint16) {
+	c.t.Helper()
+	if rs := c.opt(optStructured, nil); rs[0].typ != repAck {
+		c.t.Fatalf("STRUCTURED_REPLY should be acknowledged, got %d", rs[0].typ)
+	}
+	data := append(name(export), 0, 0, 0, 1)
+	data = append(data, name("base:allocation")...)
+	rs := c.opt(optSetMetaCtx, data)
+	if len(rs) != 2 || rs[0].typ != repMetaCtx || string(rs[0].data[4:]) != "base:allocation" || binary.BigEndian.Uint32(rs[0].data) == 0 {
+		c.t.Fatalf("SET_META_CONTEXT should select base:allocation, got %v", rs)
+	}
+	rs = c.opt(optGo, append(name(export), 0, 0))
+	if len(rs) != 2 || rs[0].typ != repInfo || rs[1].typ != repAck {
+		c.t.Fatalf("GO should reply INFO and ACK, got %v", rs)
+	}
+	info := rs[0].data
+	return int64(binary.BigEndian.Uint64(info[2:])), binary.BigEndian.Uint16(info[10:])
+}
+
+// cmd sends a command, returning its handle.
+func (c *client) cmd(typ, flags uint16, off int64, length int, data []byte) uint64 {
+	c.t.Helper()
+	c.handle++
+	c.write(uint32(requestMagic), flags, typ, c.handle, uint64(off), uint32(length), data)
+	return c.handle
+}
+
+// simple reads a simple reply to h, returning its error.
+func (c *client) simple(h uint64) uint32 {
+	c.t.Helper()
+	var magic, errno uint32
+	var handle uint64
+	c.read(&magic, &errno, &handle)
+	if magic != simpleReplyMagic || handle != h {
+		c.t.Fatalf("reply should be simple to handle %d, got magic %#x handle %d", h, magic, handle)
+	}
+	return errno
+}
+
+type chunk struct {
+	typ  uint16
+	data []byte
+}
+
+// chunks reads a structured reply to h.
+func (c *client) chunks(h uint64) []chunk {
+	c.t.Helper()
+	var cs []chunk
+	for {
+		var magic, n uint32
+		var flags, typ uint16
+		var handle uint64
+		c.read(&magic, &flags, &typ, &handle, &n)
+		if magic != structuredReplyMagic || handle != h {
+			c.t.Fatalf("reply should be structured to handle %d, got magic %#x handle %d", h, magic, handle)
+		}
+		ch := chunk{typ, make([]byte, n)}
+		c.read(ch.data)
+		cs = append(cs, ch)
+		if flags&replyFlagDone != 0 {
+			return cs
+		}
+	}
+}
+
+// readChunks renders a structured reply to a read of n bytes at off, with
+// holes as dots.
+func readChunks(t *testing.T, cs []chunk, off int64, n int) string {
+	t.Helper()
+	p := bytes.Repeat([]byte("?"), n)
+	for _, ch := range cs {
+		at := int64(binary.BigEndian.Uint64(ch.data)) - off
+		switch ch.typ {
+		case typeData:
+			copy(p[at:], ch.data[8:])
+		case typeHole:
+			copy(p[at:], strings.Repeat(".", int(binary.BigEndian.Uint32(ch.data[8:]))))
+		default:
+			t.Fatalf("read reply should hold data and holes, got chunk type %d", ch.typ)
+		}
+	}
+	return string(p)
+}
+
+func chunkError(t *testing.T, cs []chunk) uint32 {
+	t.Helper()
+	if len(cs) != 1 || cs[0].typ != typeError {
+		t.Fatalf("reply should be an error, got %v", cs)
+	}
+	return binary.BigEndian.Uint32(cs[0].data)
+}
+
+// contents renders the content of sb with holes as dots and zero bytes of
+// data as '0'.
+func contents(t *testing.T, sb *sparse.Buffer) string {
+	t.Helper()
+	p := make([]byte, sb.Size())
+	if _, err := sparse.NewReadSeeker(sb, nil).ReadAt(p, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	q := bytes.Repeat([]byte("."), len(p))
+	es, err := sparse.Extents(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range es {
+		copy(q[e.Off:e.End()], bytes.Replace(p[e.Off:e.End()], []byte{0}, []byte("0"), -1))
+	}
+	return string(q)
+}
+
+// newBuffer returns a Buffer holding "..AAA..BBB.." with holes as dots.
+func newBuffer() *sparse.Buffer {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAA"), 2)
+	sb.WriteAt([]byte("BBB"), 7)
+	sb.Truncate(12)
+	return &sb
+}
+
+func TestNegotiate(t *testing.T) {
+	s := &nbd.Server{Name: "disk", Backend: newBuffer(), ReadOnly: true}
+	c, done := serve(t, s, 3)
+
+	rs := c.opt(optList, nil)
+	if len(rs) != 2 || rs[0].typ != repServer || !bytes.Equal(rs[0].data, name("disk")) {
+		t.Errorf("LIST should list \"disk\", got %v", rs)
+	}
+	rs = c.opt(optInfo, append(name("disk"), 0, 0))
+	if len(rs) != 2 || rs[0].typ != repInfo {
+		t.Fatalf("INFO should reply INFO and ACK, got %v", rs)
+	}
+	if size := binary.BigEndian.Uint64(rs[0].data[2:]); size != 12 {
+		t.Errorf("INFO should report size 12, got %d", size)
+	}
+	if flags := binary.BigEndian.Uint16(rs[0].data[10:]); flags&flagReadOnly == 0 {
+		t.Errorf("INFO should report a read-only export, got flags %#x", flags)
+	}
+	if rs := c.opt(optGo, append(name("other"), 0, 0)); rs[0].typ != repErrUnknown {
+		t.Errorf("GO of an unknown export should fail with ERR_UNKNOWN, got %d", rs[0].typ)
+	}
+	data := append(name("disk"), 0, 0, 0, 0)
+	rs = c.opt(optListMetaCtx, data)
+	if len(rs) != 2 || rs[0].typ != repMetaCtx || string(rs[0].data[4:]) != "base:allocation" {
+		t.Fatalf("LIST_META_CONTEXT should list base:allocation, got %v", rs)
+	}
+	if id := binary.BigEndian.Uint32(rs[0].data); id != 0 {
+		t.Errorf("LIST_META_CONTEXT should reply with context id 0, got %d", id)
+	}
+	data = append(name("disk"), 0, 0, 0, 1)
+	data = append(data, name("base:allocation")...)
+	if rs := c.opt(optSetMetaCtx, data); rs[0].typ != repErrInvalid {
+		t.Errorf("SET_META_CONTEXT without structured replies should fail with ERR_INVALID, got %d", rs[0].typ)
+	}
+	if rs := c.opt(99, nil); rs[0].typ != repErrUnsup {
+		t.Errorf("an unknown option should fail with ERR_UNSUP, got %d", rs[0].typ)
+	}
+	if rs := c.opt(optAbort, nil); rs[0].typ != repAck {
+		t.Errorf("ABORT should be acknowledged, got %d", rs[0].typ)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn should return nil after ABORT, got %v", err)
+	}
+}
+
+func TestStructured(t *testing.T) {
+	sb := newBuffer()
+	c, done := serve(t, &nbd.Server{Name: "disk", Backend: sb}, 3)
+	size, flags := c.negotiate("")
+	if size != 12 || flags&flagReadOnly != 0 {
+		t.Fatalf("negotiate should report a writable export of size 12, got %d and flags %#x", size, flags)
+	}
+	if flags&flagSendDF == 0 {
+		t.Errorf("negotiate should offer DF with structured replies, got flags %#x", flags)
+	}
+
+	h := c.cmd(cmdRead, 0, 0, 12, nil)
+	if got := readChunks(t, c.chunks(h), 0, 12); got != "..AAA..BBB.." {
+		t.Errorf("READ should return %q, got %q", "..AAA..BBB..", got)
+	}
+	h = c.cmd(cmdRead, cmdFlagDF, 1, 3, nil)
+	if cs := c.chunks(h); len(cs) != 1 || cs[0].typ != typeData || !bytes.Equal(cs[0].data[8:], []byte("\000AA")) {
+		t.Errorf("READ with DF should return one data chunk of \"\\000AA\", got %v", cs)
+	}
+	h = c.cmd(cmdRead, 0, 10, 3, nil)
+	if errno := chunkError(t, c.chunks(h)); errno != errInval {
+		t.Errorf("READ beyond the end should fail with EINVAL, got %d", errno)
+	}
+
+	h = c.cmd(cmdBlockStatus, 0, 1, 10, nil)
+	cs := c.chunks(h)
+	if len(cs) != 1 || cs[0].typ != typeStatus || binary.BigEndian.Uint32(cs[0].data) != 1 {
+		t.Fatalf("BLOCK_STATUS should reply with the base:allocation context, got %v", cs)
+	}
+	var got [][2]uint32
+	for p := cs[0].data[4:]; len(p) >= 8; p = p[8:] {
+		got = append(got, [2]uint32{binary.BigEndian.Uint32(p), binary.BigEndian.Uint32(p[4:])})
+	}
+	want := [][2]uint32{{1, 3}, {3, 0}, {2, 3}, {3, 0}, {1, 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BLOCK_STATUS should return %v, got %v", want, got)
+	}
+	h = c.cmd(cmdBlockStatus, cmdFlagReqOne, 2, 10, nil)
+	if cs := c.chunks(h); len(cs[0].data) != 12 || binary.BigEndian.Uint32(cs[0].data[4:]) != 3 {
+		t.Errorf("BLOCK_STATUS with REQ_ONE should return one descriptor of length 3, got %v", cs)
+	}
+
+	h = c.cmd(cmdWrite, 0, 4, 2, []byte("xy"))
+	if errno := c.simple(h); errno != 0 {
+		t.Errorf("WRITE should succeed, got error %d", errno)
+	}
+	h = c.cmd(cmdTrim, 0, 8, 4, nil)
+	if errno := c.simple(h); errno != 0 {
+		t.Errorf("TRIM should succeed, got error %d", errno)
+	}
+	h = c.cmd(cmdWriteZeroes, 0, 2, 1, nil)
+	if errno := c.simple(h); errno != 0 {
+		t.Errorf("WRITE_ZEROES should succeed, got error %d", errno)
+	}
+	h = c.cmd(cmdWriteZeroes, cmdFlagNoHole, 0, 1, nil)
+	if errno := c.simple(h); errno != 0 {
+		t.Errorf("WRITE_ZEROES with NO_HOLE should succeed, got error %d", errno)
+	}
+	h = c.cmd(cmdFlush, 0, 0, 0, nil)
+	if errno := c.simple(h); errno != 0 {
+		t.Errorf("FLUSH should succeed, got error %d", errno)
+	}
+	h = c.cmd(cmdWrite, 0, 11, 2, []byte("zz"))
+	if errno := c.simple(h); errno != errNoSpace {
+		t.Errorf("WRITE beyond the end should fail with ENOSPC, got %d", errno)
+	}
+	if got, want := contents(t, sb), "0..Axy.B...."; got != want {
+		t.Errorf("Buffer should hold %q, got %q", want, got)
+	}
+
+	c.cmd(cmdDisc, 0, 0, 0, nil)
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn should return nil after DISC, got %v", err)
+	}
+}
+
+func TestExportName(t *testing.T) {
+	sb := newBuffer()
+	c, done := serve(t, &nbd.Server{Name: "disk", Backend: sb, ReadOnly: true}, 1)
+	c.write(uint64(optMagic), uint32(optExportName), uint32(4), []byte("disk"))
+	var size uint64
+	var flags uint16
+	pad := make([]byte, 124)
+	c.read(&size, &flags, pad)
+	if size != 12 || flags&flagReadOnly == 0 {
+		t.Errorf("EXPORT_NAME should report a read-only export of size 12, got %d and flags %#x", size, flags)
+	}
+	if flags&flagSendDF != 0 {
+		t.Errorf("EXPORT_NAME should not offer DF without structured replies, got flags %#x", flags)
+	}
+
+	h := c.cmd(cmdRead, 0, 0, 12, nil)
+	if errno := c.simple(h); errno != 0 {
+		t.Fatalf("READ should succeed, got error %d", errno)
+	}
+	p := make([]byte, 12)
+	c.read(p)
+	if want := "\000\000AAA\000\000BBB\000\000"; string(p) != want {
+		t.Errorf("READ should return %q, got %q", want, p)
+	}
+	h = c.cmd(cmdWrite, 0, 0, 1, []byte("x"))
+	if errno := c.simple(h); errno != errPerm {
+		t.Errorf("WRITE to a read-only export should fail with EPERM, got %d", errno)
+	}
+	h = c.cmd(cmdBlockStatus, 0, 0, 12, nil)
+	if errno := c.simple(h); errno != errInval {
+		t.Errorf("BLOCK_STATUS without structured replies should fail with EINVAL, got %d", errno)
+	}
+	c.cmd(cmdDisc, 0, 0, 0, nil)
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn should return nil after DISC, got %v", err)
+	}
+}
+
+// syncBuffer is a Buffer counting calls to its Sync method.
+type syncBuffer struct {
+	*sparse.Buffer
+	syncs int
+}
+
+func (b *syncBuffer) Sync() error {
+	b.syncs++
+	return nil
+}
+
+func TestFUA(t *testing.T) {
+	b := &syncBuffer{Buffer: newBuffer()}
+	c, done := serve(t, &nbd.Server{Backend: b}, 3)
+	c.negotiate("")
+
+	for _, cmd := range []struct {
+		typ   uint16
+		flags uint16
+		data  []byte
+		syncs int
+	}{
+		{cmdWrite, 0, []byte("x"), 0},
+		{cmdWrite, cmdFlagFUA, []byte("x"), 1},
+		{cmdTrim, cmdFlagFUA, nil, 2},
+		{cmdWriteZeroes, cmdFlagFUA, nil, 3},
+		{cmdWriteZeroes, cmdFlagFUA | cmdFlagNoHole, nil, 4},
+		{cmdFlush, 0, nil, 5},
+	} {
+		n := len(cmd.data)
+		if cmd.data == nil && cmd.typ != cmdFlush {
+			n = 1
+		}
+		h := c.cmd(cmd.typ, cmd.flags, 0, n, cmd.data)
+		if errno := c.simple(h); errno != 0 {
+			t.Fatalf("command %d with flags %#x should succeed, got error %d", cmd.typ, cmd.flags, errno)
+		}
+		if b.syncs != cmd.syncs {
+			t.Errorf("command %d with flags %#x should leave %d calls to Sync, got %d", cmd.typ, cmd.flags, cmd.syncs, b.syncs)
+		}
+	}
+	c.cmd(cmdDisc, 0, 0, 0, nil)
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn should return nil after DISC, got %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nbd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer l.Close()
+	sb := newBuffer()
+	go (&nbd.Server{Backend: sb}).Serve(l)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	hdr := make([]byte, 18)
+	c.read(hdr)
+	c.write(uint32(3))
+	c.negotiate("")
+	h := c.cmd(cmdWrite, 0, 0, 2, []byte("hi"))
+	if errno := c.simple(h); errno != 0 {
+		t.Fatalf("WRITE should succeed, got error %d", errno)
+	}
+	h = c.cmd(cmdRead, 0, 0, 12, nil)
+	if got := readChunks(t, c.chunks(h), 0, 12); got != "hiAAA..BBB.." {
+		t.Errorf("READ should return %q, got %q", "hiAAA..BBB..", got)
+	}
+}
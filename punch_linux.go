@@ -0,0 +1,25 @@
+package sparse
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// punchHole deallocates size bytes of f at off, leaving a hole that reads as
+// zeros, without changing the size of f.
+func punchHole(f *os.File, off, size int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, off, size)
+		if err != syscall.EINTR {
+			if err != nil {
+				return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+			}
+			return nil
+		}
+	}
+}
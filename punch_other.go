@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package sparse
+
+import (
+	"os"
+)
+
+// punchHole is not supported on this platform.
+func punchHole(f *os.File, off, size int64) error {
+	return ErrPunchUnsupported
+}
@@ -66,7 +66,7 @@ func TestSimple(t *testing.T) {
 	}
 
 	if sbuf.Size() != 3 {
-		fmt.Errorf("Buffer should have 3 bytes in it, got Size of %d", sbuf.Size())
+		t.Errorf("Buffer should have 3 bytes in it, got Size of %d", sbuf.Size())
 	}
 }
 
@@ -19,10 +19,13 @@ var (
 func resolveSeekFinder(ofs int64, whence int, endPos int64, fin Finder) (nofs int64, err error) {
 	n, size, e := fin.Find(ofs)
 	if e != nil {
-		if e == io.EOF && whence == SeekHole {
-			return ofs, nil
+		if e == io.EOF {
+			if whence == SeekHole {
+				return ofs, nil
+			}
+			return 0, ErrSeekEOF
 		}
-		return 0, err
+		return 0, e
 	}
 	if whence == SeekData {
 		if n > ofs {
@@ -13,8 +13,11 @@
 // io.WriteSeeker.  It can be used similarly to bytes.Buffer but does not
 // directly implement io.Reader.
 //
-// There are no types in this package facilitating writing sparse data,
-// because io.WriteSeeker and io.WriterAt are sufficient.
+// ReadWriteFinder captures everything Buffer offers for reading and writing
+// sparse data, so that other implementations can be used in its place.
+//
+// Array applies the same approach to sparse arrays of elements of any type,
+// and Bitmap to sparse sets of bits, such as block allocation maps.
 package sparse
 
 import (
@@ -60,3 +63,19 @@ type ReadFinder interface {
 	io.Reader
 	Finder
 }
+
+// ReadWriteFinder allows reading, writing and discovery of sparse data.  It is
+// implemented by Buffer, and by other types that can be used in its place.
+type ReadWriteFinder interface {
+	Reader
+	Finder
+	io.WriterAt
+	io.WriteSeeker
+
+	// Truncate sets the size to ofs.  Data at and after ofs is deleted.
+	Truncate(ofs int64)
+
+	// PunchHole deletes any data within off:off+size, leaving a hole.  The
+	// size is unchanged.
+	PunchHole(off, size int64)
+}
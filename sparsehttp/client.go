@@ -0,0 +1,259 @@
+package sparsehttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/dnesting/sparse"
+)
+
+// DefaultFetchSize is the least a Client fetches at once, if the data extent
+// being read is large enough, so that small reads do not each need a request.
+const DefaultFetchSize = 256 * 1024
+
+// Client is a sparse.ReadFinder over data served by a Handler, or by any
+// server offering a map of the data extents and Range requests in the same
+// way.  It learns where the data lies from the map, and fetches only the
+// ranges holding data, as they are read.  Fetched data is kept in a Buffer,
+// so it is fetched only once.  With sparse.Copy, this pulls a remote sparse
+// image transferring only its data.
+//
+// Requests are made with If-Match, so a Client fails rather than mixing data
+// from different versions if the data changes on the server.
+type Client struct {
+	url    string
+	client *http.Client
+	etag   string
+	size   int64
+	es     []sparse.Extent
+
+	// FetchSize is the least fetched at once.  It is DefaultFetchSize when
+	// the Client is created.
+	FetchSize int64
+
+	mu      sync.Mutex
+	filePos int64
+	cache   sparse.Buffer
+	cached  *sparse.ReadSeeker
+	have    sparse.ExtentSet // the ranges held by cache
+	fetched int64
+}
+
+// NewClient returns a Client for the data at rawURL, fetching its map of data
+// extents using client, or http.DefaultClient if client is nil.  Any query in
+// rawURL is kept in every request.
+func NewClient(rawURL string, client *http.Client) (*Client, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := &Client{url: rawURL, client: client, FetchSize: DefaultFetchSize}
+	c.cached = sparse.NewReadSeeker(&c.cache, nil)
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += ExtentsQuery
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sparsehttp: fetching extents from %s: %s", rawURL, resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != ExtentsType {
+		return nil, fmt.Errorf("sparsehttp: %s does not serve extents, got %q", rawURL, mt)
+	}
+	var m sparse.ExtentMap
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("sparsehttp: decoding extents from %s: %v", rawURL, err)
+	}
+	last := int64(0)
+	for _, e := range m.Extents {
+		if e.Off < last || e.Len < 0 || e.End() > m.Size {
+			return nil, fmt.Errorf("sparsehttp: invalid extents from %s", rawURL)
+		}
+		last = e.End()
+		if e.Len > 0 {
+			c.es = append(c.es, e)
+		}
+	}
+	c.etag = resp.Header.Get("ETag")
+	c.size = m.Size
+	return c, nil
+}
+
+// Size returns the size of the remote data.
+func (c *Client) Size() int64 {
+	return c.size
+}
+
+// Fetched returns the number of bytes of data fetched so far.
+func (c *Client) Fetched() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetched
+}
+
+// extent returns the index of the first data extent ending after ofs.
+func (c *Client) extent(ofs int64) int {
+	return sort.Search(len(c.es), func(i int) bool { return c.es[i].End() > ofs })
+}
+
+// Find moves the file position to the data at or after ofs.  Returns io.EOF
+// if there is no data at or after ofs.
+func (c *Client) Find(ofs int64) (readerOfs, size int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.extent(ofs)
+	if i == len(c.es) {
+		return 0, 0, io.EOF
+	}
+	e := c.es[i]
+	c.filePos = ofs
+	if e.Off > ofs {
+		c.filePos = e.Off
+	}
+	return e.Off, e.Len, nil
+}
+
+// Read reads up to len(p) bytes of data at the current file position,
+// fetching it if needed.  If the file position lies within a hole, returns
+// io.EOF without reading any bytes.
+func (c *Client) Read(p []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.extent(c.filePos)
+	if i == len(c.es) || c.es[i].Off > c.filePos {
+		return 0, io.EOF
+	}
+	if max := c.es[i].End() - c.filePos; int64(len(p)) > max {
+		p = p[:max]
+	}
+	if err = c.readData(p, c.filePos, c.es[i].End()); err != nil {
+		return 0, err
+	}
+	c.filePos += int64(len(p))
+	return len(p), nil
+}
+
+// Next advances to the next segment of data after the current file position.
+// If there is no further data, advances to the end of the data.  Returns
+// io.EOF if the file position is already at or beyond the end.
+func (c *Client) Next() (skip int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := c.filePos
+	i := sort.Search(len(c.es), func(i int) bool { return c.es[i].Off > start })
+	if i < len(c.es) {
+		c.filePos = c.es[i].Off
+		return c.filePos - start, nil
+	}
+	if start >= c.size {
+		return 0, io.EOF
+	}
+	c.filePos = c.size
+	return c.size - start, nil
+}
+
+// ReadAt reads len(p) bytes at off, with holes as zeros, fetching any data
+// needed.  It does not move the file position.
+func (c *Client) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	if rem := c.size - off; int64(len(p)) > rem {
+		p = p[:rem]
+		err = io.EOF
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range p {
+		p[i] = 0
+	}
+	end := off + int64(len(p))
+	for i := c.extent(off); i < len(c.es) && c.es[i].Off < end; i++ {
+		lo, hi := c.es[i].Off, c.es[i].End()
+		if lo < off {
+			lo = off
+		}
+		if hi > end {
+			hi = end
+		}
+		if rerr := c.readData(p[lo-off:hi-off], lo, c.es[i].End()); rerr != nil {
+			return 0, rerr
+		}
+	}
+	return len(p), err
+}
+
+// readData reads len(p) bytes of data at off, which lie within a data extent
+// ending at limit, fetching any not yet held.
+func (c *Client) readData(p []byte, off, limit int64) error {
+	end := off + int64(len(p))
+	if want := off + c.FetchSize; want > end {
+		end = want
+	}
+	if end > limit {
+		end = limit
+	}
+	missing := sparse.NewExtentSet(sparse.Extent{Off: off, Len: end - off}).Subtract(&c.have)
+	for _, e := range missing.Extents() {
+		if err := c.fetch(e); err != nil {
+			return err
+		}
+	}
+	_, err := c.cached.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// fetch fetches the data in e into the cache.
+func (c *Client) fetch(e sparse.Extent) error {
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", e.Off, e.End()-1))
+	if c.etag != "" {
+		req.Header.Set("If-Match", c.etag)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("sparsehttp: fetching %d bytes at %d from %s: %s", e.Len, e.Off, c.url, resp.Status)
+	}
+	// A server may answer with a range other than the one asked for.
+	var start, last int64
+	cr := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/", &start, &last); err != nil || start != e.Off || last != e.End()-1 {
+		return fmt.Errorf("sparsehttp: fetching %d bytes at %d from %s: unexpected Content-Range %q", e.Len, e.Off, c.url, cr)
+	}
+	data := make([]byte, e.Len)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return fmt.Errorf("sparsehttp: fetching %d bytes at %d from %s: %v", e.Len, e.Off, c.url, err)
+	}
+	c.cache.StoreAt(data, e.Off)
+	c.have.Add(e)
+	c.fetched += e.Len
+	return nil
+}
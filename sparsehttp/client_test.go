@@ -0,0 +1,203 @@
+package sparsehttp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsehttp"
+	"github.com/dnesting/sparse/sparsetest"
+)
+
+// _ asserts that Client implements the sparse interfaces.
+var (
+	_ sparse.Reader     = (*sparsehttp.Client)(nil)
+	_ sparse.ReadFinder = (*sparsehttp.Client)(nil)
+)
+
+// rangeCounter counts the bytes served in response to Range requests.
+type rangeCounter struct {
+	http.Handler
+	mu    sync.Mutex
+	bytes int64
+}
+
+func (rc *rangeCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.Handler.ServeHTTP(&countingWriter{ResponseWriter: w, rc: rc}, r)
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	rc *rangeCounter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.rc.mu.Lock()
+	w.rc.bytes += int64(len(p))
+	w.rc.mu.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+func serve(t *testing.T, src sparse.ReadFinder) (*httptest.Server, *rangeCounter) {
+	h, err := sparsehttp.NewHandler(src)
+	if err != nil {
+		t.Fatalf("NewHandler should succeed, got %v", err)
+	}
+	rc := &rangeCounter{Handler: h}
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	return srv, rc
+}
+
+func newClient(t *testing.T, m *sparsetest.Model) *sparsehttp.Client {
+	var sb sparse.Buffer
+	for _, s := range m.Segments() {
+		sb.WriteAt(s.Data, s.Off)
+	}
+	sb.Truncate(m.Size())
+	srv, _ := serve(t, &sb)
+	c, err := sparsehttp.NewClient(srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("NewClient should succeed, got %v", err)
+	}
+	c.FetchSize = 3
+	return c
+}
+
+func TestClientReadFinderConformance(t *testing.T) {
+	sparsetest.TestReadFinder(t, func(t *testing.T, m *sparsetest.Model) sparse.ReadFinder {
+		m.Coalesce()
+		return newClient(t, m)
+	})
+}
+
+func TestClientReaderConformance(t *testing.T) {
+	sparsetest.TestReader(t, func(t *testing.T, m *sparsetest.Model) sparse.Reader {
+		m.Coalesce()
+		return newClient(t, m)
+	})
+}
+
+func TestClientCopy(t *testing.T) {
+	var src sparse.Buffer
+	src.WriteAt(bytes.Repeat([]byte("A"), 1000), 1<<20)
+	src.WriteAt(bytes.Repeat([]byte("B"), 500), 1<<30)
+	src.Truncate(1<<30 + 1<<20)
+	srv, rc := serve(t, &src)
+
+	c, err := sparsehttp.NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("NewClient should succeed, got %v", err)
+	}
+	if c.Size() != src.Size() {
+		t.Errorf("Size should be %d, got %d", src.Size(), c.Size())
+	}
+	rc.bytes = 0
+
+	var dst sparse.Buffer
+	if n, err := sparse.Copy(&dst, c); n != 1500 || err != nil {
+		t.Errorf("Copy should copy 1500 bytes, got %d, %v", n, err)
+	}
+	dst.Truncate(c.Size())
+	if eq, ofs, err := sparse.Equal(&src, &dst, &sparse.EqualOptions{Strict: true}); !eq || err != nil {
+		t.Errorf("Copy should produce identical data, differs at %d (err=%v)", ofs, err)
+	}
+	if rc.bytes != 1500 || c.Fetched() != 1500 {
+		t.Errorf("only the data should be fetched, got %d bytes served and %d fetched", rc.bytes, c.Fetched())
+	}
+
+	// Data already fetched is not fetched again.
+	p := make([]byte, 10)
+	if n, err := c.ReadAt(p, 1<<20-5); n != 10 || err != nil || string(p) != "\000\000\000\000\000AAAAA" {
+		t.Errorf("ReadAt should read zeros then data, got %d, %v, %q", n, err, p)
+	}
+	if rc.bytes != 1500 {
+		t.Errorf("cached data should not be fetched again, got %d bytes served", rc.bytes)
+	}
+}
+
+func TestClientChanged(t *testing.T) {
+	var src sparse.Buffer
+	src.WriteAt([]byte("AAAA"), 0)
+	h, _ := sparsehttp.NewHandler(&src)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c, err := sparsehttp.NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("NewClient should succeed, got %v", err)
+	}
+	mu.Lock()
+	src.WriteAt([]byte("B"), 0)
+	h, _ = sparsehttp.NewHandler(&src)
+	mu.Unlock()
+	if _, err := ioutil.ReadAll(sparse.NewReader(c, nil)); err == nil || !strings.Contains(err.Error(), "412") {
+		t.Errorf("reading data changed on the server should fail with 412, got %v", err)
+	}
+}
+
+func TestNewClientNotSparse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer srv.Close()
+	if _, err := sparsehttp.NewClient(srv.URL, nil); err == nil {
+		t.Errorf("NewClient should fail for a server not serving extents")
+	}
+}
+
+func TestNewClientQuery(t *testing.T) {
+	var src sparse.Buffer
+	src.WriteAt([]byte("AAAA"), 10)
+	h, _ := sparsehttp.NewHandler(&src)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "x" {
+			http.Error(w, "no token", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c, err := sparsehttp.NewClient(srv.URL+"/data?token=x", nil)
+	if err != nil {
+		t.Fatalf("NewClient should keep the query of the URL, got %v", err)
+	}
+	if got, err := ioutil.ReadAll(sparse.NewReader(c, nil)); err != nil || string(got) != "\000\000\000\000\000\000\000\000\000\000AAAA" {
+		t.Errorf("reading should keep the query of the URL, got %q, %v", got, err)
+	}
+}
+
+func TestClientContentRange(t *testing.T) {
+	var src sparse.Buffer
+	src.WriteAt([]byte("AAAABBBB"), 0)
+	h, _ := sparsehttp.NewHandler(&src)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve the range after the one asked for.
+		if r.Header.Get("Range") == "bytes=0-3" {
+			r.Header.Set("Range", "bytes=4-7")
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c, err := sparsehttp.NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("NewClient should succeed, got %v", err)
+	}
+	c.FetchSize = 4
+	p := make([]byte, 4)
+	if _, err := c.ReadAt(p, 0); err == nil || !strings.Contains(err.Error(), "Content-Range") {
+		t.Errorf("ReadAt should fail when the server sends another range, got %v, %q", err, p)
+	}
+}
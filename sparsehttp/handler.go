@@ -0,0 +1,119 @@
+// Package sparsehttp serves sparse data over HTTP, and fetches it again,
+// transferring only the data and not the holes.
+//
+// A Handler serves the content of a sparse.ReadFinder, with holes read as
+// zeros, supporting Range requests as http.ServeContent does.  Sparse-aware
+// clients, such as a Client, can also fetch a map of the data extents, by
+// adding the query parameter "extents" to the URL, and then request only the
+// ranges holding data.
+package sparsehttp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dnesting/sparse"
+)
+
+// ExtentsQuery is the query parameter that asks a Handler for a map of the
+// data extents, as a sparse.ExtentMap rendered as JSON, in place of the
+// content.
+const ExtentsQuery = "extents"
+
+// ExtentsType is the content type of the map of data extents.
+const ExtentsType = "application/vnd.sparse.extents+json"
+
+// Handler is an http.Handler serving sparse data.  The data should not change
+// while it is being served, since the ETag is computed from its content when
+// the Handler is created.
+type Handler struct {
+	mu   sync.Mutex // guards the file position of src
+	src  sparse.ReadFinder
+	rs   *sparse.ReadSeeker
+	size int64
+	etag string
+}
+
+// NewHandler returns a Handler serving src.  The ETag is the root hash of a
+// sparse.Tree over src, so computing it takes time proportional to the data
+// held by src, not to its size.  This will move the file position of src.
+func NewHandler(src sparse.ReadFinder) (*Handler, error) {
+	t, err := sparse.NewTree(src, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{
+		src:  src,
+		rs:   sparse.NewReadSeeker(src, nil),
+		size: src.Size(),
+		etag: `"` + hex.EncodeToString(t.Root()[:16]) + `"`,
+	}, nil
+}
+
+// ETag returns the entity tag served with the content.
+func (h *Handler) ETag() string {
+	return h.etag
+}
+
+// content reads the content served by a Handler, with holes as zeros.
+type content Handler
+
+func (h *content) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= h.size {
+		return 0, io.EOF
+	}
+	if rem := h.size - off; int64(len(p)) > rem {
+		p = p[:rem]
+		err = io.EOF
+	}
+	h.mu.Lock()
+	n, rerr := h.rs.ReadAt(p, off)
+	h.mu.Unlock()
+	if rerr != nil && rerr != io.EOF {
+		return n, rerr
+	}
+	// The ReadSeeker stops at the end of the data, before any trailing hole.
+	for ; n < len(p); n++ {
+		p[n] = 0
+	}
+	return n, err
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("ETag", h.etag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if _, ok := r.URL.Query()[ExtentsQuery]; ok {
+		h.serveExtents(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader((*content)(h), 0, h.size))
+}
+
+func (h *Handler) serveExtents(w http.ResponseWriter, r *http.Request) {
+	if match := r.Header.Get("If-None-Match"); match != "" && match == h.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.mu.Lock()
+	m, err := sparse.MapOf(h.src)
+	h.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ExtentsType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	json.NewEncoder(w).Encode(m)
+}
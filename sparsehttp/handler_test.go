@@ -0,0 +1,168 @@
+package sparsehttp_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsehttp"
+)
+
+// newServer serves a Buffer holding "..AAA..BBB.." with holes as dots.
+func newServer(t *testing.T) (*httptest.Server, *sparsehttp.Handler) {
+	var sb sparse.Buffer
+	sb.WriteAt([]byte("AAA"), 2)
+	sb.WriteAt([]byte("BBB"), 7)
+	sb.Truncate(12)
+	h, err := sparsehttp.NewHandler(&sb)
+	if err != nil {
+		t.Fatalf("NewHandler should succeed, got %v", err)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv, h
+}
+
+func get(t *testing.T, url string, header ...string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func printable(b []byte) string {
+	return strings.Replace(string(b), "\000", ".", -1)
+}
+
+func TestHandler(t *testing.T) {
+	srv, h := newServer(t)
+
+	resp, body := get(t, srv.URL)
+	if resp.StatusCode != http.StatusOK || printable(body) != "..AAA..BBB.." {
+		t.Errorf("GET should return 200 and ..AAA..BBB.., got %d and %q", resp.StatusCode, printable(body))
+	}
+	if etag := resp.Header.Get("ETag"); etag == "" || etag != h.ETag() {
+		t.Errorf("GET should return ETag %s, got %q", h.ETag(), etag)
+	}
+
+	resp, body = get(t, srv.URL, "Range", "bytes=3-8")
+	if resp.StatusCode != http.StatusPartialContent || printable(body) != "AA..BB" {
+		t.Errorf("GET of a range should return 206 and AA..BB, got %d and %q", resp.StatusCode, printable(body))
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 3-8/12" {
+		t.Errorf("GET of a range should return Content-Range bytes 3-8/12, got %q", cr)
+	}
+
+	// Ranges in the trailing hole read as zeros.
+	resp, body = get(t, srv.URL, "Range", "bytes=-3")
+	if resp.StatusCode != http.StatusPartialContent || printable(body) != "B.." {
+		t.Errorf("GET of a suffix range should return 206 and B.., got %d and %q", resp.StatusCode, printable(body))
+	}
+
+	resp, _ = get(t, srv.URL, "If-None-Match", h.ETag())
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with a matching If-None-Match should return 304, got %d", resp.StatusCode)
+	}
+
+	resp, _ = get(t, srv.URL, "Range", "bytes=20-30")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("GET of a range beyond the end should return 416, got %d", resp.StatusCode)
+	}
+
+	resp, err := http.Post(srv.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST should return 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerMultiRange(t *testing.T) {
+	srv, _ := newServer(t)
+	resp, body := get(t, srv.URL, "Range", "bytes=0-3,8-11")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("GET of two ranges should return 206, got %d", resp.StatusCode)
+	}
+	mt, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("GET of two ranges should return multipart/byteranges, got %q (%v)", mt, err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+" "+printable(data))
+	}
+	want := []string{"bytes 0-3/12 ..AA", "bytes 8-11/12 BB.."}
+	if !reflect.DeepEqual(parts, want) {
+		t.Errorf("GET of two ranges should return parts %q, got %q", want, parts)
+	}
+}
+
+func TestHandlerExtents(t *testing.T) {
+	srv, h := newServer(t)
+	resp, body := get(t, srv.URL+"?"+sparsehttp.ExtentsQuery)
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != sparsehttp.ExtentsType {
+		t.Fatalf("GET of extents should return 200 and %s, got %d and %s", sparsehttp.ExtentsType, resp.StatusCode, ct)
+	}
+	var m sparse.ExtentMap
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("GET of extents should return JSON, got %v", err)
+	}
+	want := sparse.ExtentMap{Size: 12, DataBytes: 6, HoleBytes: 6, Extents: []sparse.Extent{{Off: 2, Len: 3}, {Off: 7, Len: 3}}}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("GET of extents should return %+v, got %+v", want, m)
+	}
+	if etag := resp.Header.Get("ETag"); etag != h.ETag() {
+		t.Errorf("GET of extents should return ETag %s, got %q", h.ETag(), etag)
+	}
+}
+
+func TestHandlerETag(t *testing.T) {
+	// The ETag depends on content, not on how it is stored.
+	var a, b sparse.Buffer
+	a.WriteAt([]byte("AAA"), 2)
+	a.Truncate(12)
+	b.WriteAt([]byte("\000\000AAA\000"), 0)
+	b.Truncate(12)
+	ha, _ := sparsehttp.NewHandler(&a)
+	hb, _ := sparsehttp.NewHandler(&b)
+	if ha.ETag() != hb.ETag() {
+		t.Errorf("the same content should have the same ETag, got %s and %s", ha.ETag(), hb.ETag())
+	}
+	b.WriteAt([]byte("B"), 11)
+	if hb, _ = sparsehttp.NewHandler(&b); ha.ETag() == hb.ETag() {
+		t.Errorf("different content should have different ETags")
+	}
+}
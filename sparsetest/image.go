@@ -0,0 +1,85 @@
+package sparsetest
+
+import (
+	"github.com/dnesting/sparse"
+)
+
+// image is a trivially correct, dense model of sparse data, against which
+// implementations are compared.
+type image struct {
+	data []byte
+	mask []bool // whether each byte of data is data rather than a hole
+	size int64
+}
+
+func (m *image) grow(n int64) {
+	if n > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, n-int64(len(m.data)))...)
+		m.mask = append(m.mask, make([]bool, n-int64(len(m.mask)))...)
+	}
+	if n > m.size {
+		m.size = n
+	}
+}
+
+func (m *image) writeAt(p []byte, off int64) {
+	m.grow(off + int64(len(p)))
+	copy(m.data[off:], p)
+	for i := range p {
+		m.mask[off+int64(i)] = true
+	}
+}
+
+func (m *image) truncate(ofs int64) {
+	m.grow(ofs)
+	for i := ofs; i < int64(len(m.data)); i++ {
+		m.data[i], m.mask[i] = 0, false
+	}
+	m.size = ofs
+}
+
+func (m *image) punchHole(off, size int64) {
+	for i := off; i < off+size && i < m.size; i++ {
+		m.data[i], m.mask[i] = 0, false
+	}
+}
+
+// extents returns the extents of data in the image, with adjacent extents
+// coalesced.
+func (m *image) extents() (es []sparse.Extent) {
+	for i := int64(0); i < m.size; i++ {
+		if !m.mask[i] {
+			continue
+		}
+		j := i
+		for j < m.size && m.mask[j] {
+			j++
+		}
+		es = append(es, sparse.Extent{Off: i, Len: j - i})
+		i = j
+	}
+	return
+}
+
+// dense returns the content of the image with holes as zeros.
+func (m *image) dense() []byte {
+	return m.data[:m.size]
+}
+
+// seekData returns the first offset at or after ofs holding data, or -1.
+func (m *image) seekData(ofs int64) int64 {
+	for i := ofs; i < m.size; i++ {
+		if m.mask[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// seekHole returns the first offset at or after ofs not holding data.
+func (m *image) seekHole(ofs int64) int64 {
+	for ofs < m.size && m.mask[ofs] {
+		ofs++
+	}
+	return ofs
+}
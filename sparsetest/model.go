@@ -0,0 +1,127 @@
+package sparsetest
+
+import (
+	"fmt"
+	"io"
+)
+
+// Segment is a segment of data at an offset, which may be zero-length.
+type Segment struct {
+	Off  int64
+	Data []byte
+}
+
+// End returns the offset just after the segment.
+func (s Segment) End() int64 { return s.Off + int64(len(s.Data)) }
+
+// Model is a reference implementation of sparse.Reader and sparse.Finder over
+// a fixed layout of segments.  Implementations are tested by comparing their
+// behavior with that of a Model holding the same layout.
+type Model struct {
+	segs []Segment
+	size int64
+	pos  int64
+}
+
+// NewModel returns a Model of size bytes holding segs, which must be in order
+// and must not overlap.  If the last segment ends beyond size, the size is
+// extended to include it.
+func NewModel(size int64, segs ...Segment) *Model {
+	m := &Model{segs: segs, size: size}
+	for i, s := range segs {
+		if s.Off < 0 || (i > 0 && s.Off < segs[i-1].End()) {
+			panic(fmt.Sprintf("sparsetest: segment %d at %d is out of order or overlaps", i, s.Off))
+		}
+		if s.End() > m.size {
+			m.size = s.End()
+		}
+	}
+	return m
+}
+
+// Segments returns the segments held by m.
+func (m *Model) Segments() []Segment {
+	return m.segs
+}
+
+// Coalesce merges adjacent segments and removes zero-length ones.  Factories
+// for implementations that do not preserve segment boundaries can call this
+// on the Model they are given, so that their results can be compared.
+func (m *Model) Coalesce() {
+	var segs []Segment
+	for _, s := range m.segs {
+		if len(s.Data) == 0 {
+			continue
+		}
+		if n := len(segs); n > 0 && segs[n-1].End() == s.Off {
+			segs[n-1].Data = append(append([]byte(nil), segs[n-1].Data...), s.Data...)
+			continue
+		}
+		segs = append(segs, s)
+	}
+	m.segs = segs
+}
+
+// Bytes returns the content of m, with holes as zeros.
+func (m *Model) Bytes() []byte {
+	b := make([]byte, m.size)
+	for _, s := range m.segs {
+		copy(b[s.Off:], s.Data)
+	}
+	return b
+}
+
+// Size returns the size of m.
+func (m *Model) Size() int64 {
+	return m.size
+}
+
+// Find moves the position to the first byte of data at or after ofs, and
+// returns the start and size of the segment containing it.  Zero-length
+// segments are never found.  Returns io.EOF without moving the position if
+// there is no data at or after ofs.
+func (m *Model) Find(ofs int64) (readerOfs, size int64, err error) {
+	for _, s := range m.segs {
+		if len(s.Data) > 0 && ofs < s.End() {
+			m.pos = ofs
+			if s.Off > ofs {
+				m.pos = s.Off
+			}
+			return s.Off, int64(len(s.Data)), nil
+		}
+	}
+	return 0, 0, io.EOF
+}
+
+// Read reads up to len(p) bytes from the segment at the position, stopping at
+// its end even if the next segment is adjacent.  Returns io.EOF if the
+// position does not lie within data.
+func (m *Model) Read(p []byte) (n int, err error) {
+	for _, s := range m.segs {
+		if s.Off <= m.pos && m.pos < s.End() {
+			n = copy(p, s.Data[m.pos-s.Off:])
+			m.pos += int64(n)
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// Next moves the position to the start of the first segment, including
+// zero-length segments, beginning after the position.  If there is none, it
+// moves to the end of m.  Returns io.EOF if the position is already at or
+// beyond the end.
+func (m *Model) Next() (skip int64, err error) {
+	start := m.pos
+	for _, s := range m.segs {
+		if s.Off > start {
+			m.pos = s.Off
+			return m.pos - start, nil
+		}
+	}
+	if start < m.size {
+		m.pos = m.size
+		return m.size - start, nil
+	}
+	return 0, io.EOF
+}
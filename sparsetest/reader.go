@@ -0,0 +1,251 @@
+package sparsetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+// layouts are the layouts of sparse data that implementations are tested
+// with, covering the edge cases of the Reader and Finder semantics.
+var layouts = []struct {
+	name string
+	size int64
+	segs []Segment
+}{
+	{"Empty", 0, nil},
+	{"Hole", 10, nil},
+	{"Data", 5, []Segment{{0, []byte("ABCDE")}}},
+	{"LeadingHole", 8, []Segment{{3, []byte("ABCDE")}}},
+	{"TrailingHole", 10, []Segment{{0, []byte("ABC")}}},
+	{"Gaps", 20, []Segment{{2, []byte("AB")}, {6, []byte("CDE")}, {15, []byte("F")}}},
+	{"Adjacent", 9, []Segment{{0, []byte("ABC")}, {3, []byte("DEF")}, {6, []byte("GHI")}}},
+	{"ZeroLength", 10, []Segment{{2, nil}, {4, []byte("AB")}, {7, nil}}},
+	{"ZeroLengthOnly", 5, []Segment{{3, nil}}},
+	{"ZeroLengthAfterData", 8, []Segment{{0, []byte("AB")}, {2, nil}, {5, []byte("C")}}},
+	{"ZeroLengthAtEnd", 6, []Segment{{0, []byte("AB")}, {6, nil}}},
+	// Holes of whole blocks, which file systems can hold.
+	{"BlockHoles", 4 * blockSize, []Segment{{blockSize, blockOf('A')}, {3 * blockSize, blockOf('B')}}},
+}
+
+// blockSize is the size of the blocks of the BlockHoles layout, a common size
+// of file system blocks.
+const blockSize = 4096
+
+func blockOf(c byte) []byte {
+	return bytes.Repeat([]byte{c}, blockSize)
+}
+
+// forEachLayout runs fn as a subtest for each layout, with a new Model for
+// it.
+func forEachLayout(t *testing.T, fn func(t *testing.T, m *Model)) {
+	for _, l := range layouts {
+		l := l
+		t.Run(l.name, func(t *testing.T) {
+			fn(t, NewModel(l.size, l.segs...))
+		})
+	}
+}
+
+func closeIfCloser(v interface{}) {
+	if c, ok := v.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// TestReader runs conformance tests against Reader implementations.
+// newReader should return a new instance holding the same layout as m,
+// positioned at 0.  If the implementation cannot represent the layout
+// exactly, newReader may adjust m (such as with m.Coalesce) or skip the test
+// with t.Skip.  If the instance implements io.Closer, it is closed at the end
+// of each test.
+func TestReader(t *testing.T, newReader func(t *testing.T, m *Model) sparse.Reader) {
+	t.Run("Stream", func(t *testing.T) {
+		forEachLayout(t, func(t *testing.T, m *Model) {
+			r := newReader(t, m)
+			defer closeIfCloser(r)
+			got, err := ioutil.ReadAll(sparse.NewReader(r, nil))
+			if err != nil {
+				t.Errorf("reading with NewReader returned error %v", err)
+			} else if want := m.Bytes(); !bytes.Equal(got, want) {
+				t.Errorf("reading with NewReader should return %q, got %q", want, got)
+			}
+		})
+	})
+	for _, n := range []int{1, 2, 100} {
+		n := n
+		t.Run(fmt.Sprintf("Walk%d", n), func(t *testing.T) {
+			forEachLayout(t, func(t *testing.T, m *Model) {
+				r := newReader(t, m)
+				defer closeIfCloser(r)
+				testWalk(t, r, m, n)
+			})
+		})
+	}
+	t.Run("Random", func(t *testing.T) {
+		forEachLayout(t, func(t *testing.T, m *Model) {
+			r := newReader(t, m)
+			defer closeIfCloser(r)
+			testRandomReads(t, r, m, nil)
+		})
+	})
+}
+
+// compareRead calls Read on r and m with n-byte buffers, and reports whether
+// the results match and whether Read returned io.EOF.
+func compareRead(t *testing.T, r io.Reader, m *Model, n int, desc string) (ok, eof bool) {
+	t.Helper()
+	got, want := make([]byte, n), make([]byte, n)
+	gotN, gotErr := r.Read(got)
+	wantN, wantErr := m.Read(want)
+	if gotN != wantN || gotErr != wantErr || !bytes.Equal(got[:gotN], want[:wantN]) {
+		t.Errorf("%s: Read should return %q, %v, got %q, %v", desc, want[:wantN], wantErr, got[:gotN], gotErr)
+		return false, false
+	}
+	return true, wantErr == io.EOF
+}
+
+// compareNext calls Next on r and m, and reports whether the results match.
+func compareNext(t *testing.T, r sparse.Reader, m *Model, desc string) (ok, eof bool) {
+	t.Helper()
+	gotSkip, gotErr := r.Next()
+	wantSkip, wantErr := m.Next()
+	if gotSkip != wantSkip || gotErr != wantErr {
+		t.Errorf("%s: Next should return %d, %v, got %d, %v", desc, wantSkip, wantErr, gotSkip, gotErr)
+		return false, false
+	}
+	return true, wantErr == io.EOF
+}
+
+// testWalk reads through r with n-byte reads, calling Next whenever Read
+// returns io.EOF, until Next returns io.EOF.
+func testWalk(t *testing.T, r sparse.Reader, m *Model, n int) {
+	// Each step reads at least a byte or moves to the next segment.
+	for i := 0; i < 1000+int(m.Size()); i++ {
+		desc := fmt.Sprintf("step %d", i)
+		ok, eof := compareRead(t, r, m, n, desc)
+		if !ok {
+			return
+		}
+		if !eof {
+			continue
+		}
+		if ok, eof = compareNext(t, r, m, desc); !ok {
+			return
+		}
+		if eof {
+			// The end of the stream should stay the end.
+			if ok, _ := compareRead(t, r, m, n, "after EOF"); ok {
+				compareNext(t, r, m, "after EOF")
+			}
+			return
+		}
+	}
+	t.Errorf("Next never returned io.EOF")
+}
+
+// testRandomReads compares r with m over a random series of calls to Read,
+// Next and, if f is non-nil, f.Find.
+func testRandomReads(t *testing.T, r sparse.Reader, m *Model, f sparse.Finder) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		desc := fmt.Sprintf("step %d", i)
+		switch n := rnd.Intn(4); {
+		case n == 0:
+			if ok, _ := compareNext(t, r, m, desc); !ok {
+				return
+			}
+		case n == 1 && f != nil:
+			if ok, _ := compareFind(t, f, m, rnd.Int63n(m.Size()+2)); !ok {
+				return
+			}
+		default:
+			if ok, _ := compareRead(t, r, m, rnd.Intn(4)+1, desc); !ok {
+				return
+			}
+		}
+	}
+}
+
+// compareFind calls Find(ofs) on f and m, and reports whether the results
+// match and whether data was found.  Implementations that cannot tell where a
+// segment begins may report ofs as its start.
+func compareFind(t *testing.T, f sparse.Finder, m *Model, ofs int64) (ok, found bool) {
+	t.Helper()
+	gotOfs, gotSize, gotErr := f.Find(ofs)
+	wantOfs, wantSize, wantErr := m.Find(ofs)
+	if gotErr != wantErr {
+		t.Errorf("Find(%d) should return error %v, got %v", ofs, wantErr, gotErr)
+		return false, false
+	}
+	if wantErr != nil {
+		return true, false
+	}
+	pos := ofs
+	if wantOfs > pos {
+		pos = wantOfs
+	}
+	if gotOfs < wantOfs || gotOfs > pos || gotOfs+gotSize != wantOfs+wantSize {
+		t.Errorf("Find(%d) should return %d, %d, got %d, %d", ofs, wantOfs, wantSize, gotOfs, gotSize)
+		return false, false
+	}
+	return true, true
+}
+
+// TestReadFinder runs conformance tests against ReadFinder implementations.
+// newRF should return a new instance holding the same layout as m, as with
+// TestReader.  If the instance also implements sparse.Reader, random series
+// of calls to Find, Read and Next are tested as well.
+func TestReadFinder(t *testing.T, newRF func(t *testing.T, m *Model) sparse.ReadFinder) {
+	t.Run("Extents", func(t *testing.T) {
+		forEachLayout(t, func(t *testing.T, m *Model) {
+			rf := newRF(t, m)
+			defer closeIfCloser(rf)
+			if got := rf.Size(); got != m.Size() {
+				t.Errorf("Size should return %d, got %d", m.Size(), got)
+			}
+			var want []sparse.Extent
+			for _, s := range m.Segments() {
+				if len(s.Data) > 0 {
+					want = append(want, sparse.Extent{Off: s.Off, Len: int64(len(s.Data))})
+				}
+			}
+			got, err := sparse.Extents(rf)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("Extents should return %v, got %v, %v", want, got, err)
+			}
+		})
+	})
+	t.Run("Find", func(t *testing.T) {
+		forEachLayout(t, func(t *testing.T, m *Model) {
+			rf := newRF(t, m)
+			defer closeIfCloser(rf)
+			for ofs := int64(0); ofs <= m.Size()+1; ofs++ {
+				ok, found := compareFind(t, rf, m, ofs)
+				if ok && found {
+					ok, _ = compareRead(t, rf, m, int(m.Size()), fmt.Sprintf("after Find(%d)", ofs))
+				}
+				if !ok {
+					return
+				}
+			}
+		})
+	})
+	t.Run("Random", func(t *testing.T) {
+		forEachLayout(t, func(t *testing.T, m *Model) {
+			rf := newRF(t, m)
+			defer closeIfCloser(rf)
+			r, ok := rf.(sparse.Reader)
+			if !ok {
+				t.Skip("not a sparse.Reader")
+			}
+			testRandomReads(t, r, m, rf)
+		})
+	})
+}
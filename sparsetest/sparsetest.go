@@ -0,0 +1,291 @@
+// Package sparsetest provides conformance tests for implementations of the
+// interfaces in package sparse.
+//
+// TestReader and TestReadFinder compare an implementation holding a fixed
+// layout of data with a Model, the reference implementation, holding the same
+// layout.  TestReadWriteFinder checks that writes leave an implementation
+// holding what they should.  An implementation's tests can run a suite with
+// something like:
+//
+//	func TestConformance(t *testing.T) {
+//		sparsetest.TestReadWriteFinder(t, func(t *testing.T) sparse.ReadWriteFinder {
+//			return NewMyBuffer()
+//		})
+//	}
+package sparsetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+// coalesce merges adjacent extents, since implementations are free to
+// represent adjacent data as one extent or several.
+func coalesce(es []sparse.Extent) (out []sparse.Extent) {
+	for _, e := range es {
+		if n := len(out); n > 0 && out[n-1].End() == e.Off {
+			out[n-1].Len += e.Len
+		} else {
+			out = append(out, e)
+		}
+	}
+	return
+}
+
+// check verifies that rf holds the same content and layout as m.  desc
+// describes how rf came to be, for error messages.
+func check(t *testing.T, rf sparse.ReadFinder, m *image, desc func() string) bool {
+	t.Helper()
+	if got := rf.Size(); got != m.size {
+		t.Errorf("Size should return %d, got %d after:\n%s", m.size, got, desc())
+		return false
+	}
+	es, err := sparse.Extents(rf)
+	if err != nil {
+		t.Errorf("Find returned error %v after:\n%s", err, desc())
+		return false
+	}
+	if got, want := coalesce(es), m.extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("extents should be %v, got %v after:\n%s", want, got, desc())
+		return false
+	}
+	for _, e := range es {
+		got := make([]byte, e.Len)
+		if ofs, _, err := rf.Find(e.Off); ofs > e.Off || err != nil {
+			t.Errorf("Find(%d) should find data, got %d, %v after:\n%s", e.Off, ofs, err, desc())
+			return false
+		}
+		if n, err := io.ReadFull(rf, got); err != nil {
+			t.Errorf("Read of %d bytes at %d should succeed, got %d, %v after:\n%s", e.Len, e.Off, n, err, desc())
+			return false
+		}
+		if want := m.data[e.Off:e.End()]; !bytes.Equal(got, want) {
+			t.Errorf("Read at %d should return %q, got %q after:\n%s", e.Off, want, got, desc())
+			return false
+		}
+	}
+	return true
+}
+
+// checkReader verifies that reading r from the start as a stream produces
+// the same content as m.  r must be positioned at 0.
+func checkReader(t *testing.T, r sparse.Reader, m *image, desc func() string) bool {
+	t.Helper()
+	got, err := ioutil.ReadAll(sparse.NewReader(r, nil))
+	if err != nil {
+		t.Errorf("reading with NewReader returned error %v after:\n%s", err, desc())
+		return false
+	}
+	if want := m.dense(); !bytes.Equal(got, want) {
+		t.Errorf("reading with NewReader should return %q, got %q after:\n%s", want, got, desc())
+		return false
+	}
+	return true
+}
+
+// TestReadWriteFinder runs conformance tests against ReadWriteFinder
+// implementations.  newRWF should return a new, empty instance each time it
+// is called.  If the instance implements io.Closer, it is closed at the end
+// of each test.
+func TestReadWriteFinder(t *testing.T, newRWF func(t *testing.T) sparse.ReadWriteFinder) {
+	run := func(name string, fn func(t *testing.T, rwf sparse.ReadWriteFinder)) {
+		t.Run(name, func(t *testing.T) {
+			rwf := newRWF(t)
+			if c, ok := rwf.(io.Closer); ok {
+				defer c.Close()
+			}
+			fn(t, rwf)
+		})
+	}
+	run("Empty", testEmpty)
+	run("WriteAt", testWriteAt)
+	run("Truncate", testTruncate)
+	run("PunchHole", testPunchHole)
+	run("WriteSeek", testWriteSeek)
+	run("Random", testRandom)
+}
+
+func testEmpty(t *testing.T, rwf sparse.ReadWriteFinder) {
+	if rwf.Size() != 0 {
+		t.Errorf("Size should return 0, got %d", rwf.Size())
+	}
+	if ofs, size, err := rwf.Find(0); err != io.EOF {
+		t.Errorf("Find(0) should return io.EOF, got %d, %d, %v", ofs, size, err)
+	}
+	if n, err := rwf.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read should return 0, io.EOF, got %d, %v", n, err)
+	}
+	if skip, err := rwf.Next(); skip != 0 || err != io.EOF {
+		t.Errorf("Next should return 0, io.EOF, got %d, %v", skip, err)
+	}
+}
+
+// op is a single operation applied to both an implementation and its image.
+type op struct {
+	desc  string
+	apply func(rwf sparse.ReadWriteFinder, m *image)
+}
+
+func writeAt(s string, off int64) op {
+	return op{fmt.Sprintf("WriteAt(%q, %d)", s, off), func(rwf sparse.ReadWriteFinder, m *image) {
+		rwf.WriteAt([]byte(s), off)
+		m.writeAt([]byte(s), off)
+	}}
+}
+
+func truncate(ofs int64) op {
+	return op{fmt.Sprintf("Truncate(%d)", ofs), func(rwf sparse.ReadWriteFinder, m *image) {
+		rwf.Truncate(ofs)
+		m.truncate(ofs)
+	}}
+}
+
+func punchHole(off, size int64) op {
+	return op{fmt.Sprintf("PunchHole(%d, %d)", off, size), func(rwf sparse.ReadWriteFinder, m *image) {
+		rwf.PunchHole(off, size)
+		m.punchHole(off, size)
+	}}
+}
+
+// runOps applies ops in order, checking the implementation after each.
+func runOps(t *testing.T, rwf sparse.ReadWriteFinder, ops ...op) {
+	t.Helper()
+	var m image
+	for i, o := range ops {
+		o.apply(rwf, &m)
+		desc := func() string {
+			var s []string
+			start := 0
+			if i >= 20 {
+				// Show only the most recent operations.
+				start = i - 19
+				s = append(s, fmt.Sprintf("  (%d earlier operations)", start))
+			}
+			for _, o := range ops[start : i+1] {
+				s = append(s, "  "+o.desc)
+			}
+			return strings.Join(s, "\n")
+		}
+		if !check(t, rwf, &m, desc) {
+			return
+		}
+		rwf.Seek(0, io.SeekStart)
+		if !checkReader(t, rwf, &m, desc) {
+			return
+		}
+	}
+}
+
+func testWriteAt(t *testing.T, rwf sparse.ReadWriteFinder) {
+	// Writes overlapping and adjacent to existing data on either side.
+	runOps(t, rwf,
+		writeAt("AAA", 5),
+		writeAt("BBB", 13),
+		writeAt("CC", 0),
+		writeAt("DD", 3),
+		writeAt("EEE", 7),
+		writeAt("FFF", 10),
+		writeAt("G", 16),
+		writeAt("HHHHHHHHHHHHHHHHHHHH", 1),
+		writeAt("I", 30),
+	)
+}
+
+func testTruncate(t *testing.T, rwf sparse.ReadWriteFinder) {
+	runOps(t, rwf,
+		truncate(3),
+		writeAt("AAA", 5),
+		writeAt("BBB", 10),
+		truncate(20),
+		truncate(11),
+		truncate(9),
+		truncate(6),
+		writeAt("CCC", 8),
+		truncate(0),
+	)
+}
+
+func testPunchHole(t *testing.T, rwf sparse.ReadWriteFinder) {
+	runOps(t, rwf,
+		writeAt("AAAAAAAAAA", 0),
+		writeAt("BBBBBBBBBB", 15),
+		punchHole(3, 2),
+		punchHole(0, 1),
+		punchHole(9, 8),
+		punchHole(23, 10),
+		punchHole(40, 5),
+		writeAt("CCC", 3),
+		punchHole(0, 30),
+	)
+}
+
+func testWriteSeek(t *testing.T, rwf sparse.ReadWriteFinder) {
+	var m image
+	pos := int64(0)
+	write := func(s string) {
+		n, err := rwf.Write([]byte(s))
+		if n != len(s) || err != nil {
+			t.Fatalf("Write(%q) should return %d, nil, got %d, %v", s, len(s), n, err)
+		}
+		m.writeAt([]byte(s), pos)
+		pos += int64(len(s))
+	}
+	seek := func(ofs int64, whence int) {
+		got, err := rwf.Seek(ofs, whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d) returned error %v", ofs, whence, err)
+		}
+		pos = got
+	}
+	write("AAA")
+	seek(2, io.SeekCurrent)
+	write("BBB")
+	seek(10, io.SeekStart)
+	write("CC")
+	seek(2, io.SeekEnd)
+	write("D")
+	desc := func() string { return "a series of Seek and Write calls" }
+	if !check(t, rwf, &m, desc) {
+		return
+	}
+
+	for ofs := int64(0); ofs <= m.size+1; ofs++ {
+		got, err := rwf.Seek(ofs, sparse.SeekData)
+		if want := m.seekData(ofs); want < 0 {
+			if err == nil {
+				t.Errorf("Seek(%d, SeekData) should fail, got %d", ofs, got)
+			}
+		} else if got != want || err != nil {
+			t.Errorf("Seek(%d, SeekData) should return %d, got %d, %v", ofs, want, got, err)
+		}
+		got, err = rwf.Seek(ofs, sparse.SeekHole)
+		if want := m.seekHole(ofs); got != want || err != nil {
+			t.Errorf("Seek(%d, SeekHole) should return %d, got %d, %v", ofs, want, got, err)
+		}
+	}
+}
+
+func testRandom(t *testing.T, rwf sparse.ReadWriteFinder) {
+	r := rand.New(rand.NewSource(1))
+	var ops []op
+	for i := 0; i < 1000; i++ {
+		off := r.Int63n(64)
+		switch r.Intn(8) {
+		case 0:
+			ops = append(ops, truncate(off))
+		case 1:
+			ops = append(ops, punchHole(off, r.Int63n(20)+1))
+		default:
+			ops = append(ops, writeAt(strings.Repeat(string(rune('A'+i%26)), r.Intn(16)+1), off))
+		}
+	}
+	runOps(t, rwf, ops...)
+}
@@ -0,0 +1,165 @@
+package sparse
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// SpillStore is a backing store for segment data that a Buffer cannot keep in
+// memory.  The Buffer writes to it at increasing offsets, starting at 0, and
+// reads back only what it has written.
+type SpillStore interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// spillStore tracks a SpillStore and how it is being used.
+type spillStore struct {
+	SpillStore
+	next int64    // offset of the next write
+	used int64    // bytes currently referenced by segments
+	tmp  *os.File // if we created the store ourselves
+}
+
+// spilled is coldData held in a spillStore.
+type spilled struct {
+	store *spillStore
+	off   int64
+	n     int
+}
+
+func (s *spilled) size() int { return s.n }
+
+func (s *spilled) readAt(p []byte, off int64) (int, error) {
+	return s.store.ReadAt(p, s.off+off)
+}
+
+func (s *spilled) truncate(n int) {
+	s.store.release(s.off+int64(n), int64(s.n-n))
+	s.n = n
+}
+
+func (s *spilled) split(n int) coldData {
+	right := &spilled{s.store, s.off + int64(n), s.n - n}
+	s.n = n
+	return right
+}
+
+func (s *spilled) release() {
+	s.store.release(s.off, int64(s.n))
+	s.n = 0
+}
+
+// release notes that size bytes at off are no longer in use.  If we created
+// the store, we punch a hole there to give the space back.
+func (s *spillStore) release(off, size int64) {
+	s.used -= size
+	if s.tmp != nil && size > 0 {
+		punchHole(s.tmp, off, size)
+	}
+}
+
+// SetMemoryLimit limits the segment data b keeps in memory to about limit
+// bytes.  When a write takes b over the limit, the least recently used
+// segments are spilled to store, or to a temporary file if store is nil.
+// Spilled segments are read directly from the store, and are brought back
+// into memory only when they are modified.  A limit of 0 removes the limit,
+// but does not bring spilled segments back into memory.
+//
+// A Buffer that creates a temporary file should be closed with Close when it
+// is no longer needed.
+func (b *Buffer) SetMemoryLimit(limit int64, store SpillStore) {
+	b.limit = limit
+	if store != nil {
+		b.store = &spillStore{SpillStore: store}
+	}
+	b.spillCold()
+}
+
+// MemoryUsage returns the number of bytes of segment data held in memory, and
+// the number of bytes spilled to the backing store.
+func (b *Buffer) MemoryUsage() (resident, spilled int64) {
+	resident = b.resident
+	if b.store != nil {
+		spilled = b.store.used
+	}
+	return
+}
+
+// Err returns the first error encountered spilling data to the backing store,
+// or by a call to StoreAt.  Segments that could not be spilled remain in
+// memory.
+func (b *Buffer) Err() error {
+	return b.err
+}
+
+func (b *Buffer) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Close empties the buffer and removes any temporary file it created for
+// spilling data.
+func (b *Buffer) Close() error {
+	b.Reset()
+	if b.store == nil || b.store.tmp == nil {
+		return nil
+	}
+	tmp := b.store.tmp
+	b.store = nil
+	err := tmp.Close()
+	if rerr := os.Remove(tmp.Name()); err == nil && !os.IsNotExist(rerr) {
+		err = rerr
+	}
+	return err
+}
+
+// spillCold spills the least recently used segments until b is within its
+// memory limit.
+func (b *Buffer) spillCold() {
+	if b.limit <= 0 || b.resident <= b.limit || b.err != nil {
+		return
+	}
+	var idx []int
+	for i := range b.es {
+		if b.es[i].cold == nil && len(b.es[i].data) > 0 {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool { return b.es[idx[i]].used < b.es[idx[j]].used })
+	for _, i := range idx {
+		if b.resident <= b.limit {
+			break
+		}
+		if err := b.spill(&b.es[i]); err != nil {
+			b.setErr(err)
+			return
+		}
+	}
+}
+
+// spill moves the data of s to the backing store.
+func (b *Buffer) spill(s *segment) error {
+	if b.store == nil {
+		f, err := ioutil.TempFile("", "sparse-spill")
+		if err != nil {
+			return err
+		}
+		b.store = &spillStore{SpillStore: f, tmp: f}
+	}
+	st := b.store
+	if _, err := st.WriteAt(s.data, st.next); err != nil {
+		return err
+	}
+	cold := &spilled{st, st.next, len(s.data)}
+	st.next += int64(len(s.data))
+	st.used += int64(len(s.data))
+	b.resident -= int64(len(s.data))
+	b.stats.capacity -= int64(cap(s.data))
+	s.data = nil
+	s.cold = cold
+	return nil
+}
@@ -0,0 +1,149 @@
+package sparse_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/dnesting/sparse"
+	"github.com/dnesting/sparse/sparsetest"
+)
+
+// memStore is a SpillStore held in memory, for testing.
+type memStore struct {
+	data   []byte
+	writes int
+}
+
+func (m *memStore) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memStore) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	m.writes++
+	return copy(m.data[off:], p), nil
+}
+
+func TestSpillConformance(t *testing.T) {
+	sparsetest.TestReadWriteFinder(t, func(t *testing.T) sparse.ReadWriteFinder {
+		sb := new(sparse.Buffer)
+		sb.SetMemoryLimit(16, &memStore{})
+		return sb
+	})
+}
+
+func TestSpill(t *testing.T) {
+	var sb sparse.Buffer
+	var store memStore
+	sb.SetMemoryLimit(8, &store)
+
+	sb.WriteAt([]byte("AAAAA"), 0)
+	sb.WriteAt([]byte("BBBBB"), 10)
+	if resident, spilled := sb.MemoryUsage(); resident != 5 || spilled != 5 {
+		t.Errorf("MemoryUsage should report 5 resident and 5 spilled, got %d and %d", resident, spilled)
+	}
+	if store.writes != 1 {
+		t.Errorf("the least recently used segment should have been spilled, got %d writes", store.writes)
+	}
+
+	// Reads come from the store without bringing the segment back.
+	if got := readAll(t, &sb); got != "AAAAA.....BBBBB" {
+		t.Errorf("Buffer should read AAAAA.....BBBBB, got %s", got)
+	}
+
+	// Writes that merge with a spilled segment need its data.
+	sb.WriteAt([]byte("CC"), 4)
+	sb.Truncate(12)
+	if got := readAll(t, &sb); got != "AAAACC....BB" {
+		t.Errorf("Buffer should read AAAACC....BB, got %s", got)
+	}
+	if resident, _ := sb.MemoryUsage(); resident > 8 {
+		t.Errorf("MemoryUsage should report at most 8 resident, got %d", resident)
+	}
+	if err := sb.Err(); err != nil {
+		t.Errorf("Err should return nil, got %v", err)
+	}
+}
+
+func TestSpillTempFile(t *testing.T) {
+	var sb sparse.Buffer
+	sb.SetMemoryLimit(1, nil)
+	sb.WriteAt([]byte("AAA"), 0)
+	sb.WriteAt([]byte("BBB"), 5)
+	if _, spilled := sb.MemoryUsage(); spilled != 6 {
+		t.Errorf("MemoryUsage should report 6 spilled, got %d", spilled)
+	}
+	if got := readAll(t, &sb); got != "AAA..BBB" {
+		t.Errorf("Buffer should read AAA..BBB, got %s", got)
+	}
+	if err := sb.Close(); err != nil {
+		t.Errorf("Close returned error %v", err)
+	}
+	if sb.Size() != 0 {
+		t.Errorf("Close should empty the Buffer, Size is %d", sb.Size())
+	}
+}
+
+// readAll reads all of sb, showing holes as '.'.
+func readAll(t *testing.T, sb *sparse.Buffer) string {
+	buf := make([]byte, sb.Size())
+	readBuf(sb, buf)
+	if err := sb.Err(); err != nil {
+		t.Errorf("Buffer reports error %v", err)
+	}
+	return printable(buf)
+}
+
+// TestSpillRandom applies the same random writes to a Buffer with and without
+// a memory limit and ensures they end up the same.
+func TestSpillRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		var plain, limited sparse.Buffer
+		limited.SetMemoryLimit(r.Int63n(32), &memStore{})
+		var ops []string
+		for j := 0; j < 20; j++ {
+			off := r.Int63n(64)
+			p := bytes.Repeat([]byte{byte('A' + j)}, r.Intn(12))
+			switch r.Intn(6) {
+			case 0:
+				plain.Truncate(off)
+				limited.Truncate(off)
+				ops = append(ops, fmt.Sprintf("Truncate(%d)", off))
+			case 1:
+				plain.StoreAt(append([]byte(nil), p...), off)
+				limited.StoreAt(p, off)
+				ops = append(ops, fmt.Sprintf("StoreAt(%q, %d)", p, off))
+			case 2:
+				plain.PunchHole(off, int64(len(p)))
+				limited.PunchHole(off, int64(len(p)))
+				ops = append(ops, fmt.Sprintf("PunchHole(%d, %d)", off, len(p)))
+			default:
+				plain.WriteAt(p, off)
+				limited.WriteAt(p, off)
+				ops = append(ops, fmt.Sprintf("WriteAt(%q, %d)", p, off))
+			}
+		}
+		if eq, ofs, err := sparse.Equal(&plain, &limited, &sparse.EqualOptions{Strict: true}); !eq || err != nil {
+			t.Fatalf("%d: Buffers differ at %d (err=%v) after:\n%v", i, ofs, err, ops)
+		}
+		if err := limited.Err(); err != nil {
+			t.Fatalf("%d: Err returned %v", i, err)
+		}
+		if err := limited.Check(); err != nil {
+			t.Fatalf("%d: Check returned %v after:\n%v", i, err, ops)
+		}
+	}
+}
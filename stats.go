@@ -0,0 +1,147 @@
+package sparse
+
+import (
+	"container/heap"
+)
+
+// Stats describes the layout and memory use of a Buffer.
+type Stats struct {
+	Segments  int   // number of segments, including zero-length ones
+	DataBytes int64 // bytes of data held, whether resident or spilled
+	HoleBytes int64 // bytes within Size not holding data
+	Size      int64 // the logical size, as returned by Size
+
+	Largest  int64 // size of the largest segment
+	Smallest int64 // size of the smallest segment
+
+	// Resident is the number of bytes of data held in memory, and Capacity
+	// the number of bytes allocated to hold them, which may be more when
+	// segments have room to grow.
+	Resident int64
+	Capacity int64
+
+	// Compressed is the number of bytes of data held compressed, and
+	// CompressedMem the number of bytes of memory holding them.  See
+	// SetCompression.
+	Compressed    int64
+	CompressedMem int64
+
+	// Fragmentation is the fraction of segments that begin where the one
+	// before them ends, and so could be merged by Compact.
+	Fragmentation float64
+}
+
+// segStats accumulates statistics about a Buffer's segments.  It is kept up
+// to date as segments change, so that Stats need not visit every segment.
+type segStats struct {
+	segments      int
+	data          int64
+	capacity      int64
+	adjacent      int           // pairs of adjacent segments
+	compressed    int64         // bytes of data held compressed
+	compressedMem int64         // bytes of memory holding compressed data
+	sizes         map[int64]int // number of segments of each size
+	small, large  sizeHeap      // the sizes in sizes, the latter negated
+}
+
+// sizeHeap is a min-heap of segment sizes.  Sizes whose segments are all
+// removed are dropped lazily, once they reach the top or the heap grows to
+// twice the number of distinct sizes.
+type sizeHeap []int64
+
+func (h sizeHeap) Len() int            { return len(h) }
+func (h sizeHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h sizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sizeHeap) Push(x interface{}) { *h = append(*h, x.(int64)) }
+func (h *sizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// top returns the least size in h still counted in sizes, or 0 if there is
+// none, where sizes are negated in h if neg is -1.
+func (h *sizeHeap) top(sizes map[int64]int, neg int64) int64 {
+	for len(*h) > 0 && sizes[neg*(*h)[0]] == 0 {
+		heap.Pop(h)
+	}
+	if len(*h) == 0 {
+		return 0
+	}
+	return neg * (*h)[0]
+}
+
+// rebuild replaces the contents of h with the sizes counted in sizes.
+func (h *sizeHeap) rebuild(sizes map[int64]int, neg int64) {
+	*h = (*h)[:0]
+	for n := range sizes {
+		*h = append(*h, neg*n)
+	}
+	heap.Init(h)
+}
+
+// tally adds (if sign is 1) or removes (if sign is -1) the contribution of
+// es[i:j] to st, including the adjacency of each to its neighbors.  Callers
+// changing es[i:j] remove its contribution first, and add back the
+// contribution of whatever replaces it.
+func (st *segStats) tally(es []segment, i, j, sign int) {
+	for k := i; k < j; k++ {
+		s := &es[k]
+		n := int64(s.size())
+		st.segments += sign
+		st.data += int64(sign) * n
+		if s.cold == nil {
+			st.capacity += int64(sign * cap(s.data))
+		} else if c, ok := s.cold.(*compressed); ok {
+			st.compressed += int64(sign) * n
+			st.compressedMem += int64(sign) * c.memSize()
+		}
+		if st.sizes == nil {
+			st.sizes = make(map[int64]int)
+		}
+		if st.sizes[n] += sign; st.sizes[n] == 0 {
+			delete(st.sizes, n)
+		} else if sign > 0 && st.sizes[n] == 1 {
+			heap.Push(&st.small, n)
+			heap.Push(&st.large, -n)
+		}
+	}
+	if len(st.small) > 2*len(st.sizes)+8 {
+		st.small.rebuild(st.sizes, 1)
+		st.large.rebuild(st.sizes, -1)
+	}
+	for k := i - 1; k < j; k++ {
+		if k >= 0 && k+1 < len(es) && es[k].end() == es[k+1].off {
+			st.adjacent += sign
+		}
+	}
+}
+
+// recount recomputes b's statistics from scratch.
+func (b *Buffer) recount() {
+	b.stats = segStats{}
+	b.stats.tally(b.es, 0, len(b.es), 1)
+}
+
+// Stats returns statistics about b.  They are maintained as b changes, so
+// this is cheap to call.
+func (b *Buffer) Stats() Stats {
+	st := Stats{
+		Segments:  b.stats.segments,
+		DataBytes: b.stats.data,
+		Size:      b.Size(),
+		Resident:  b.resident,
+		Capacity:  b.stats.capacity,
+
+		Compressed:    b.stats.compressed,
+		CompressedMem: b.stats.compressedMem,
+	}
+	st.HoleBytes = st.Size - st.DataBytes
+	st.Largest = b.stats.large.top(b.stats.sizes, -1)
+	st.Smallest = b.stats.small.top(b.stats.sizes, 1)
+	if st.Segments > 0 {
+		st.Fragmentation = float64(b.stats.adjacent) / float64(st.Segments)
+	}
+	return st
+}
@@ -0,0 +1,75 @@
+package sparse_test
+
+import (
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+func TestStats(t *testing.T) {
+	var sb sparse.Buffer
+	if got := sb.Stats(); got != (sparse.Stats{}) {
+		t.Errorf("Stats of an empty Buffer should be zero, got %+v", got)
+	}
+
+	sb.StoreAt([]byte("AAAA"), 0)
+	sb.StoreAt([]byte("BB"), 4)
+	sb.StoreAt([]byte("C"), 10)
+	sb.StoreAt(make([]byte, 2, 8), 12)
+	sb.Truncate(20)
+
+	want := sparse.Stats{
+		Segments:      4,
+		DataBytes:     9,
+		HoleBytes:     11,
+		Size:          20,
+		Largest:       4,
+		Smallest:      1,
+		Resident:      9,
+		Capacity:      15,
+		Fragmentation: 0.25,
+	}
+	if got := sb.Stats(); got != want {
+		t.Errorf("Stats should be\n%+v, got\n%+v", want, got)
+	}
+
+	sb.PunchHole(1, 2)
+	sb.Compact(sparse.CompactOptions{})
+	want = sparse.Stats{
+		Segments:  4,
+		DataBytes: 7,
+		HoleBytes: 13,
+		Size:      20,
+		Largest:   3,
+		Smallest:  1,
+		Resident:  7,
+		Capacity:  13,
+	}
+	if got := sb.Stats(); got != want {
+		t.Errorf("Stats after PunchHole and Compact should be\n%+v, got\n%+v", want, got)
+	}
+}
+
+func TestStatsLargestSmallest(t *testing.T) {
+	var sb sparse.Buffer
+	for i := 0; i < 100; i++ {
+		sb.StoreAt(make([]byte, i+1), int64(i*200))
+	}
+	// Remove the largest and smallest segments in turn.
+	for i := 0; i < 40; i++ {
+		sb.PunchHole(int64((99-i)*200), 200)
+		sb.PunchHole(int64(i*200), 200)
+		if st := sb.Stats(); st.Largest != int64(99-i) || st.Smallest != int64(i+2) {
+			t.Errorf("step %d: Largest and Smallest should be %d and %d, got %d and %d", i, 99-i, i+2, st.Largest, st.Smallest)
+		}
+	}
+	// Bring back sizes removed before.
+	sb.StoreAt(make([]byte, 100), 99*200)
+	sb.StoreAt(make([]byte, 1), 0)
+	if st := sb.Stats(); st.Largest != 100 || st.Smallest != 1 {
+		t.Errorf("Largest and Smallest should be 100 and 1, got %d and %d", st.Largest, st.Smallest)
+	}
+	if err := sb.Check(); err != nil {
+		t.Errorf("Check returned %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package sparse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// The sync protocol brings a receiver's copy of sparse data up to date with
+// a sender's, in the style of rsync, sending only what differs:
+//
+//   1. The receiver sends a Manifest of its old copy, as written by
+//      Manifest.WriteTo.
+//   2. The sender replies with a Patch, as written by Patch.WriteTo, holding
+//      the data of the blocks that differ and the holes within them, and the
+//      new size.  Holes are sent as ranges, never as zeros.
+//
+// Blocks are compared by checksum, and holes compare equal to zeros, so the
+// receiver ends up with the same content as the sender, though explicit
+// zeros it already held in place of holes may remain.
+
+// SyncReceive makes dst match the data held by a sender calling SyncSend at
+// the other end of rw, given old, the data dst holds now.  Usually old and
+// dst are the same, such as a Buffer or a File.  Blocks are checksummed with
+// c, or with SHA-256 and DefaultBlockSize if c is nil.  Holes are made as by
+// Patch.Apply, and dst is grown with its Truncate method, so holes are written
+// as zeros only where dst cannot hold them.  This will move the file position
+// of old.
+func SyncReceive(rw io.ReadWriter, old ReadFinder, dst io.WriterAt, c *Checksummer) error {
+	if c == nil {
+		c = &Checksummer{Algorithm: SHA256}
+	}
+	oldSize := old.Size()
+	m, err := c.Sum(old)
+	if err != nil {
+		return err
+	}
+	if _, err := m.WriteTo(rw); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(rw)
+	hdr, err := readPatchHeader(r)
+	if err != nil {
+		return unexpected(err)
+	}
+	buf := make([]byte, diffChunk)
+	var zeros []byte
+	for i := uint64(0); i < hdr.NumOps; i++ {
+		op, err := readPatchOp(r)
+		if err != nil {
+			return unexpected(err)
+		}
+		if op.Kind != patchData {
+			// Holes beyond the old size are left for setSize to create, so
+			// that growing dst never writes zeros.
+			if end := op.Off + op.Len; op.Off < oldSize {
+				if end > oldSize {
+					end = oldSize
+				}
+				if err := writeHoleAt(dst, op.Off, end-op.Off, &zeros); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for off, end := op.Off, op.Off+op.Len; off < end; {
+			n := end - off
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			if _, err := io.ReadFull(r, buf[:n]); err != nil {
+				return unexpected(err)
+			}
+			if _, err := dst.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+			off += n
+		}
+	}
+	return setSize(dst, hdr.Size)
+}
+
+// syncOp is a range to be sent by SyncSend, as data or as a hole.
+type syncOp struct {
+	Extent
+	data bool
+}
+
+// SyncSend answers a receiver calling SyncReceive at the other end of rw,
+// sending what it needs to make its data match src.  This will move the file
+// position of src.
+func SyncSend(rw io.ReadWriter, src ReadFinder) error {
+	m, err := ReadManifest(rw)
+	if err != nil {
+		return err
+	}
+	bad, err := Verify(src, m)
+	if err != nil {
+		return err
+	}
+	es, err := Extents(src)
+	if err != nil {
+		return err
+	}
+	size := src.Size()
+
+	// Split the ranges that differ into data and holes.
+	var ops []syncOp
+	for _, b := range bad {
+		pos, end := b.Off, b.End()
+		if end > size {
+			end = size
+		}
+		for pos < end {
+			for len(es) > 0 && es[0].End() <= pos {
+				es = es[1:]
+			}
+			op := syncOp{Extent{pos, end - pos}, false}
+			if len(es) > 0 && es[0].Off <= pos {
+				op.data = true
+				if e := es[0].End(); e < end {
+					op.Len = e - pos
+				}
+			} else if len(es) > 0 && es[0].Off < end {
+				op.Len = es[0].Off - pos
+			}
+			ops = append(ops, op)
+			pos = op.End()
+		}
+	}
+
+	w := bufio.NewWriter(rw)
+	if err := writePatchHeader(w, size, len(ops)); err != nil {
+		return err
+	}
+	buf := make([]byte, diffChunk)
+	for _, op := range ops {
+		kind := byte(patchHole)
+		if op.data {
+			kind = patchData
+		}
+		if err := binary.Write(w, binary.BigEndian, patchOpHeader{op.Off, op.Len, kind}); err != nil {
+			return err
+		}
+		for off := op.Off; op.data && off < op.End(); {
+			n := op.End() - off
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			if err := readExtent(src, buf[:n], off); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			off += n
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,151 @@
+package sparse_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/dnesting/sparse"
+)
+
+// countingConn counts the bytes read from a net.Conn.
+type countingConn struct {
+	net.Conn
+	n int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n += n
+	return n, err
+}
+
+// syncPipe syncs dst, which holds old, to src over a net.Pipe, and returns the
+// number of bytes the receiver read from the sender.
+func syncPipe(t *testing.T, old sparse.ReadFinder, dst io.WriterAt, src sparse.ReadFinder, c *sparse.Checksummer) int {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() { done <- sparse.SyncSend(b, src) }()
+	conn := &countingConn{Conn: a}
+	if err := sparse.SyncReceive(conn, old, dst, c); err != nil {
+		t.Fatalf("SyncReceive should succeed, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("SyncSend should succeed, got %v", err)
+	}
+	return conn.n
+}
+
+func TestSync(t *testing.T) {
+	const bs = sparse.DefaultBlockSize
+	block := func(c byte) []byte { return bytes.Repeat([]byte{c}, bs) }
+
+	var old, cur sparse.Buffer
+	for i := int64(0); i < 64; i++ {
+		old.WriteAt(block(byte('A'+i%26)), i*bs)
+		cur.WriteAt(block(byte('A'+i%26)), i*bs)
+	}
+	old.Truncate(1 << 30)
+	cur.Truncate(1<<30 + 10)
+	cur.WriteAt([]byte("changed"), 5*bs+100) // one block of data
+	cur.PunchHole(10*bs, 4*bs)               // a hole
+	cur.WriteAt([]byte("new"), 1<<29)        // a new block within a hole
+	old.WriteAt(block('Z'), 100*bs)          // data the sender doesn't have
+	old.WriteAt(make([]byte, bs), 200*bs)    // zeros the sender holds as a hole
+
+	n := syncPipe(t, &old, &old, &cur, nil)
+	if eq, ofs, err := sparse.Equal(&old, &cur, &sparse.EqualOptions{}); !eq || err != nil {
+		t.Errorf("SyncReceive should leave the same content, differs at %d (err=%v)", ofs, err)
+	}
+	if old.Size() != cur.Size() {
+		t.Errorf("SyncReceive should leave size %d, got %d", cur.Size(), old.Size())
+	}
+	want := []sparse.Extent{{0, 10 * bs}, {14 * bs, 50 * bs}, {200 * bs, bs}, {1 << 29, 3}}
+	if got, _ := sparse.Extents(&old); !reflect.DeepEqual(got, want) {
+		t.Errorf("SyncReceive should leave extents %v, got %v", want, got)
+	}
+	// Only the changed block, the three new bytes and some metadata should
+	// travel.  The rest of the new block is a hole, and travels as one.
+	if n < bs+3 || n > bs+512 {
+		t.Errorf("SyncReceive should read about %d bytes, got %d", bs+3, n)
+	}
+
+	// Once in sync, nothing but metadata travels.
+	if n := syncPipe(t, &old, &old, &cur, &sparse.Checksummer{Algorithm: sparse.CRC32C, BlockSize: 512}); n > 100 {
+		t.Errorf("syncing identical data should read little, got %d bytes", n)
+	}
+}
+
+func TestSyncEmpty(t *testing.T) {
+	var old, cur sparse.Buffer
+	old.WriteAt([]byte("AAAA"), 10)
+	syncPipe(t, &old, &old, &cur, nil)
+	if old.Size() != 0 {
+		t.Errorf("syncing from empty data should leave nothing, got size %d", old.Size())
+	}
+	cur.WriteAt([]byte("BBBB"), 5)
+	syncPipe(t, &old, &old, &cur, nil)
+	if got := readAll(t, &old); got != ".....BBBB" {
+		t.Errorf("syncing into empty data should copy it, got %q", got)
+	}
+}
+
+func TestSyncSendHostile(t *testing.T) {
+	// A receiver can't make SyncSend allocate a block of any size it likes.
+	m := &sparse.Manifest{BlockSize: 1 << 50, Size: 1 << 52}
+	var rw bytes.Buffer
+	m.WriteTo(&rw)
+	var src sparse.Buffer
+	src.WriteAt([]byte("data"), 0)
+	if err := sparse.SyncSend(&rw, &src); err == nil {
+		t.Errorf("SyncSend should reject a block size of %d", m.BlockSize)
+	}
+}
+
+func TestSyncFile(t *testing.T) {
+	cleanup(sparseFile(t)) // skips if the file system lacks holes
+	f := denseFile(t, "AB.C")
+	defer cleanup(f)
+
+	// The source drops block 1 and grows into a large hole, with a little
+	// data in the middle of it.
+	const size = 64 << 20
+	var src sparse.Buffer
+	src.WriteAt(bytes.Repeat([]byte{'A'}, blockSize), 0)
+	src.WriteAt(bytes.Repeat([]byte{'C'}, blockSize), 3*blockSize)
+	src.WriteAt([]byte("new"), size/2)
+	src.Truncate(size)
+
+	syncPipe(t, sparse.NewFile(f), f, &src, nil)
+	if fi, err := f.Stat(); err != nil || fi.Size() != size {
+		t.Fatalf("SyncReceive should grow the file to %d, got %v, %v", size, fi.Size(), err)
+	}
+	if eq, ofs, err := sparse.Equal(sparse.NewFile(f), &src, nil); !eq || err != nil {
+		t.Fatalf("SyncReceive should leave the same content, differs at %d (err=%v)", ofs, err)
+	}
+
+	// The growth must not have been written as zeros.
+	es, err := sparse.Extents(sparse.NewFile(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data int64
+	for _, e := range es {
+		data += e.Len
+	}
+	if data > 1<<20 {
+		t.Errorf("SyncReceive should leave little data in the file, got extents %v", es)
+	}
+	if runtime.GOOS == "linux" {
+		for _, e := range es {
+			if e.Off < 2*blockSize && e.End() > blockSize {
+				t.Errorf("SyncReceive should punch out block 1, got extents %v", es)
+			}
+		}
+	}
+}